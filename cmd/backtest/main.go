@@ -0,0 +1,154 @@
+// Command backtest replays a merchant's history through the matching engine
+// with a chosen strategy and configuration, and compares the result and the
+// production matches against the manually confirmed ones. It never writes.
+//
+//	backtest -merchant 1 -from 2024-03-01 -to 2024-03-31 -mode optimal -tolerance-paise 100
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gorm.io/gorm"
+
+	"upisettle/internal/config"
+	"upisettle/internal/logger"
+	"upisettle/internal/matching"
+	"upisettle/internal/storage"
+)
+
+func main() {
+	var (
+		merchantID     = flag.Uint("merchant", 0, "merchant id (required)")
+		stores         = flag.String("store", "", "comma-separated store ids; default all stores")
+		from           = flag.String("from", "", "first business day in the merchant's timezone, YYYY-MM-DD (required)")
+		to             = flag.String("to", "", "last business day, YYYY-MM-DD; default -from")
+		mode           = flag.String("mode", matching.ModeGreedy, "reconcile mode: greedy or optimal")
+		strategies     = flag.String("strategies", "", "comma-separated strategy priority; default each store's settings")
+		timeWindow     = flag.Duration("time-window", 0, "amount/time scorer window; default MATCH_TIME_WINDOW")
+		combinedWindow = flag.Duration("combined-window", 0, "combined payment window; default MATCH_COMBINED_WINDOW")
+		threshold      = flag.Float64("threshold", 0, "auto-match confidence threshold; default MATCH_AUTO_THRESHOLD")
+		lookback       = flag.Int("lookback", -1, "payment lookback in minutes; default each store's settings")
+		lookahead      = flag.Int("lookahead", -1, "payment lookahead in minutes; default each store's settings")
+		tolPaise       = flag.Int64("tolerance-paise", -1, "absolute amount tolerance; default each store's settings")
+		tolPct         = flag.Float64("tolerance-pct", -1, "relative amount tolerance in percent; default each store's settings")
+		verbose        = flag.Bool("v", false, "print every store-day")
+	)
+	flag.Parse()
+
+	if *merchantID == 0 || *from == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *to == "" {
+		to = from
+	}
+
+	cfg, err := config.LoadTool()
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+	if *timeWindow > 0 {
+		cfg.MatchTimeWindow = *timeWindow
+	}
+	if *combinedWindow > 0 {
+		cfg.MatchCombinedWindow = *combinedWindow
+	}
+	if *threshold > 0 {
+		cfg.MatchAutoThreshold = *threshold
+	}
+
+	opts := matching.BacktestOptions{MerchantID: *merchantID, Mode: *mode}
+	if opts.From, err = time.Parse("2006-01-02", *from); err != nil {
+		log.Fatalf("invalid -from: %v", err)
+	}
+	if opts.To, err = time.Parse("2006-01-02", *to); err != nil {
+		log.Fatalf("invalid -to: %v", err)
+	}
+	if *stores != "" {
+		for _, s := range strings.Split(*stores, ",") {
+			id, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+			if err != nil {
+				log.Fatalf("invalid -store: %v", err)
+			}
+			opts.StoreIDs = append(opts.StoreIDs, uint(id))
+		}
+	}
+	if *strategies != "" {
+		for _, s := range strings.Split(*strategies, ",") {
+			opts.Overrides.Strategies = append(opts.Overrides.Strategies, strings.TrimSpace(s))
+		}
+	}
+	if *lookback >= 0 {
+		opts.Overrides.LookbackMinutes = lookback
+	}
+	if *lookahead >= 0 {
+		opts.Overrides.LookaheadMinutes = lookahead
+	}
+	if *tolPaise >= 0 {
+		opts.Overrides.TolerancePaise = tolPaise
+	}
+	if *tolPct >= 0 {
+		opts.Overrides.TolerancePct = tolPct
+	}
+
+	db, err := storage.NewDB(cfg, logger.New(cfg.Env))
+	if err != nil {
+		log.Fatalf("failed to connect to database: %v", err)
+	}
+
+	// A read-only transaction guarantees the replay can't touch production
+	// data and gives it one consistent snapshot.
+	var report matching.BacktestReport
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SET TRANSACTION READ ONLY").Error; err != nil {
+			return err
+		}
+		var err error
+		report, err = matching.NewService(tx, cfg).Backtest(opts)
+		return err
+	})
+	if err != nil {
+		log.Fatalf("backtest failed: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if *verbose {
+		fmt.Fprintln(w, "STORE\tDATE\tCONFIRMED\tREPLAY P/R\tPROD P/R\tREPLAY MATCHES\tPROD MATCHES\tREPLAY EXC\tPROD EXC")
+		for _, d := range report.Days {
+			fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\t%d\t%d\t%d\t%d\n",
+				d.StoreID, d.Date, d.Confirmed,
+				precisionRecall(d.Replay), precisionRecall(d.Production),
+				d.Replay.Matches, d.Production.Matches,
+				d.Replay.Exceptions, d.Production.Exceptions)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "\tREPLAY (%s)\tPRODUCTION\n", report.Mode)
+	row := func(name string, replay, production any) {
+		fmt.Fprintf(w, "%s\t%v\t%v\n", name, replay, production)
+	}
+	row("precision", percent(report.Replay.Precision), percent(report.Production.Precision))
+	row("recall", percent(report.Replay.Recall), percent(report.Production.Recall))
+	row("matches", report.Replay.Matches, report.Production.Matches)
+	row("true positives", report.Replay.TruePositives, report.Production.TruePositives)
+	row("false positives", report.Replay.FalsePositives, report.Production.FalsePositives)
+	row("false negatives", report.Replay.FalseNegatives, report.Production.FalseNegatives)
+	row("ambiguous", report.Replay.Ambiguous, report.Production.Ambiguous)
+	row("exceptions", report.Replay.Exceptions, report.Production.Exceptions)
+	w.Flush()
+}
+
+func percent(f float64) string {
+	return fmt.Sprintf("%.1f%%", f*100)
+}
+
+func precisionRecall(m matching.BacktestMetrics) string {
+	return percent(m.Precision) + "/" + percent(m.Recall)
+}
@@ -0,0 +1,206 @@
+// Command webhookstub plays a payment provider against a local server: it
+// builds a payment webhook in the provider's format, signs it with the
+// endpoint secret the way the provider does and delivers it, optionally
+// several times to exercise replay handling.
+//
+//	webhookstub -provider soundbox -key 3f2a... -secret 9c1e... -amount 25000 -target SB123 -repeat 2
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+type event struct {
+	id, ref, vpa, name, target string
+	amount                     int64 // paise
+	success                    bool
+	at                         time.Time
+}
+
+func main() {
+	var (
+		baseURL  = flag.String("url", "http://localhost:8080/api/v1", "API base URL")
+		provider = flag.String("provider", "soundbox", "provider format: razorpay, cashfree or soundbox")
+		key      = flag.String("key", "", "endpoint key (required)")
+		secret   = flag.String("secret", "", "endpoint secret (required)")
+		amount   = flag.Int64("amount", 25000, "amount in paise")
+		ref      = flag.String("ref", "", "UPI ref; default random")
+		vpa      = flag.String("vpa", "customer@okaxis", "payer VPA")
+		name     = flag.String("name", "TEST CUSTOMER", "payer name")
+		target   = flag.String("target", "", "QR code id (razorpay) or device id (soundbox)")
+		eventID  = flag.String("event", "", "provider event id, digits; default random")
+		failed   = flag.Bool("failed", false, "send a failed payment instead of a credit")
+		repeat   = flag.Int("repeat", 1, "deliveries of the same event")
+		tamper   = flag.Bool("tamper", false, "sign with a wrong secret")
+	)
+	flag.Parse()
+
+	if *key == "" || *secret == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ev := event{
+		id:      *eventID,
+		ref:     *ref,
+		vpa:     *vpa,
+		name:    *name,
+		target:  *target,
+		amount:  *amount,
+		success: !*failed,
+		at:      time.Now(),
+	}
+	if ev.ref == "" {
+		ev.ref = randomDigits(12)
+	}
+	if ev.id == "" {
+		ev.id = randomDigits(14)
+	}
+
+	signingSecret := *secret
+	if *tamper {
+		signingSecret += "x"
+	}
+
+	url := fmt.Sprintf("%s/webhooks/%s/%s", *baseURL, *provider, *key)
+	for i := 1; i <= *repeat; i++ {
+		req, err := build(*provider, url, ev, signingSecret)
+		if err != nil {
+			log.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Fatalf("delivery %d failed: %v", i, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		fmt.Printf("delivery %d: %s\n%s\n", i, resp.Status, body)
+	}
+}
+
+// build makes a signed delivery of ev in a provider's format.
+func build(provider, url string, ev event, secret string) (*http.Request, error) {
+	var (
+		payload any
+		header  = http.Header{"Content-Type": {"application/json"}}
+	)
+	switch provider {
+	case "razorpay":
+		status, name := "captured", "payment.captured"
+		if !ev.success {
+			status, name = "failed", "payment.failed"
+		}
+		if ev.target != "" && ev.success {
+			name = "qr_code.credited"
+		}
+		header.Set("X-Razorpay-Event-Id", "evt_"+ev.id)
+		payload = map[string]any{
+			"entity": "event",
+			"event":  name,
+			"payload": map[string]any{
+				"payment": map[string]any{"entity": map[string]any{
+					"id":            "pay_" + ev.ref,
+					"amount":        ev.amount,
+					"currency":      "INR",
+					"status":        status,
+					"method":        "upi",
+					"vpa":           ev.vpa,
+					"created_at":    ev.at.Unix(),
+					"acquirer_data": map[string]any{"rrn": ev.ref},
+				}},
+				"qr_code": map[string]any{"entity": map[string]any{"id": ev.target}},
+			},
+		}
+	case "cashfree":
+		status, name := "SUCCESS", "PAYMENT_SUCCESS_WEBHOOK"
+		if !ev.success {
+			status, name = "FAILED", "PAYMENT_FAILED_WEBHOOK"
+		}
+		header.Set("X-Webhook-Timestamp", strconv.FormatInt(ev.at.UnixMilli(), 10))
+		payload = map[string]any{
+			"type":       name,
+			"event_time": ev.at.Format(time.RFC3339),
+			"data": map[string]any{
+				"payment": map[string]any{
+					"cf_payment_id":  json.Number(ev.id),
+					"payment_status": status,
+					"payment_amount": json.Number(fmt.Sprintf("%d.%02d", ev.amount/100, ev.amount%100)),
+					"payment_time":   ev.at.Format(time.RFC3339),
+					"bank_reference": ev.ref,
+					"payment_group":  "upi",
+					"payment_method": map[string]any{"upi": map[string]any{"upi_id": ev.vpa}},
+				},
+				"customer_details": map[string]any{"customer_name": ev.name},
+			},
+		}
+	case "soundbox":
+		status := "SUCCESS"
+		if !ev.success {
+			status = "FAILED"
+		}
+		payload = map[string]any{
+			"event_id":   ev.id,
+			"device_id":  ev.target,
+			"status":     status,
+			"amount":     ev.amount,
+			"upi_ref":    ev.ref,
+			"payer_vpa":  ev.vpa,
+			"payer_name": ev.name,
+			"txn_time":   ev.at.Format(time.RFC3339),
+		}
+	default:
+		return nil, fmt.Errorf("unknown provider %q", provider)
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	switch provider {
+	case "razorpay":
+		mac.Write(body)
+		header.Set("X-Razorpay-Signature", hex.EncodeToString(mac.Sum(nil)))
+	case "cashfree":
+		mac.Write([]byte(header.Get("X-Webhook-Timestamp")))
+		mac.Write(body)
+		header.Set("X-Webhook-Signature", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	case "soundbox":
+		mac.Write(body)
+		header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	return req, nil
+}
+
+func randomDigits(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		d, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			log.Fatal(err)
+		}
+		b[i] = byte('0' + d.Int64())
+	}
+	return string(b)
+}
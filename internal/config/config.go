@@ -3,6 +3,8 @@ package config
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 )
 
 type Config struct {
@@ -10,9 +12,54 @@ type Config struct {
 	Port        string
 	DatabaseURL string
 	JWTSecret   string
+
+	// Matching defaults used by the reconciliation engine.
+	MatchTimeWindow     time.Duration
+	MatchCombinedWindow time.Duration
+	MatchAutoThreshold  float64
+	// MatchLookback and MatchLookahead widen the payment window around the
+	// business day, so payments just past midnight or left over from earlier
+	// days can still match. Stores can override them.
+	MatchLookback  time.Duration
+	MatchLookahead time.Duration
+	// MatchTolerancePaise and MatchTolerancePct are the default amount
+	// tolerance; zero means amounts must match exactly.
+	MatchTolerancePaise int64
+	MatchTolerancePct   float64
+
+	// ReconcileWorkers bounds how many background reconcile jobs run at
+	// once; ReconcileJobPoll is how often an idle worker checks the queue.
+	ReconcileWorkers int
+	ReconcileJobPoll time.Duration
+	// MerchantReconcileWorkers bounds how many stores a merchant-wide
+	// reconcile runs at once.
+	MerchantReconcileWorkers int
+
+	// DayCloseTime is the local closing time ("15:04") at which every store
+	// is reconciled in its merchant's timezone; empty disables the
+	// scheduler. DayCloseInterval is how often the scheduler checks.
+	DayCloseTime     string
+	DayCloseInterval time.Duration
+
+	// IdempotencyRetention is how long an Idempotency-Key and the response
+	// saved for it are kept.
+	IdempotencyRetention time.Duration
 }
 
 func Load() (Config, error) {
+	cfg, err := LoadTool()
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.JWTSecret == "" {
+		return cfg, fmt.Errorf("JWT_SECRET is required")
+	}
+	return cfg, nil
+}
+
+// LoadTool loads the configuration for command-line tools, which need the
+// database and matching settings but not the API's secrets.
+func LoadTool() (Config, error) {
 	cfg := Config{
 		Env:         getEnv("APP_ENV", "development"),
 		Port:        getEnv("PORT", "8080"),
@@ -23,8 +70,53 @@ func Load() (Config, error) {
 	if cfg.DatabaseURL == "" {
 		return cfg, fmt.Errorf("DATABASE_URL is required")
 	}
-	if cfg.JWTSecret == "" {
-		return cfg, fmt.Errorf("JWT_SECRET is required")
+
+	var err error
+	if cfg.MatchTimeWindow, err = getDuration("MATCH_TIME_WINDOW", 2*time.Hour); err != nil {
+		return cfg, err
+	}
+	if cfg.MatchCombinedWindow, err = getDuration("MATCH_COMBINED_WINDOW", 30*time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.MatchAutoThreshold, err = getFloat("MATCH_AUTO_THRESHOLD", 0.5); err != nil {
+		return cfg, err
+	}
+	if cfg.MatchLookback, err = getDuration("MATCH_LOOKBACK", 24*time.Hour); err != nil {
+		return cfg, err
+	}
+	if cfg.MatchLookahead, err = getDuration("MATCH_LOOKAHEAD", 2*time.Hour); err != nil {
+		return cfg, err
+	}
+	if cfg.MatchTolerancePaise, err = getInt64("MATCH_TOLERANCE_PAISE", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.MatchTolerancePct, err = getFloat("MATCH_TOLERANCE_PCT", 0); err != nil {
+		return cfg, err
+	}
+	workers, err := getInt64("RECONCILE_WORKERS", 4)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ReconcileWorkers = int(workers)
+	storeWorkers, err := getInt64("MERCHANT_RECONCILE_WORKERS", 4)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.MerchantReconcileWorkers = int(storeWorkers)
+	if cfg.ReconcileJobPoll, err = getDuration("RECONCILE_JOB_POLL", 2*time.Second); err != nil {
+		return cfg, err
+	}
+	cfg.DayCloseTime = getEnv("DAY_CLOSE_TIME", "23:30")
+	if cfg.DayCloseTime == "off" {
+		cfg.DayCloseTime = ""
+	} else if _, err := time.Parse("15:04", cfg.DayCloseTime); err != nil {
+		return cfg, fmt.Errorf("DAY_CLOSE_TIME must be HH:MM or off: %w", err)
+	}
+	if cfg.DayCloseInterval, err = getDuration("DAY_CLOSE_INTERVAL", time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.IdempotencyRetention, err = getDuration("IDEMPOTENCY_RETENTION", 24*time.Hour); err != nil {
+		return cfg, err
 	}
 
 	return cfg, nil
@@ -37,3 +129,38 @@ func getEnv(key, def string) string {
 	return def
 }
 
+func getDuration(key string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a duration (e.g. 90m): %w", key, err)
+	}
+	return d, nil
+}
+
+func getFloat(key string, def float64) (float64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a number: %w", key, err)
+	}
+	return f, nil
+}
+
+func getInt64(key string, def int64) (int64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be an integer: %w", key, err)
+	}
+	return n, nil
+}
@@ -1,6 +1,7 @@
 package http
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/gin-gonic/gin"
@@ -8,6 +9,7 @@ import (
 
 	"upisettle/internal/auth"
 	"upisettle/internal/config"
+	"upisettle/internal/idempotency"
 	"upisettle/internal/logger"
 	"upisettle/internal/matching"
 	"upisettle/internal/merchant"
@@ -22,6 +24,8 @@ type Server struct {
 	db      *gorm.DB
 	engine  *gin.Engine
 	authSvc *auth.Service
+
+	matchingSvc *matching.Service
 }
 
 func NewServer(cfg config.Config, log logger.Logger, db *gorm.DB) *Server {
@@ -48,6 +52,11 @@ func NewServer(cfg config.Config, log logger.Logger, db *gorm.DB) *Server {
 
 func (s *Server) Run() error {
 	addr := fmt.Sprintf(":%s", s.cfg.Port)
+	go s.matchingSvc.RunJobs(context.Background(), s.cfg.ReconcileWorkers, s.cfg.ReconcileJobPoll, s.log)
+	if s.cfg.DayCloseTime != "" {
+		go s.matchingSvc.RunScheduler(context.Background(), s.cfg.DayCloseTime, s.cfg.DayCloseInterval, s.log)
+	}
+
 	s.log.Printf("starting HTTP server on %s", addr)
 	return s.engine.Run(addr)
 }
@@ -67,17 +76,22 @@ func (s *Server) registerRoutes() {
 	// Protected routes
 	protected := api.Group("")
 	protected.Use(auth.AuthMiddleware(s.cfg.JWTSecret))
+	protected.Use(idempotency.Middleware(s.db, s.cfg.IdempotencyRetention))
 
 	merchantSvc := merchant.NewService(s.db)
 	orderSvc := order.NewService(s.db)
 	paymentSvc := payment.NewService(s.db)
-	matchingSvc := matching.NewService(s.db)
+	s.matchingSvc = matching.NewService(s.db, s.cfg)
+	paymentSvc.SetMatcher(s.matchingSvc)
 	reportingSvc := reporting.NewService(s.db)
 
 	merchant.RegisterHTTP(protected, merchantSvc)
 	order.RegisterHTTP(protected, orderSvc)
 	payment.RegisterHTTP(protected, paymentSvc)
-	matching.RegisterHTTP(protected, matchingSvc)
+	matching.RegisterHTTP(protected, s.matchingSvc)
 	reporting.RegisterHTTP(protected, reportingSvc)
+
+	// PSP and soundbox webhooks (signed, no user auth)
+	payment.RegisterWebhookHTTP(api, paymentSvc)
 }
 
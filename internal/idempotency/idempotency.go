@@ -0,0 +1,184 @@
+// Package idempotency makes write requests safe to retry. A client sends
+// an Idempotency-Key header with a write; the first request with the key
+// runs and its response is saved, and later requests with the same key and
+// payload get the saved response instead of running again.
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"upisettle/internal/auth"
+)
+
+const (
+	Header = "Idempotency-Key"
+	// ReplayHeader is set on responses replayed from a saved one.
+	ReplayHeader = "Idempotent-Replayed"
+
+	maxKeyLength = 255
+	// maxBodySize bounds the request bodies hashed. It is above the largest
+	// upload the API takes, a bank statement.
+	maxBodySize = 16 << 20
+)
+
+// Key is a used Idempotency-Key. ResponseStatus is zero while the first
+// request is still running.
+type Key struct {
+	ID             uint   `gorm:"primaryKey"`
+	MerchantID     uint   `gorm:"not null;uniqueIndex:idx_idempotency_keys_key"`
+	Key            string `gorm:"size:255;not null;uniqueIndex:idx_idempotency_keys_key"`
+	Method         string `gorm:"size:16;not null"`
+	Path           string `gorm:"size:512;not null"`
+	RequestHash    string `gorm:"size:64;not null"` // sha256 of method, path and body
+	ResponseStatus int
+	ResponseBody   []byte
+	ContentType    string    `gorm:"size:255"`
+	ExpiresAt      time.Time `gorm:"not null"`
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+func (Key) TableName() string {
+	return "idempotency_keys"
+}
+
+// Middleware handles Idempotency-Key on the write requests of a group that
+// has already authenticated the merchant. Keys are per merchant and kept for
+// retention. Requests without the header run as usual.
+//
+// A key reused with a different method, path or body is refused with 422;
+// one whose first request is still running gets 409. A response with a 5xx
+// status is not saved, so the request can be retried with the same key.
+func Middleware(db *gorm.DB, retention time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(Header)
+		if key == "" || c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+			c.Next()
+			return
+		}
+		if len(key) > maxKeyLength {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key is too long"})
+			return
+		}
+		merchantID := c.GetUint(auth.ContextMerchantIDKey)
+		if merchantID == 0 {
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxBodySize+1))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if len(body) > maxBodySize {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "request body too large for an idempotent request"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		path := c.Request.URL.RequestURI()
+		sum := sha256.New()
+		sum.Write([]byte(c.Request.Method + " " + path + "\n"))
+		sum.Write(body)
+		hash := hex.EncodeToString(sum.Sum(nil))
+
+		k, err := claim(db, Key{
+			MerchantID:  merchantID,
+			Key:         key,
+			Method:      c.Request.Method,
+			Path:        path,
+			RequestHash: hash,
+			ExpiresAt:   time.Now().Add(retention),
+		})
+		if errors.Is(err, errKeyTaken) {
+			switch {
+			case k.RequestHash != hash:
+				c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used with a different request"})
+			case k.ResponseStatus == 0:
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "a request with this Idempotency-Key is still in progress"})
+			default:
+				c.Header(ReplayHeader, "true")
+				c.Data(k.ResponseStatus, k.ContentType, k.ResponseBody)
+				c.Abort()
+			}
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// A handler that panics must not leave the key in progress until it
+		// expires.
+		defer func() {
+			if r := recover(); r != nil {
+				db.Delete(&k)
+				panic(r)
+			}
+		}()
+		rec := &recorder{ResponseWriter: c.Writer}
+		c.Writer = rec
+		c.Next()
+
+		status := c.Writer.Status()
+		if status >= http.StatusInternalServerError {
+			db.Delete(&k)
+			return
+		}
+		db.Model(&k).Updates(map[string]any{
+			"response_status": status,
+			"response_body":   rec.body.Bytes(),
+			"content_type":    c.Writer.Header().Get("Content-Type"),
+		})
+	}
+}
+
+var errKeyTaken = errors.New("idempotency key already used")
+
+// claim stores a new key, or returns the live one already stored with
+// errKeyTaken. An expired key is replaced, and the merchant's other expired
+// keys are cleared on the way.
+func claim(db *gorm.DB, k Key) (Key, error) {
+	now := time.Now()
+	if err := db.Where("merchant_id = ? AND expires_at < ?", k.MerchantID, now).Delete(&Key{}).Error; err != nil {
+		return Key{}, err
+	}
+	err := db.Create(&k).Error
+	if err == nil {
+		return k, nil
+	}
+	if !errors.Is(err, gorm.ErrDuplicatedKey) {
+		return Key{}, err
+	}
+	var existing Key
+	if err := db.Where("merchant_id = ? AND key = ?", k.MerchantID, k.Key).First(&existing).Error; err != nil {
+		return Key{}, err
+	}
+	return existing, errKeyTaken
+}
+
+// recorder keeps a copy of the response body as it is written.
+type recorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *recorder) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,265 @@
+package matching
+
+import (
+	"math"
+	"time"
+
+	"upisettle/internal/order"
+	"upisettle/internal/payment"
+)
+
+type edge struct {
+	payment int
+	fit     Fit
+}
+
+// planOptimal solves the store-day as a bipartite assignment problem: it
+// first maximises the number of matched pairs and then minimises the total
+// distance (1 - score) between them. The candidate graph is split into
+// connected components so that each Hungarian solve stays small.
+func (s *Service) planOptimal(pl *plan, orders []order.Order, payments []payment.Payment, used map[uint]bool) {
+	edges := make([][]edge, len(orders))
+	uf := newUnionFind(len(orders) + len(payments))
+	for i, o := range orders {
+		for j, p := range payments {
+			fit := s.scorer.Rate(o, p)
+			if fit.Score <= 0 {
+				continue
+			}
+			edges[i] = append(edges[i], edge{payment: j, fit: fit})
+			uf.union(i, len(orders)+j)
+		}
+	}
+
+	componentOrders := make(map[int][]int)
+	componentPayments := make(map[int][]int)
+	for i := range orders {
+		root := uf.find(i)
+		componentOrders[root] = append(componentOrders[root], i)
+	}
+	for j := range payments {
+		root := uf.find(len(orders) + j)
+		componentPayments[root] = append(componentPayments[root], j)
+	}
+
+	assigned := make([]int, len(orders))
+	for i := range assigned {
+		assigned[i] = -1
+	}
+	for root, rows := range componentOrders {
+		cols := componentPayments[root]
+		if len(cols) == 0 {
+			continue
+		}
+		for r, c := range solveComponent(rows, cols, edges) {
+			assigned[rows[r]] = c
+		}
+	}
+
+	owner := make(map[int]int, len(orders))
+	for i, j := range assigned {
+		if j >= 0 {
+			owner[j] = i
+		}
+	}
+
+	for i, o := range orders {
+		j := assigned[i]
+		if j < 0 {
+			var best Fit
+			for _, e := range edges[i] {
+				if e.fit.Score > best.Score {
+					best = e.fit
+				}
+			}
+			s.decide(pl, o, nil, Fit{}, best)
+			continue
+		}
+
+		fit := edgeFit(edges[i], j)
+		// The runner-up is the cheapest alternative assignment, margin
+		// further away in score; as a time gap that is margin of the window.
+		var runnerUp Fit
+		if margin := swapMargin(i, j, edges, assigned, owner); margin < fit.Score {
+			runnerUp = Fit{
+				Score:     fit.Score - margin,
+				Gap:       fit.Gap + time.Duration(margin*float64(s.scorer.TimeWindow)),
+				Tolerated: fit.Tolerated,
+			}
+		}
+		if s.decide(pl, o, &payments[j], fit, runnerUp) {
+			used[payments[j].ID] = true
+		}
+	}
+}
+
+// solveComponent returns, for each row of the component, the index of the
+// assigned payment or -1.
+func solveComponent(rows, cols []int, edges [][]edge) []int {
+	k := len(rows)
+	if len(cols) > k {
+		k = len(cols)
+	}
+	// Any infeasible pairing must cost more than every feasible assignment
+	// combined, so the solver never trades a match for a shorter distance.
+	big := float64(k) + 1
+
+	colIndex := make(map[int]int, len(cols))
+	for c, j := range cols {
+		colIndex[j] = c
+	}
+
+	cost := make([][]float64, k)
+	for r := range cost {
+		cost[r] = make([]float64, k)
+		for c := range cost[r] {
+			cost[r][c] = big
+		}
+		if r >= len(rows) {
+			continue
+		}
+		for _, e := range edges[rows[r]] {
+			cost[r][colIndex[e.payment]] = 1 - e.fit.Score
+		}
+	}
+
+	result := make([]int, len(rows))
+	for r, c := range hungarian(cost) {
+		if r >= len(rows) {
+			continue
+		}
+		result[r] = -1
+		if c < len(cols) && cost[r][c] < big {
+			result[r] = cols[c]
+		}
+	}
+	return result
+}
+
+// swapMargin is how much worse the cheapest alternative assignment for
+// order i is, considering both unused payments and single swaps with the
+// order that holds a neighbouring payment. It plays the role of the
+// runner-up gap in greedy mode.
+func swapMargin(i, j int, edges [][]edge, assigned []int, owner map[int]int) float64 {
+	current := 1 - edgeScore(edges[i], j)
+	margin := math.Inf(1)
+	for _, e := range edges[i] {
+		if e.payment == j {
+			continue
+		}
+		delta := (1 - e.fit.Score) - current
+		if other, ok := owner[e.payment]; ok {
+			otherScore := edgeScore(edges[other], j)
+			if otherScore <= 0 {
+				continue
+			}
+			delta += (1 - otherScore) - (1 - edgeScore(edges[other], e.payment))
+		}
+		if delta < 0 {
+			delta = 0
+		}
+		margin = math.Min(margin, delta)
+	}
+	return margin
+}
+
+func edgeScore(es []edge, payment int) float64 {
+	return edgeFit(es, payment).Score
+}
+
+func edgeFit(es []edge, payment int) Fit {
+	for _, e := range es {
+		if e.payment == payment {
+			return e.fit
+		}
+	}
+	return Fit{}
+}
+
+// hungarian solves the square assignment problem for the given cost matrix
+// and returns the column assigned to each row.
+func hungarian(cost [][]float64) []int {
+	n := len(cost)
+	u := make([]float64, n+1)
+	v := make([]float64, n+1)
+	p := make([]int, n+1)
+	way := make([]int, n+1)
+
+	for i := 1; i <= n; i++ {
+		p[0] = i
+		j0 := 0
+		minv := make([]float64, n+1)
+		for j := range minv {
+			minv[j] = math.Inf(1)
+		}
+		used := make([]bool, n+1)
+		for {
+			used[j0] = true
+			i0, delta, j1 := p[j0], math.Inf(1), 0
+			for j := 1; j <= n; j++ {
+				if used[j] {
+					continue
+				}
+				cur := cost[i0-1][j-1] - u[i0] - v[j]
+				if cur < minv[j] {
+					minv[j], way[j] = cur, j0
+				}
+				if minv[j] < delta {
+					delta, j1 = minv[j], j
+				}
+			}
+			for j := 0; j <= n; j++ {
+				if used[j] {
+					u[p[j]] += delta
+					v[j] -= delta
+				} else {
+					minv[j] -= delta
+				}
+			}
+			j0 = j1
+			if p[j0] == 0 {
+				break
+			}
+		}
+		for j0 != 0 {
+			j1 := way[j0]
+			p[j0] = p[j1]
+			j0 = j1
+		}
+	}
+
+	rowToCol := make([]int, n)
+	for j := 1; j <= n; j++ {
+		if p[j] != 0 {
+			rowToCol[p[j]-1] = j - 1
+		}
+	}
+	return rowToCol
+}
+
+type unionFind struct {
+	parent []int
+}
+
+func newUnionFind(n int) *unionFind {
+	parent := make([]int, n)
+	for i := range parent {
+		parent[i] = i
+	}
+	return &unionFind{parent: parent}
+}
+
+func (uf *unionFind) find(x int) int {
+	for uf.parent[x] != x {
+		uf.parent[x] = uf.parent[uf.parent[x]]
+		x = uf.parent[x]
+	}
+	return x
+}
+
+func (uf *unionFind) union(a, b int) {
+	ra, rb := uf.find(a), uf.find(b)
+	if ra != rb {
+		uf.parent[ra] = rb
+	}
+}
@@ -0,0 +1,112 @@
+package matching
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHungarian(t *testing.T) {
+	tests := []struct {
+		name string
+		cost [][]float64
+		want []int
+	}{
+		{
+			name: "empty",
+			cost: [][]float64{},
+			want: []int{},
+		},
+		{
+			name: "single",
+			cost: [][]float64{{0.3}},
+			want: []int{0},
+		},
+		{
+			name: "diagonal is cheapest",
+			cost: [][]float64{
+				{0.1, 0.9},
+				{0.9, 0.1},
+			},
+			want: []int{0, 1},
+		},
+		{
+			name: "greedy first pick is wrong",
+			cost: [][]float64{
+				{0.1, 0.2},
+				{0.2, 0.9},
+			},
+			want: []int{1, 0},
+		},
+		{
+			name: "three by three",
+			cost: [][]float64{
+				{4, 1, 3},
+				{2, 0, 5},
+				{3, 2, 2},
+			},
+			want: []int{1, 0, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hungarian(tt.cost); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hungarian() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSolveComponent(t *testing.T) {
+	tests := []struct {
+		name  string
+		rows  []int
+		cols  []int
+		edges [][]edge
+		want  []int
+	}{
+		{
+			name:  "more payments than orders",
+			rows:  []int{0, 1},
+			cols:  []int{0, 1, 2},
+			edges: [][]edge{{{payment: 2, fit: Fit{Score: 0.9}}, {payment: 0, fit: Fit{Score: 0.5}}}, {{payment: 2, fit: Fit{Score: 0.8}}, {payment: 1, fit: Fit{Score: 0.2}}}},
+			want:  []int{0, 2},
+		},
+		{
+			name:  "more orders than payments",
+			rows:  []int{0, 1, 2},
+			cols:  []int{0},
+			edges: [][]edge{{{payment: 0, fit: Fit{Score: 0.4}}}, {{payment: 0, fit: Fit{Score: 0.9}}}, {{payment: 0, fit: Fit{Score: 0.6}}}},
+			want:  []int{-1, 0, -1},
+		},
+		{
+			name: "match count beats distance",
+			rows: []int{0, 1},
+			cols: []int{0, 1},
+			// Giving order 0 its best payment would leave order 1 with
+			// nothing.
+			edges: [][]edge{{{payment: 0, fit: Fit{Score: 0.9}}, {payment: 1, fit: Fit{Score: 0.1}}}, {{payment: 0, fit: Fit{Score: 0.1}}}},
+			want:  []int{1, 0},
+		},
+		{
+			name:  "order without edges",
+			rows:  []int{0, 1},
+			cols:  []int{0},
+			edges: [][]edge{nil, {{payment: 0, fit: Fit{Score: 0.7}}}},
+			want:  []int{-1, 0},
+		},
+		{
+			name:  "rows and cols map back to graph indices",
+			rows:  []int{3},
+			cols:  []int{5, 7},
+			edges: [][]edge{3: {{payment: 7, fit: Fit{Score: 0.6}}, {payment: 5, fit: Fit{Score: 0.3}}}},
+			want:  []int{7},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := solveComponent(tt.rows, tt.cols, tt.edges); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("solveComponent() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
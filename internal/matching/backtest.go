@@ -0,0 +1,310 @@
+package matching
+
+import (
+	"time"
+
+	"upisettle/internal/merchant"
+	"upisettle/internal/order"
+	"upisettle/internal/payment"
+)
+
+// BacktestOptions selects the history to replay and the configuration to
+// replay it with.
+type BacktestOptions struct {
+	MerchantID uint
+	// StoreIDs restricts the backtest to some stores; empty means all.
+	StoreIDs []uint
+	// From and To are the first and last business day, inclusive. Only
+	// their dates count; the days are taken in the merchant's timezone.
+	From, To time.Time
+	Mode     string
+	// Overrides replaces fields of each store's effective settings; nil
+	// fields keep the store's own value.
+	Overrides SettingsRequest
+}
+
+// BacktestMetrics scores one side of a backtest against the manually
+// confirmed matches. Only orders with a manual match are judged, since for
+// the rest nobody has said what the right payment is.
+type BacktestMetrics struct {
+	Matches        int     `json:"matches"`
+	Exceptions     int     `json:"exceptions"`
+	Ambiguous      int     `json:"ambiguous"` // AMOUNT_MISMATCH exceptions
+	TruePositives  int     `json:"true_positives"`
+	FalsePositives int     `json:"false_positives"`
+	FalseNegatives int     `json:"false_negatives"`
+	Precision      float64 `json:"precision"`
+	Recall         float64 `json:"recall"`
+}
+
+func (m *BacktestMetrics) add(o BacktestMetrics) {
+	m.Matches += o.Matches
+	m.Exceptions += o.Exceptions
+	m.Ambiguous += o.Ambiguous
+	m.TruePositives += o.TruePositives
+	m.FalsePositives += o.FalsePositives
+	m.FalseNegatives += o.FalseNegatives
+}
+
+func (m *BacktestMetrics) finish() {
+	if judged := m.TruePositives + m.FalsePositives; judged > 0 {
+		m.Precision = float64(m.TruePositives) / float64(judged)
+	}
+	if truth := m.TruePositives + m.FalseNegatives; truth > 0 {
+		m.Recall = float64(m.TruePositives) / float64(truth)
+	}
+}
+
+// BacktestDay compares the replay with production for one store-day.
+type BacktestDay struct {
+	StoreID    uint            `json:"store_id"`
+	Date       string          `json:"date"`
+	Confirmed  int             `json:"confirmed"` // manually confirmed matches
+	Replay     BacktestMetrics `json:"replay"`
+	Production BacktestMetrics `json:"production"`
+}
+
+type BacktestReport struct {
+	Mode       string          `json:"mode"`
+	Days       []BacktestDay   `json:"days"`
+	Replay     BacktestMetrics `json:"replay"`
+	Production BacktestMetrics `json:"production"`
+}
+
+type matchPair struct {
+	OrderID   uint
+	PaymentID uint
+}
+
+// Backtest replays the history of a merchant through the matching engine
+// and scores the result, and the matches production made, against the
+// matches users confirmed by hand. It only reads: orders are replayed as if
+// unpaid apart from cash recorded against them, and nothing is written.
+func (s *Service) Backtest(opts BacktestOptions) (BacktestReport, error) {
+	if opts.Mode == "" {
+		opts.Mode = ModeGreedy
+	}
+	report := BacktestReport{Mode: opts.Mode}
+	if opts.Mode != ModeGreedy && opts.Mode != ModeOptimal {
+		return report, ErrUnknownMode
+	}
+
+	loc, err := merchant.Location(s.db, opts.MerchantID)
+	if err != nil {
+		return report, err
+	}
+	from := time.Date(opts.From.Year(), opts.From.Month(), opts.From.Day(), 0, 0, 0, 0, loc)
+	to := time.Date(opts.To.Year(), opts.To.Month(), opts.To.Day(), 0, 0, 0, 0, loc)
+
+	storeIDs := opts.StoreIDs
+	if len(storeIDs) == 0 {
+		stores, err := s.stores.ListStores(opts.MerchantID)
+		if err != nil {
+			return report, err
+		}
+		for _, st := range stores {
+			storeIDs = append(storeIDs, st.ID)
+		}
+	}
+
+	for _, storeID := range storeIDs {
+		es, err := s.settingsFor(opts.MerchantID, storeID)
+		if err != nil {
+			return report, err
+		}
+		es = applyOverrides(es, opts.Overrides)
+		tuned := s.withSettings(es)
+
+		// Payments a replayed day used are gone for the following days,
+		// as they would be in production.
+		used := make(map[uint]bool)
+		for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+			bd, err := tuned.backtestDay(opts.MerchantID, storeID, day, opts.Mode, es, used)
+			if err != nil {
+				return report, err
+			}
+			report.Days = append(report.Days, bd)
+			report.Replay.add(bd.Replay)
+			report.Production.add(bd.Production)
+		}
+	}
+	report.Replay.finish()
+	report.Production.finish()
+	return report, nil
+}
+
+func applyOverrides(es EffectiveSettings, o SettingsRequest) EffectiveSettings {
+	if len(o.Strategies) > 0 {
+		es.Strategies = o.Strategies
+	}
+	if o.LookbackMinutes != nil {
+		es.LookbackMinutes = *o.LookbackMinutes
+	}
+	if o.LookaheadMinutes != nil {
+		es.LookaheadMinutes = *o.LookaheadMinutes
+	}
+	if o.TolerancePaise != nil {
+		es.TolerancePaise = *o.TolerancePaise
+	}
+	if o.TolerancePct != nil {
+		es.TolerancePct = *o.TolerancePct
+	}
+	return es
+}
+
+func (s *Service) backtestDay(merchantID, storeID uint, start time.Time, mode string, es EffectiveSettings, used map[uint]bool) (BacktestDay, error) {
+	end := start.Add(24 * time.Hour)
+	bd := BacktestDay{StoreID: storeID, Date: start.Format("2006-01-02")}
+
+	var orders []order.Order
+	if err := s.db.
+		Where("merchant_id = ? AND store_id = ? AND created_at >= ? AND created_at < ? AND status <> ?", merchantID, storeID, start, end, order.StatusCancelled).
+		Order("created_at ASC").
+		Find(&orders).Error; err != nil {
+		return bd, err
+	}
+	orderIDs := make([]uint, 0, len(orders))
+	for _, o := range orders {
+		orderIDs = append(orderIDs, o.ID)
+	}
+
+	var payments []payment.Payment
+	if err := s.db.
+		Where("merchant_id = ? AND store_id = ? AND time >= ? AND time < ?", merchantID, storeID, start.Add(-es.lookback()), end.Add(es.lookahead())).
+		Order("time ASC").
+		Find(&payments).Error; err != nil {
+		return bd, err
+	}
+
+	var existing []Match
+	if len(orderIDs) > 0 {
+		if err := s.db.Where("order_id IN ?", orderIDs).Find(&existing).Error; err != nil {
+			return bd, err
+		}
+	}
+	truth := make(map[uint]map[uint]bool)
+	var production []matchPair
+	for _, m := range existing {
+		if m.MatchedBy != nil {
+			if truth[m.OrderID] == nil {
+				truth[m.OrderID] = make(map[uint]bool)
+			}
+			truth[m.OrderID][m.PaymentID] = true
+			bd.Confirmed++
+		} else {
+			production = append(production, matchPair{m.OrderID, m.PaymentID})
+		}
+	}
+
+	// Replay each order from scratch, keeping only the cash recorded
+	// directly against it.
+	cash := make(map[uint]int64)
+	var free, dayFree []payment.Payment
+	for _, p := range payments {
+		switch {
+		case p.OrderID != nil:
+			cash[*p.OrderID] += p.Amount
+		case p.DuplicateOfID != nil || used[p.ID]:
+		default:
+			free = append(free, p)
+			if !p.Time.Before(start) && p.Time.Before(end) {
+				dayFree = append(dayFree, p)
+			}
+		}
+	}
+	open := make([]order.Order, 0, len(orders))
+	for _, o := range orders {
+		o.PaidAmount, o.Status, o.PaidAt = 0, order.StatusPending, nil
+		if c := cash[o.ID]; c > 0 {
+			o.ApplyPayment(c, order.StatusPaidCash, o.CreatedAt)
+		}
+		if o.Outstanding() > 0 {
+			open = append(open, o)
+		}
+	}
+
+	pl, err := s.buildPlan(mode, es.Strategies, open, free)
+	if err != nil {
+		return bd, err
+	}
+	pl.addUnmatchedPayments(dayFree)
+
+	replay := make([]matchPair, 0, len(pl.matches))
+	for _, pm := range pl.matches {
+		replay = append(replay, matchPair{pm.Order.ID, pm.Payment.ID})
+		used[pm.Payment.ID] = true
+		if pm.Difference != 0 {
+			bd.Replay.Exceptions++
+		}
+	}
+	bd.Replay.Exceptions += len(pl.exceptions)
+	for _, pe := range pl.exceptions {
+		if pe.Type == ExceptionAmountMismatch {
+			bd.Replay.Ambiguous++
+		}
+	}
+	scorePairs(&bd.Replay, replay, truth)
+
+	// Production exceptions are the ones reconcile raised for the day's
+	// orders and payments, whatever has happened to them since.
+	dayPaymentIDs := make([]uint, 0, len(payments))
+	for _, p := range payments {
+		if !p.Time.Before(start) && p.Time.Before(end) {
+			dayPaymentIDs = append(dayPaymentIDs, p.ID)
+		}
+	}
+	if len(orderIDs) > 0 || len(dayPaymentIDs) > 0 {
+		var exceptions []Exception
+		q := s.db.Where("merchant_id = ? AND store_id = ? AND type IN ?", merchantID, storeID,
+			append(append([]string{}, reconcileExceptionTypes...), differenceExceptionTypes...))
+		switch {
+		case len(orderIDs) > 0 && len(dayPaymentIDs) > 0:
+			q = q.Where("order_id IN ? OR payment_id IN ?", orderIDs, dayPaymentIDs)
+		case len(orderIDs) > 0:
+			q = q.Where("order_id IN ?", orderIDs)
+		default:
+			q = q.Where("payment_id IN ?", dayPaymentIDs)
+		}
+		if err := q.Find(&exceptions).Error; err != nil {
+			return bd, err
+		}
+		bd.Production.Exceptions = len(exceptions)
+		for _, ex := range exceptions {
+			if ex.Type == ExceptionAmountMismatch {
+				bd.Production.Ambiguous++
+			}
+		}
+	}
+	scorePairs(&bd.Production, production, truth)
+
+	bd.Replay.finish()
+	bd.Production.finish()
+	return bd, nil
+}
+
+// scorePairs counts predicted pairs against the confirmed ones. A
+// prediction for an order without a confirmed match is counted in Matches
+// but not judged.
+func scorePairs(m *BacktestMetrics, predicted []matchPair, truth map[uint]map[uint]bool) {
+	m.Matches = len(predicted)
+	found := make(map[matchPair]bool)
+	for _, p := range predicted {
+		payments, judged := truth[p.OrderID]
+		if !judged {
+			continue
+		}
+		if payments[p.PaymentID] {
+			m.TruePositives++
+			found[p] = true
+		} else {
+			m.FalsePositives++
+		}
+	}
+	for orderID, payments := range truth {
+		for paymentID := range payments {
+			if !found[matchPair{orderID, paymentID}] {
+				m.FalseNegatives++
+			}
+		}
+	}
+}
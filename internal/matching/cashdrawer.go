@@ -0,0 +1,275 @@
+package matching
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"upisettle/internal/payment"
+)
+
+var ErrInvalidDenomination = errors.New("denominations need a positive value and a non-negative count")
+
+// Denomination is one line of a cash count: so many notes or coins of a
+// value.
+type Denomination struct {
+	Value int64 `json:"value"` // paise per note or coin
+	Count int   `json:"count"`
+}
+
+// CashDrawer is a store's cash drawer for one business day: the float it
+// opened with and, once the day is closed, what was counted in it. The
+// drawer is expected to hold the float plus the day's cash payments minus
+// its cash payouts; a difference raises CASH_SHORTAGE or CASH_EXCESS.
+type CashDrawer struct {
+	ID             uint           `gorm:"primaryKey"`
+	MerchantID     uint           `gorm:"not null;index"`
+	StoreID        uint           `gorm:"not null;index"`
+	BusinessDate   time.Time      `gorm:"type:date;not null"`
+	OpeningFloat   int64          `gorm:"not null;default:0"`
+	Denominations  []Denomination `gorm:"serializer:json;type:jsonb"`
+	CountedAmount  *int64         // nil until the drawer is counted
+	ExpectedAmount int64          `gorm:"not null;default:0"`
+	Difference     int64          `gorm:"not null;default:0"` // counted minus expected
+	CountedBy      *uint          // user who counted the drawer
+	CountedAt      *time.Time
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+func (CashDrawer) TableName() string {
+	return "cash_drawers"
+}
+
+// cashExceptionTypes are raised for a counted drawer that does not balance.
+var cashExceptionTypes = []string{ExceptionCashShortage, ExceptionCashExcess}
+
+type OpeningFloatRequest struct {
+	Amount *int64 `json:"amount" binding:"required,gte=0"`
+}
+
+type CashCountRequest struct {
+	Denominations []Denomination `json:"denominations" binding:"required,min=1"`
+	// CountedAt defaults to now.
+	CountedAt time.Time `json:"counted_at"`
+}
+
+// GetCashDrawer returns a store's drawer for the day with the cash expected
+// in it right now. A day without a float or count yet gets an unsaved
+// drawer with a zero float.
+func (s *Service) GetCashDrawer(merchantID, storeID uint, day time.Time) (CashDrawer, error) {
+	start := startOfDay(day)
+	var d CashDrawer
+	err := s.db.Where("merchant_id = ? AND store_id = ? AND business_date = ?", merchantID, storeID, start).
+		First(&d).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		d = CashDrawer{MerchantID: merchantID, StoreID: storeID, BusinessDate: start}
+	} else if err != nil {
+		return CashDrawer{}, err
+	}
+
+	expected, err := s.expectedCash(merchantID, storeID, start, d.OpeningFloat)
+	if err != nil {
+		return CashDrawer{}, err
+	}
+	d.ExpectedAmount = expected
+	if d.CountedAmount != nil {
+		d.Difference = *d.CountedAmount - expected
+	}
+	return d, nil
+}
+
+// SetOpeningFloat records the cash the drawer opened the day with. If the
+// drawer was already counted, the count is checked again.
+func (s *Service) SetOpeningFloat(merchantID, storeID uint, day time.Time, amount int64) (CashDrawer, error) {
+	var d CashDrawer
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		start := startOfDay(day)
+		if d, err = lockCashDrawer(tx, merchantID, storeID, start); err != nil {
+			return err
+		}
+		d.OpeningFloat = amount
+		return s.withDB(tx).balanceCashDrawer(&d, start, nil)
+	})
+	return d, err
+}
+
+// RecordCashCount records the closing count of a store's drawer and raises,
+// updates or resolves the day's cash exception to match. Counting again
+// replaces the earlier count.
+func (s *Service) RecordCashCount(merchantID, storeID, userID uint, day time.Time, req CashCountRequest) (CashDrawer, error) {
+	var counted int64
+	for _, dn := range req.Denominations {
+		if dn.Value <= 0 || dn.Count < 0 {
+			return CashDrawer{}, ErrInvalidDenomination
+		}
+		counted += dn.Value * int64(dn.Count)
+	}
+	if req.CountedAt.IsZero() {
+		req.CountedAt = time.Now()
+	}
+
+	var d CashDrawer
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		start := startOfDay(day)
+		if d, err = lockCashDrawer(tx, merchantID, storeID, start); err != nil {
+			return err
+		}
+		d.Denominations = req.Denominations
+		d.CountedAmount = &counted
+		d.CountedAt = &req.CountedAt
+		d.CountedBy = nil
+		if userID != 0 {
+			d.CountedBy = &userID
+		}
+		return s.withDB(tx).balanceCashDrawer(&d, start, d.CountedBy)
+	})
+	return d, err
+}
+
+// recheckCashDrawer balances a counted drawer again, e.g. when reconcile
+// runs after cash was recorded late. Days without a count are left alone.
+func (s *Service) recheckCashDrawer(merchantID, storeID uint, start time.Time) error {
+	var d CashDrawer
+	err := s.db.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("merchant_id = ? AND store_id = ? AND business_date = ? AND counted_amount IS NOT NULL", merchantID, storeID, start).
+		First(&d).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.balanceCashDrawer(&d, start, nil)
+}
+
+// lockCashDrawer returns the store-day's drawer, creating it if needed,
+// locked for the rest of the transaction.
+func lockCashDrawer(tx *gorm.DB, merchantID, storeID uint, start time.Time) (CashDrawer, error) {
+	d := CashDrawer{MerchantID: merchantID, StoreID: storeID, BusinessDate: start}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&d).Error; err != nil {
+		return CashDrawer{}, err
+	}
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("merchant_id = ? AND store_id = ? AND business_date = ?", merchantID, storeID, start).
+		First(&d).Error
+	return d, err
+}
+
+// balanceCashDrawer recomputes the expected cash of a drawer for the day
+// starting at start, saves it and, if the drawer was counted, syncs its
+// cash exception.
+func (s *Service) balanceCashDrawer(d *CashDrawer, start time.Time, userID *uint) error {
+	expected, err := s.expectedCash(d.MerchantID, d.StoreID, start, d.OpeningFloat)
+	if err != nil {
+		return err
+	}
+	d.ExpectedAmount = expected
+	d.Difference = 0
+	if d.CountedAmount != nil {
+		d.Difference = *d.CountedAmount - expected
+	}
+	if err := s.db.Save(d).Error; err != nil {
+		return err
+	}
+	if d.CountedAmount == nil {
+		return nil
+	}
+	return s.syncCashException(d, userID)
+}
+
+// expectedCash is the opening float plus the day's cash payments minus the
+// day's cash payouts. Payments flagged as duplicates don't count.
+func (s *Service) expectedCash(merchantID, storeID uint, start time.Time, openingFloat int64) (int64, error) {
+	end := start.Add(24 * time.Hour)
+
+	var cashIn int64
+	if err := s.db.Model(&payment.Payment{}).
+		Where("merchant_id = ? AND store_id = ? AND channel = ? AND duplicate_of_id IS NULL AND time >= ? AND time < ?", merchantID, storeID, payment.ChannelCash, start, end).
+		Select("COALESCE(SUM(amount), 0)").Scan(&cashIn).Error; err != nil {
+		return 0, err
+	}
+	var cashOut int64
+	if err := s.db.Model(&payment.CashPayout{}).
+		Where("merchant_id = ? AND store_id = ? AND time >= ? AND time < ?", merchantID, storeID, start, end).
+		Select("COALESCE(SUM(amount), 0)").Scan(&cashOut).Error; err != nil {
+		return 0, err
+	}
+	return openingFloat + cashIn - cashOut, nil
+}
+
+// syncCashException keeps one open exception per counted drawer carrying
+// the current difference. An open exception of the right type is updated
+// in place, one of the wrong type is resolved, and a drawer that balances
+// resolves it. A shortage or excess a user already wrote off or ignored is
+// not raised again unless the amount changes.
+func (s *Service) syncCashException(d *CashDrawer, userID *uint) error {
+	want := ""
+	switch {
+	case d.Difference < 0:
+		want = ExceptionCashShortage
+	case d.Difference > 0:
+		want = ExceptionCashExcess
+	}
+
+	var current []Exception
+	if err := s.db.Where("cash_drawer_id = ? AND type IN ?", d.ID, cashExceptionTypes).
+		Order("id DESC").
+		Find(&current).Error; err != nil {
+		return err
+	}
+
+	kept := false
+	for i := range current {
+		ex := &current[i]
+		if ex.Resolved {
+			continue
+		}
+		if ex.Type == want && !kept {
+			kept = true
+			ex.DifferenceAmount = d.Difference
+			ex.Reason = describeCashDifference(d)
+			if err := s.db.Save(ex).Error; err != nil {
+				return err
+			}
+			continue
+		}
+		ex.ResolutionReason = "drawer recounted"
+		if err := transition(s.db, ex, ExceptionStatusResolved, "", userID); err != nil {
+			return err
+		}
+	}
+	if want == "" || kept {
+		return nil
+	}
+	for _, ex := range current {
+		if ex.Type == want && ex.DifferenceAmount == d.Difference &&
+			(ex.Status == ExceptionStatusWrittenOff || ex.Status == ExceptionStatusIgnored) {
+			return nil
+		}
+	}
+
+	drawerID := d.ID
+	ex := Exception{
+		MerchantID:       d.MerchantID,
+		StoreID:          d.StoreID,
+		CashDrawerID:     &drawerID,
+		Type:             want,
+		Reason:           describeCashDifference(d),
+		DifferenceAmount: d.Difference,
+		Status:           ExceptionStatusOpen,
+	}
+	return s.db.Create(&ex).Error
+}
+
+func describeCashDifference(d *CashDrawer) string {
+	if d.Difference < 0 {
+		return fmt.Sprintf("counted %d paise, %d paise less than the %d paise expected", *d.CountedAmount, -d.Difference, d.ExpectedAmount)
+	}
+	return fmt.Sprintf("counted %d paise, %d paise more than the %d paise expected", *d.CountedAmount, d.Difference, d.ExpectedAmount)
+}
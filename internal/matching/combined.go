@@ -0,0 +1,91 @@
+package matching
+
+import (
+	"fmt"
+	"sort"
+
+	"upisettle/internal/order"
+	"upisettle/internal/payment"
+)
+
+const (
+	// maxCombinedOrders caps how many orders one payment may cover.
+	maxCombinedOrders = 4
+	// maxCombinedCandidates caps the orders searched per payment, nearest first.
+	maxCombinedCandidates = 12
+	// combinedConfidenceFactor scales down combined-bill matches so the
+	// owner is prompted to confirm them.
+	combinedConfidenceFactor = 0.5
+)
+
+type combinedCandidate struct {
+	order order.Order
+	fit   Fit
+}
+
+// planCombined looks for a single payment that covers several open orders
+// placed shortly before or after it, e.g. a regular customer paying for two
+// or three orders at once. Every covered order gets its own match for its
+// outstanding balance.
+func (s *Service) planCombined(pl *plan, orders []order.Order, payments []payment.Payment, used map[uint]bool) {
+	matched := make(map[uint]bool)
+	for _, pm := range pl.matches {
+		matched[pm.Order.ID] = true
+	}
+
+	for _, p := range payments {
+		if used[p.ID] {
+			continue
+		}
+
+		var cands []combinedCandidate
+		for _, o := range orders {
+			outstanding := o.Outstanding()
+			if matched[o.ID] || outstanding <= 0 || outstanding >= p.Amount {
+				continue
+			}
+			if fit := s.combinedScorer.timeFit(o.CreatedAt, p.Time); fit.Score > 0 {
+				cands = append(cands, combinedCandidate{order: o, fit: fit})
+			}
+		}
+		if len(cands) < 2 {
+			continue
+		}
+		sort.SliceStable(cands, func(i, j int) bool { return cands[i].fit.Score > cands[j].fit.Score })
+		if len(cands) > maxCombinedCandidates {
+			cands = cands[:maxCombinedCandidates]
+		}
+
+		amounts := make([]int64, len(cands))
+		fits := make([]Fit, len(cands))
+		for i, c := range cands {
+			amounts[i], fits[i] = c.order.Outstanding(), c.fit
+		}
+		best, bestFit, runnerUp := bestSubset(amounts, fits, p.Amount, maxCombinedOrders)
+		if best == nil {
+			continue
+		}
+		// The threshold applies to how clearly the grouping stands out; the
+		// matches are stored with a discounted confidence for guessing it.
+		conf := s.combinedScorer.Confidence(bestFit, runnerUp)
+		if conf < s.threshold {
+			continue
+		}
+		conf *= combinedConfidenceFactor
+
+		for _, i := range best {
+			o := cands[i].order
+			pl.dropOrderException(o.ID)
+			pl.matches = append(pl.matches, plannedMatch{
+				Order:      o,
+				Payment:    p,
+				Amount:     o.Outstanding(),
+				Kind:       MatchKindCombined,
+				Confidence: conf,
+				Reason:     fmt.Sprintf("payment covers %d orders placed close together; please confirm", len(best)),
+			})
+			matched[o.ID] = true
+		}
+		used[p.ID] = true
+	}
+}
@@ -0,0 +1,71 @@
+package matching
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"upisettle/internal/config"
+	"upisettle/internal/order"
+	"upisettle/internal/payment"
+)
+
+func TestPlanCombined(t *testing.T) {
+	t.Setenv("DATABASE_URL", "postgres://localhost/test")
+	cfg, err := config.LoadTool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(nil, cfg)
+
+	paidAt := time.Date(2024, 3, 12, 13, 0, 0, 0, time.UTC)
+	ord := func(id uint, amount int64, before time.Duration) order.Order {
+		return order.Order{ID: id, Amount: amount, Status: order.StatusPending, CreatedAt: paidAt.Add(-before)}
+	}
+	p := payment.Payment{ID: 1, Amount: 100000, Time: paidAt}
+
+	tests := []struct {
+		name     string
+		orders   []order.Order
+		want     []uint
+		wantConf float64
+	}{
+		{
+			name:   "two orders add up to the payment",
+			orders: []order.Order{ord(1, 60000, 5*time.Minute), ord(2, 40000, 3*time.Minute), ord(3, 30000, 4*time.Minute)},
+			want:   []uint{2, 1}, // nearest first
+			// Mean time score (25/30 + 27/30) / 2, halved.
+			wantConf: 52.0 / 60 * combinedConfidenceFactor,
+		},
+		{
+			name:   "grouping is ambiguous",
+			orders: []order.Order{ord(1, 50000, 4*time.Minute), ord(2, 50000, 5*time.Minute), ord(3, 50000, 6*time.Minute)},
+		},
+		{
+			name:   "orders outside the combined window",
+			orders: []order.Order{ord(1, 60000, time.Hour), ord(2, 40000, 3*time.Minute)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pl plan
+			used := make(map[uint]bool)
+			svc.planCombined(&pl, tt.orders, []payment.Payment{p}, used)
+
+			if len(pl.matches) != len(tt.want) {
+				t.Fatalf("got %d matches, want %d: %+v", len(pl.matches), len(tt.want), pl.matches)
+			}
+			for i, pm := range pl.matches {
+				if pm.Order.ID != tt.want[i] || pm.Kind != MatchKindCombined || pm.Amount != pm.Order.Amount {
+					t.Errorf("match %d = order %d, kind %s, amount %d", i, pm.Order.ID, pm.Kind, pm.Amount)
+				}
+				if math.Abs(pm.Confidence-tt.wantConf) > 1e-9 {
+					t.Errorf("match %d confidence = %v, want %v", i, pm.Confidence, tt.wantConf)
+				}
+			}
+			if used[p.ID] != (len(tt.want) > 0) {
+				t.Errorf("payment used = %v", used[p.ID])
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package matching
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"upisettle/internal/logger"
+	"upisettle/internal/merchant"
+)
+
+// Day close statuses.
+const (
+	DayCloseStatusPending = "PENDING"
+	DayCloseStatusClosed  = "CLOSED"
+	DayCloseStatusFailed  = "FAILED"
+)
+
+// DayClose records the end-of-day reconciliation of a store's business
+// day. The scheduler creates one per store and day, so a day it has handled
+// is never reconciled automatically again.
+type DayClose struct {
+	ID           uint      `gorm:"primaryKey"`
+	MerchantID   uint      `gorm:"not null;index"`
+	StoreID      uint      `gorm:"not null;index"`
+	BusinessDate time.Time `gorm:"type:date;not null"`
+	Timezone     string    `gorm:"size:100;not null"`
+	Status       string    `gorm:"size:16;not null"`
+	JobID        *uint     // reconcile job that closes the day
+	RunID        *uint     // reconciliation run of that job, once it has finished
+	Error        string    `gorm:"size:1024"`
+	ClosedAt     *time.Time
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+func (DayClose) TableName() string {
+	return "day_closes"
+}
+
+// ListDayCloses returns the day closes of a store, newest first.
+func (s *Service) ListDayCloses(merchantID, storeID uint) ([]DayClose, error) {
+	var closes []DayClose
+	if err := s.db.Where("merchant_id = ? AND store_id = ?", merchantID, storeID).
+		Order("business_date DESC").Limit(90).
+		Find(&closes).Error; err != nil {
+		return nil, err
+	}
+	return closes, nil
+}
+
+// RunScheduler reconciles every store once a day at closeAt ("15:04") in
+// its merchant's timezone, until ctx is cancelled. Every interval it queues
+// reconcile jobs for store-days that are due and records the outcome of the
+// jobs it queued earlier.
+func (s *Service) RunScheduler(ctx context.Context, closeAt string, interval time.Duration, log logger.Logger) {
+	closing, err := time.Parse("15:04", closeAt)
+	if err != nil {
+		log.Printf("day close: invalid closing time %q, scheduler disabled", closeAt)
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.scheduleDayCloses(time.Now(), closing, log); err != nil {
+			log.Printf("day close: scheduling failed: %v", err)
+		}
+		if err := s.syncDayCloses(); err != nil {
+			log.Printf("day close: recording results failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scheduleDayCloses queues a reconcile job for each store whose business
+// day has reached its closing time and has no day close yet. Yesterday is
+// always due, so a day missed while the server was down is caught up.
+func (s *Service) scheduleDayCloses(now, closing time.Time, log logger.Logger) error {
+	var merchants []merchant.Merchant
+	if err := s.db.Find(&merchants).Error; err != nil {
+		return err
+	}
+
+	for _, m := range merchants {
+		loc, err := time.LoadLocation(m.Timezone)
+		if err != nil {
+			log.Printf("day close: merchant %d has unknown timezone %q, skipping", m.ID, m.Timezone)
+			continue
+		}
+		local := now.In(loc)
+		today := startOfDay(local)
+		due := []time.Time{today.AddDate(0, 0, -1)}
+		if !local.Before(today.Add(time.Duration(closing.Hour())*time.Hour + time.Duration(closing.Minute())*time.Minute)) {
+			due = append(due, today)
+		}
+
+		var stores []merchant.Store
+		if err := s.db.Where("merchant_id = ?", m.ID).Find(&stores).Error; err != nil {
+			return err
+		}
+		for _, st := range stores {
+			for _, day := range due {
+				// Don't close days before the store existed.
+				if !st.CreatedAt.Before(day.AddDate(0, 0, 1)) {
+					continue
+				}
+				if err := s.scheduleDayClose(m.ID, st.ID, day); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// scheduleDayClose claims the day close of a store-day and queues its job.
+// The unique index on day_closes makes the claim safe across instances, and
+// the claim and the job are committed together, so a claimed day always has
+// a job to close it.
+func (s *Service) scheduleDayClose(merchantID, storeID uint, day time.Time) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		dc := DayClose{
+			MerchantID:   merchantID,
+			StoreID:      storeID,
+			BusinessDate: day,
+			Timezone:     day.Location().String(),
+			Status:       DayCloseStatusPending,
+		}
+		res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&dc)
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+
+		job, err := s.withDB(tx).EnqueueReconcile(merchantID, storeID, day, ReconcileOptions{})
+		if err != nil {
+			return err
+		}
+		return tx.Model(&dc).Update("job_id", job.ID).Error
+	})
+}
+
+// syncDayCloses copies the outcome of finished jobs onto their day closes.
+func (s *Service) syncDayCloses() error {
+	var pending []DayClose
+	if err := s.db.Where("status = ? AND job_id IS NOT NULL", DayCloseStatusPending).Find(&pending).Error; err != nil {
+		return err
+	}
+
+	for _, dc := range pending {
+		var job ReconcileJob
+		if err := s.db.First(&job, *dc.JobID).Error; err != nil {
+			return err
+		}
+		switch job.Status {
+		case JobStatusSucceeded:
+			now := time.Now()
+			dc.Status = DayCloseStatusClosed
+			dc.RunID = job.RunID
+			dc.ClosedAt = &now
+		case JobStatusFailed:
+			dc.Status = DayCloseStatusFailed
+			dc.RunID = job.RunID
+			dc.Error = job.Error
+		default:
+			continue
+		}
+		if err := s.db.Save(&dc).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
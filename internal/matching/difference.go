@@ -0,0 +1,49 @@
+package matching
+
+import "fmt"
+
+// roundingUnits are the steps customers round bills to: one, five and ten
+// rupees, in paise.
+var roundingUnits = []int64{100, 500, 1000}
+
+// differenceType classifies a tolerated amount difference. A payment that
+// is the order amount rounded to a whole rupee, five or ten is ROUNDING;
+// anything else is an over- or underpayment.
+func differenceType(due, paid int64) string {
+	diff := paid - due
+	if diff < 0 {
+		diff = -diff
+	}
+	for _, unit := range roundingUnits {
+		if due%unit != 0 && paid%unit == 0 && diff < unit {
+			return ExceptionRounding
+		}
+	}
+	if paid > due {
+		return ExceptionOverpayment
+	}
+	return ExceptionUnderpayment
+}
+
+func describeDifference(diff int64) string {
+	if diff > 0 {
+		return fmt.Sprintf("paid %d paise more than due", diff)
+	}
+	return fmt.Sprintf("paid %d paise less than due", -diff)
+}
+
+// differenceException is the exception recorded next to a tolerated match.
+func differenceException(merchantID, storeID uint, runID *uint, pm plannedMatch) Exception {
+	orderID, paymentID := pm.Order.ID, pm.Payment.ID
+	return Exception{
+		MerchantID:       merchantID,
+		StoreID:          storeID,
+		OrderID:          &orderID,
+		PaymentID:        &paymentID,
+		Type:             differenceType(pm.Amount, pm.Amount+pm.Difference),
+		Reason:           "matched within amount tolerance, " + describeDifference(pm.Difference),
+		DifferenceAmount: pm.Difference,
+		Status:           ExceptionStatusOpen,
+		RunID:            runID,
+	}
+}
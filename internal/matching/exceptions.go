@@ -0,0 +1,121 @@
+package matching
+
+// reconcileExceptionTypes are the exception types owned by Reconcile; other
+// types are never touched by a run.
+var reconcileExceptionTypes = []string{
+	ExceptionUnmatchedOrder,
+	ExceptionUnmatchedPayment,
+	ExceptionAmountMismatch,
+}
+
+type exceptionKey struct {
+	Type      string
+	OrderID   uint
+	PaymentID uint
+}
+
+func keyOf(typ string, orderID, paymentID *uint) exceptionKey {
+	k := exceptionKey{Type: typ}
+	if orderID != nil {
+		k.OrderID = *orderID
+	}
+	if paymentID != nil {
+		k.PaymentID = *paymentID
+	}
+	return k
+}
+
+// syncExceptions makes the open exceptions in the plan's scope equal to the
+// planned ones, so that running Reconcile again for the same day never
+// duplicates them. Existing exceptions are kept (with a refreshed reason),
+// missing ones are created and stale ones are resolved. Exceptions a user
+// wrote off or ignored are not raised again.
+func (s *Service) syncExceptions(merchantID, storeID uint, runID *uint, pl plan, summary *ReconcileSummary) error {
+	var current []Exception
+	if len(pl.scopeOrderIDs) > 0 || len(pl.scopePaymentIDs) > 0 {
+		q := s.db.Where("merchant_id = ? AND store_id = ? AND type IN ?", merchantID, storeID, reconcileExceptionTypes).
+			Where("resolved = ? OR status IN ?", false, []string{ExceptionStatusWrittenOff, ExceptionStatusIgnored})
+		switch {
+		case len(pl.scopeOrderIDs) > 0 && len(pl.scopePaymentIDs) > 0:
+			q = q.Where("order_id IN ? OR payment_id IN ?", pl.scopeOrderIDs, pl.scopePaymentIDs)
+		case len(pl.scopeOrderIDs) > 0:
+			q = q.Where("order_id IN ?", pl.scopeOrderIDs)
+		default:
+			q = q.Where("payment_id IN ?", pl.scopePaymentIDs)
+		}
+		if err := q.Order("id ASC").Find(&current).Error; err != nil {
+			return err
+		}
+	}
+
+	existing := make(map[exceptionKey]*Exception, len(current))
+	dismissed := make(map[exceptionKey]bool)
+	var stale []*Exception
+	for i := range current {
+		ex := &current[i]
+		k := keyOf(ex.Type, ex.OrderID, ex.PaymentID)
+		if ex.Resolved {
+			dismissed[k] = true
+			continue
+		}
+		if _, dup := existing[k]; dup {
+			// Left over from runs before reconcile was idempotent.
+			stale = append(stale, ex)
+			continue
+		}
+		existing[k] = ex
+	}
+
+	seen := make(map[exceptionKey]bool, len(pl.exceptions))
+	for _, pe := range pl.exceptions {
+		k := keyOf(pe.Type, pe.OrderID, pe.PaymentID)
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+
+		if ex, ok := existing[k]; ok {
+			if ex.Reason != pe.Reason {
+				ex.Reason = pe.Reason
+				if err := s.db.Save(ex).Error; err != nil {
+					return err
+				}
+			}
+		} else if !dismissed[k] {
+			ex := Exception{
+				MerchantID: merchantID,
+				StoreID:    storeID,
+				OrderID:    pe.OrderID,
+				PaymentID:  pe.PaymentID,
+				Type:       pe.Type,
+				Reason:     pe.Reason,
+				Status:     ExceptionStatusOpen,
+				RunID:      runID,
+			}
+			if err := s.db.Create(&ex).Error; err != nil {
+				return err
+			}
+		}
+
+		if pe.OrderID != nil {
+			summary.UnmatchedOrders++
+		} else {
+			summary.UnmatchedPayments++
+		}
+	}
+
+	for k, ex := range existing {
+		if !seen[k] {
+			stale = append(stale, ex)
+		}
+	}
+
+	for _, ex := range stale {
+		ex.ResolutionReason = "no longer applies after reconcile"
+		if err := transition(s.db, ex, ExceptionStatusResolved, "", nil); err != nil {
+			return err
+		}
+		summary.ResolvedExceptions++
+	}
+	return nil
+}
@@ -1,13 +1,16 @@
 package matching
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 
 	"upisettle/internal/auth"
+	"upisettle/internal/merchant"
 )
 
 func RegisterHTTP(rg *gin.RouterGroup, svc *Service) {
@@ -31,23 +34,707 @@ func RegisterHTTP(rg *gin.RouterGroup, svc *Service) {
 		}
 		storeID := uint(storeIDUint64)
 
-		dateStr := c.Query("date")
-		if dateStr == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "date query param is required (YYYY-MM-DD)"})
+		day, ok := merchant.QueryDay(c, svc.db, merchantID, "date")
+		if !ok {
 			return
 		}
-		day, err := time.Parse("2006-01-02", dateStr)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid date format, expected YYYY-MM-DD"})
+
+		opts := ReconcileOptions{Mode: c.Query("mode"), PlanHash: c.Query("plan_hash")}
+		if rawUserID, ok := c.Get(auth.ContextUserIDKey); ok {
+			opts.TriggeredBy, _ = rawUserID.(uint)
+		}
+
+		// preview=true returns the proposed matches and exceptions without
+		// writing anything; send its plan_hash back to apply it.
+		if c.Query("preview") == "true" {
+			preview, err := svc.Preview(merchantID, storeID, day, opts)
+			if err != nil {
+				if errors.Is(err, ErrUnknownMode) {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "invalid mode, expected greedy or optimal"})
+					return
+				}
+				if errors.Is(err, ErrUnknownStrategy) {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, preview)
 			return
 		}
 
-		summary, err := svc.Reconcile(merchantID, storeID, day)
+		summary, err := svc.Reconcile(merchantID, storeID, day, opts)
 		if err != nil {
+			if errors.Is(err, ErrUnknownMode) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid mode, expected greedy or optimal"})
+				return
+			}
+			if errors.Is(err, ErrUnknownStrategy) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if errors.Is(err, ErrPlanChanged) {
+				c.JSON(http.StatusConflict, gin.H{"error": "data changed since preview, please preview again"})
+				return
+			}
+			if errors.Is(err, ErrReconcileConflict) {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+				return
+			}
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 		c.JSON(http.StatusOK, summary)
 	})
+
+	// Reconciles every store of the merchant for the day.
+	rg.POST("/reconcile", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+
+		day, ok := merchant.QueryDay(c, svc.db, merchantID, "date")
+		if !ok {
+			return
+		}
+
+		opts := ReconcileOptions{Mode: c.Query("mode")}
+		if rawUserID, ok := c.Get(auth.ContextUserIDKey); ok {
+			opts.TriggeredBy, _ = rawUserID.(uint)
+		}
+
+		result, err := svc.ReconcileMerchant(merchantID, day, opts)
+		if err != nil {
+			if errors.Is(err, ErrUnknownMode) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid mode, expected greedy or optimal"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+
+	// Background variant of reconcile for large store-days: returns a job to
+	// poll instead of waiting for the run.
+	rg.POST("/stores/:storeId/reconcile-jobs", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+
+		storeIDParam := c.Param("storeId")
+		storeIDUint64, err := strconv.ParseUint(storeIDParam, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid storeId"})
+			return
+		}
+		storeID := uint(storeIDUint64)
+
+		day, ok := merchant.QueryDay(c, svc.db, merchantID, "date")
+		if !ok {
+			return
+		}
+
+		opts := ReconcileOptions{Mode: c.Query("mode")}
+		if rawUserID, ok := c.Get(auth.ContextUserIDKey); ok {
+			opts.TriggeredBy, _ = rawUserID.(uint)
+		}
+
+		job, err := svc.EnqueueReconcile(merchantID, storeID, day, opts)
+		if err != nil {
+			if errors.Is(err, ErrUnknownMode) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid mode, expected greedy or optimal"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusAccepted, job)
+	})
+
+	rg.GET("/stores/:storeId/reconcile-jobs/:jobId", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+
+		storeIDParam := c.Param("storeId")
+		storeIDUint64, err := strconv.ParseUint(storeIDParam, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid storeId"})
+			return
+		}
+		storeID := uint(storeIDUint64)
+
+		jobIDUint64, err := strconv.ParseUint(c.Param("jobId"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid jobId"})
+			return
+		}
+
+		detail, err := svc.GetJob(merchantID, storeID, uint(jobIDUint64))
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, detail)
+	})
+
+	// Day closes recorded by the end-of-day scheduler.
+	rg.GET("/stores/:storeId/day-closes", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+
+		storeIDParam := c.Param("storeId")
+		storeIDUint64, err := strconv.ParseUint(storeIDParam, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid storeId"})
+			return
+		}
+		storeID := uint(storeIDUint64)
+
+		closes, err := svc.ListDayCloses(merchantID, storeID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, closes)
+	})
+
+	// The store's cash drawer for a day: opening float, count and the cash
+	// expected in it.
+	rg.GET("/stores/:storeId/cash-drawer", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+
+		storeIDParam := c.Param("storeId")
+		storeIDUint64, err := strconv.ParseUint(storeIDParam, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid storeId"})
+			return
+		}
+		storeID := uint(storeIDUint64)
+
+		day, ok := merchant.QueryDay(c, svc.db, merchantID, "date")
+		if !ok {
+			return
+		}
+
+		drawer, err := svc.GetCashDrawer(merchantID, storeID, day)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, drawer)
+	})
+
+	rg.PUT("/stores/:storeId/cash-drawer/opening-float", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+
+		storeIDParam := c.Param("storeId")
+		storeIDUint64, err := strconv.ParseUint(storeIDParam, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid storeId"})
+			return
+		}
+		storeID := uint(storeIDUint64)
+
+		day, ok := merchant.QueryDay(c, svc.db, merchantID, "date")
+		if !ok {
+			return
+		}
+
+		var req OpeningFloatRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		drawer, err := svc.SetOpeningFloat(merchantID, storeID, day, *req.Amount)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, drawer)
+	})
+
+	rg.POST("/stores/:storeId/cash-drawer/count", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+		userID := c.GetUint(auth.ContextUserIDKey)
+
+		storeIDParam := c.Param("storeId")
+		storeIDUint64, err := strconv.ParseUint(storeIDParam, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid storeId"})
+			return
+		}
+		storeID := uint(storeIDUint64)
+
+		day, ok := merchant.QueryDay(c, svc.db, merchantID, "date")
+		if !ok {
+			return
+		}
+
+		var req CashCountRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		drawer, err := svc.RecordCashCount(merchantID, storeID, userID, day, req)
+		if err != nil {
+			if errors.Is(err, ErrInvalidDenomination) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, drawer)
+	})
+
+	rg.GET("/stores/:storeId/reconcile-runs", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+
+		storeIDParam := c.Param("storeId")
+		storeIDUint64, err := strconv.ParseUint(storeIDParam, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid storeId"})
+			return
+		}
+		storeID := uint(storeIDUint64)
+
+		// date is optional here; without it all runs of the store are listed.
+		var day *time.Time
+		if c.Query("date") != "" {
+			d, ok := merchant.QueryDay(c, svc.db, merchantID, "date")
+			if !ok {
+				return
+			}
+			day = &d
+		}
+
+		runs, err := svc.ListRuns(merchantID, storeID, day)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, runs)
+	})
+
+	rg.GET("/stores/:storeId/reconcile-runs/:runId", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+
+		storeIDParam := c.Param("storeId")
+		storeIDUint64, err := strconv.ParseUint(storeIDParam, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid storeId"})
+			return
+		}
+		storeID := uint(storeIDUint64)
+
+		runIDUint64, err := strconv.ParseUint(c.Param("runId"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid runId"})
+			return
+		}
+
+		detail, err := svc.GetRun(merchantID, storeID, uint(runIDUint64))
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "reconciliation run not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, detail)
+	})
+
+	rg.POST("/stores/:storeId/matches", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+		userID := c.GetUint(auth.ContextUserIDKey)
+
+		storeIDParam := c.Param("storeId")
+		storeIDUint64, err := strconv.ParseUint(storeIDParam, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid storeId"})
+			return
+		}
+		storeID := uint(storeIDUint64)
+
+		var req ManualMatchRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		m, err := svc.ManualMatch(merchantID, storeID, userID, req)
+		if err != nil {
+			writeManualMatchError(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, m)
+	})
+
+	rg.DELETE("/stores/:storeId/matches/:matchId", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+		userID := c.GetUint(auth.ContextUserIDKey)
+
+		storeIDParam := c.Param("storeId")
+		storeIDUint64, err := strconv.ParseUint(storeIDParam, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid storeId"})
+			return
+		}
+		storeID := uint(storeIDUint64)
+
+		matchIDUint64, err := strconv.ParseUint(c.Param("matchId"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid matchId"})
+			return
+		}
+
+		if err := svc.Unmatch(merchantID, storeID, userID, uint(matchIDUint64)); err != nil {
+			writeManualMatchError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	rg.POST("/stores/:storeId/matches/:matchId/rematch", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+		userID := c.GetUint(auth.ContextUserIDKey)
+
+		storeIDParam := c.Param("storeId")
+		storeIDUint64, err := strconv.ParseUint(storeIDParam, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid storeId"})
+			return
+		}
+		storeID := uint(storeIDUint64)
+
+		matchIDUint64, err := strconv.ParseUint(c.Param("matchId"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid matchId"})
+			return
+		}
+
+		var req ManualMatchRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		m, err := svc.Rematch(merchantID, storeID, userID, uint(matchIDUint64), req)
+		if err != nil {
+			writeManualMatchError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, m)
+	})
+
+	rg.PATCH("/stores/:storeId/exceptions/:exceptionId", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+		userID := c.GetUint(auth.ContextUserIDKey)
+
+		storeIDParam := c.Param("storeId")
+		storeIDUint64, err := strconv.ParseUint(storeIDParam, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid storeId"})
+			return
+		}
+		storeID := uint(storeIDUint64)
+
+		exceptionIDUint64, err := strconv.ParseUint(c.Param("exceptionId"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid exceptionId"})
+			return
+		}
+
+		var req UpdateExceptionRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		ex, err := svc.UpdateException(merchantID, storeID, userID, uint(exceptionIDUint64), req)
+		if err != nil {
+			switch {
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				c.JSON(http.StatusNotFound, gin.H{"error": "exception not found"})
+			case errors.Is(err, ErrInvalidTransition), errors.Is(err, ErrDuplicateMatched):
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			case errors.Is(err, ErrUnknownStatus), errors.Is(err, ErrResolutionReasonNeeded), errors.Is(err, ErrUnknownAssignee):
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+		c.JSON(http.StatusOK, ex)
+	})
+
+	rg.GET("/stores/:storeId/exceptions/:exceptionId/history", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+
+		storeIDParam := c.Param("storeId")
+		storeIDUint64, err := strconv.ParseUint(storeIDParam, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid storeId"})
+			return
+		}
+		storeID := uint(storeIDUint64)
+
+		exceptionIDUint64, err := strconv.ParseUint(c.Param("exceptionId"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid exceptionId"})
+			return
+		}
+
+		events, err := svc.ListExceptionHistory(merchantID, storeID, uint(exceptionIDUint64))
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "exception not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, events)
+	})
+
+	rg.GET("/stores/:storeId/matching-settings", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+
+		storeIDParam := c.Param("storeId")
+		storeIDUint64, err := strconv.ParseUint(storeIDParam, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid storeId"})
+			return
+		}
+		storeID := uint(storeIDUint64)
+
+		settings, err := svc.GetSettings(merchantID, storeID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, settings)
+	})
+
+	rg.PUT("/stores/:storeId/matching-settings", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+
+		storeIDParam := c.Param("storeId")
+		storeIDUint64, err := strconv.ParseUint(storeIDParam, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid storeId"})
+			return
+		}
+		storeID := uint(storeIDUint64)
+
+		var req SettingsRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		settings, err := svc.SaveSettings(merchantID, &storeID, req)
+		if err != nil {
+			writeSettingsError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, settings)
+	})
+
+	// Merchant-wide settings apply to every store without its own.
+	rg.PUT("/matching-settings", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+
+		var req SettingsRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		settings, err := svc.SaveSettings(merchantID, nil, req)
+		if err != nil {
+			writeSettingsError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, settings)
+	})
 }
 
+func writeManualMatchError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "order, payment or match not found"})
+	case errors.Is(err, ErrInvalidAmount):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrOrderSettled), errors.Is(err, ErrPaymentAllocated), errors.Is(err, ErrPaymentLinked), errors.Is(err, ErrPaymentDuplicate):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		c.JSON(http.StatusConflict, gin.H{"error": "order and payment are already matched"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func writeSettingsError(c *gin.Context, err error) {
+	if errors.Is(err, ErrUnknownStrategy) || errors.Is(err, ErrInvalidWindow) || errors.Is(err, ErrInvalidTolerance) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
@@ -0,0 +1,192 @@
+package matching
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"upisettle/internal/merchant"
+	"upisettle/internal/order"
+	"upisettle/internal/payment"
+)
+
+// modeIncremental plans a single new payment against the open orders it
+// could belong to. It is internal: Reconcile only accepts the public modes.
+const modeIncremental = "incremental"
+
+// MatchPayment matches one newly ingested payment against open orders with
+// the store's strategies, so the counter sees the order as paid right away.
+// Only confident matches are written; anything doubtful, and all exception
+// bookkeeping, is left to the next reconcile run. A suspected duplicate is
+// not matched but gets a DUPLICATE_PAYMENT exception. It implements
+// payment.Matcher.
+func (s *Service) MatchPayment(p payment.Payment) (payment.MatchResult, error) {
+	var res payment.MatchResult
+	if p.DuplicateOfID != nil {
+		return res, s.flagDuplicate(p, nil)
+	}
+	if p.OrderID != nil {
+		return res, nil
+	}
+
+	settings, err := s.settingsFor(p.MerchantID, p.StoreID)
+	if err != nil {
+		return res, err
+	}
+
+	loc, err := merchant.Location(s.db, p.MerchantID)
+	if err != nil {
+		return res, err
+	}
+
+	// Orders of every business day whose payment window covers the
+	// payment's time.
+	paidAt := p.Time.In(loc)
+	from := startOfDay(paidAt.Add(-settings.lookahead()))
+	to := startOfDay(paidAt.Add(settings.lookback())).AddDate(0, 0, 1)
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		// Take the same locks as a reconcile run of each of those days, in
+		// the same order: the store-day, then its orders, then payments.
+		for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+			if err := lockStoreDay(tx, p.StoreID, day); err != nil {
+				return err
+			}
+		}
+
+		var orders []order.Order
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("merchant_id = ? AND store_id = ? AND created_at >= ? AND created_at < ? AND status IN ?", p.MerchantID, p.StoreID, from, to, []string{order.StatusPending, order.StatusPartial}).
+			Order("created_at ASC").
+			Find(&orders).Error; err != nil {
+			return err
+		}
+
+		var locked payment.Payment
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&locked, p.ID).Error; err != nil {
+			return err
+		}
+		var matched int64
+		if err := tx.Model(&Match{}).Where("payment_id = ?", p.ID).Count(&matched).Error; err != nil {
+			return err
+		}
+		if matched > 0 || locked.OrderID != nil || locked.DuplicateOfID != nil {
+			return nil
+		}
+
+		free := make([]order.Order, 0, len(orders))
+		for _, o := range orders {
+			if o.Outstanding() > 0 {
+				free = append(free, o)
+			}
+		}
+
+		scoped := s.withDB(tx).withSettings(settings)
+		pl, err := scoped.buildPlan(modeIncremental, settings.Strategies, free, []payment.Payment{locked})
+		if err != nil || len(pl.matches) == 0 {
+			return err
+		}
+
+		// The payment is used, so its open exceptions no longer apply, nor
+		// do those of the orders it settles. An order it only partly pays
+		// keeps one AMOUNT_MISMATCH exception for the rest.
+		pl.exceptions = nil
+		pl.scopePaymentIDs = []uint{p.ID}
+		left := make(map[uint]int64)
+		var orderIDs []uint
+		for _, pm := range pl.matches {
+			if _, ok := left[pm.Order.ID]; !ok {
+				left[pm.Order.ID] = pm.Order.Outstanding()
+				orderIDs = append(orderIDs, pm.Order.ID)
+			}
+			left[pm.Order.ID] -= pm.Amount
+		}
+		for _, id := range orderIDs {
+			pl.scopeOrderIDs = append(pl.scopeOrderIDs, id)
+			if left[id] > 0 {
+				orderID := id
+				pl.exceptions = append(pl.exceptions, plannedException{
+					OrderID: &orderID,
+					Type:    ExceptionAmountMismatch,
+					Reason:  fmt.Sprintf("partly paid, %d paise still outstanding", left[id]),
+				})
+			}
+		}
+		var summary ReconcileSummary
+		if err := scoped.applyPlan(p.MerchantID, p.StoreID, nil, pl, nil, &summary); err != nil {
+			return err
+		}
+
+		var updated []order.Order
+		if err := tx.Where("id IN ?", pl.scopeOrderIDs).Find(&updated).Error; err != nil {
+			return err
+		}
+		status := make(map[uint]string, len(updated))
+		for _, o := range updated {
+			status[o.ID] = o.Status
+		}
+
+		res.Matched = true
+		for _, pm := range pl.matches {
+			res.Orders = append(res.Orders, payment.MatchedOrder{
+				OrderID:     pm.Order.ID,
+				ExternalRef: pm.Order.ExternalRef,
+				Amount:      pm.Amount,
+				Status:      status[pm.Order.ID],
+				Confidence:  pm.Confidence,
+				Strategy:    pm.Strategy,
+			})
+		}
+		return nil
+	})
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		// A reconcile run matched the payment first.
+		return payment.MatchResult{}, nil
+	}
+	if err != nil {
+		return payment.MatchResult{}, err
+	}
+	return res, nil
+}
+
+// flagDuplicate raises the DUPLICATE_PAYMENT exception for a payment that
+// was stored as a near-duplicate, unless the payment already has one.
+func (s *Service) flagDuplicate(p payment.Payment, runID *uint) error {
+	paymentID := p.ID
+	originalID := *p.DuplicateOfID
+	ex := Exception{
+		MerchantID:    p.MerchantID,
+		StoreID:       p.StoreID,
+		PaymentID:     &paymentID,
+		DuplicateOfID: &originalID,
+		Type:          ExceptionDuplicatePayment,
+		Reason:        fmt.Sprintf("same amount and payer VPA as payment %d within seconds, no UPI ref", originalID),
+		Status:        ExceptionStatusOpen,
+		RunID:         runID,
+	}
+	return s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&ex).Error
+}
+
+// flagDuplicates raises the DUPLICATE_PAYMENT exceptions missing for the
+// day's near-duplicates, for payments that were not flagged on ingestion.
+func (s *Service) flagDuplicates(merchantID, storeID uint, start time.Time, runID *uint) error {
+	var payments []payment.Payment
+	if err := s.db.Where("merchant_id = ? AND store_id = ? AND time >= ? AND time < ? AND duplicate_of_id IS NOT NULL", merchantID, storeID, start, start.Add(24*time.Hour)).
+		Where("NOT EXISTS (SELECT 1 FROM exceptions WHERE exceptions.payment_id = payments.id AND exceptions.type = ?)", ExceptionDuplicatePayment).
+		Find(&payments).Error; err != nil {
+		return err
+	}
+	for _, p := range payments {
+		if err := s.flagDuplicate(p, runID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
@@ -0,0 +1,233 @@
+package matching
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"upisettle/internal/logger"
+)
+
+// Reconcile job statuses.
+const (
+	JobStatusQueued    = "QUEUED"
+	JobStatusRunning   = "RUNNING"
+	JobStatusSucceeded = "SUCCEEDED"
+	JobStatusFailed    = "FAILED"
+)
+
+const (
+	// maxJobAttempts bounds how often a job is retried after the worker
+	// processing it died.
+	maxJobAttempts = 3
+	// staleJobAfter is how long a RUNNING job may go without a progress
+	// update before another worker takes it over.
+	staleJobAfter = 10 * time.Minute
+)
+
+// ReconcileJob is a queued Reconcile call, processed in the background by
+// RunJobs. Jobs live in Postgres so they survive restarts.
+type ReconcileJob struct {
+	ID           uint      `gorm:"primaryKey"`
+	MerchantID   uint      `gorm:"not null;index"`
+	StoreID      uint      `gorm:"not null;index"`
+	BusinessDate time.Time `gorm:"type:date;not null"`
+	Timezone     string    `gorm:"size:100;not null;default:'UTC'"` // zone the business day is counted in
+	Mode         string    `gorm:"size:32;not null"`
+	TriggeredBy  *uint
+	Status       string `gorm:"size:16;not null;default:'QUEUED'"`
+	Progress     int    `gorm:"not null;default:0"` // percent of the run's writes done
+	Attempts     int    `gorm:"not null;default:0"`
+	RunID        *uint  // reconciliation run that processed the job
+	Error        string `gorm:"size:1024"`
+	StartedAt    *time.Time
+	FinishedAt   *time.Time
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+func (ReconcileJob) TableName() string {
+	return "reconcile_jobs"
+}
+
+// JobDetail is a job together with the summary of its run once it has
+// finished.
+type JobDetail struct {
+	Job    ReconcileJob      `json:"job"`
+	Result *ReconcileSummary `json:"result,omitempty"`
+}
+
+// EnqueueReconcile queues a reconcile run for a store and day and returns
+// the job to poll.
+func (s *Service) EnqueueReconcile(merchantID, storeID uint, day time.Time, opts ReconcileOptions) (ReconcileJob, error) {
+	if opts.Mode == "" {
+		opts.Mode = ModeGreedy
+	}
+	if opts.Mode != ModeGreedy && opts.Mode != ModeOptimal {
+		return ReconcileJob{}, ErrUnknownMode
+	}
+
+	job := ReconcileJob{
+		MerchantID:   merchantID,
+		StoreID:      storeID,
+		BusinessDate: time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location()),
+		Timezone:     day.Location().String(),
+		Mode:         opts.Mode,
+		Status:       JobStatusQueued,
+	}
+	if opts.TriggeredBy != 0 {
+		triggeredBy := opts.TriggeredBy
+		job.TriggeredBy = &triggeredBy
+	}
+	if err := s.db.Create(&job).Error; err != nil {
+		return ReconcileJob{}, err
+	}
+	return job, nil
+}
+
+// GetJob returns a job of the store and, once it has run, its result.
+func (s *Service) GetJob(merchantID, storeID, jobID uint) (JobDetail, error) {
+	var detail JobDetail
+	if err := s.db.Where("id = ? AND merchant_id = ? AND store_id = ?", jobID, merchantID, storeID).
+		First(&detail.Job).Error; err != nil {
+		return detail, err
+	}
+	if detail.Job.Status != JobStatusSucceeded || detail.Job.RunID == nil {
+		return detail, nil
+	}
+
+	var run ReconciliationRun
+	if err := s.db.First(&run, *detail.Job.RunID).Error; err != nil {
+		return detail, err
+	}
+	detail.Result = &ReconcileSummary{
+		RunID:              run.ID,
+		Mode:               run.Strategy,
+		MatchedOrders:      run.MatchedOrders,
+		UnmatchedOrders:    run.UnmatchedOrders,
+		UnmatchedPayments:  run.UnmatchedPayments,
+		ResolvedExceptions: run.ResolvedExceptions,
+	}
+	return detail, nil
+}
+
+// RunJobs processes queued reconcile jobs until ctx is cancelled, running at
+// most concurrency of them at once and polling every poll when idle.
+func (s *Service) RunJobs(ctx context.Context, concurrency int, poll time.Duration, log logger.Logger) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sem <- struct{}{}:
+		}
+
+		job, err := s.claimJob()
+		if err != nil || job == nil {
+			<-sem
+			if err != nil {
+				log.Printf("reconcile jobs: claim failed: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(poll):
+			}
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := s.runJob(job); err != nil {
+				log.Printf("reconcile jobs: job %d failed: %v", job.ID, err)
+			}
+		}()
+	}
+}
+
+// claimJob marks the oldest queued job, or one whose worker has gone quiet,
+// as RUNNING and returns it; nil means there is nothing to do. SKIP LOCKED
+// lets several API instances share the queue.
+func (s *Service) claimJob() (*ReconcileJob, error) {
+	staleBefore := time.Now().Add(-staleJobAfter)
+
+	if err := s.db.Model(&ReconcileJob{}).
+		Where("status = ? AND updated_at < ? AND attempts >= ?", JobStatusRunning, staleBefore, maxJobAttempts).
+		Updates(map[string]any{
+			"status":      JobStatusFailed,
+			"error":       "worker stopped responding too many times",
+			"finished_at": time.Now(),
+		}).Error; err != nil {
+		return nil, err
+	}
+
+	var jobs []ReconcileJob
+	err := s.db.Raw(`
+		UPDATE reconcile_jobs
+		SET status = ?, attempts = attempts + 1, started_at = NOW(), updated_at = NOW()
+		WHERE id = (
+			SELECT id FROM reconcile_jobs
+			WHERE status = ? OR (status = ? AND updated_at < ?)
+			ORDER BY id
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1
+		)
+		RETURNING *`,
+		JobStatusRunning, JobStatusQueued, JobStatusRunning, staleBefore).
+		Scan(&jobs).Error
+	if err != nil || len(jobs) == 0 {
+		return nil, err
+	}
+	return &jobs[0], nil
+}
+
+// runJob runs the job's reconcile and records the outcome on the job.
+func (s *Service) runJob(job *ReconcileJob) error {
+	opts := ReconcileOptions{
+		Mode: job.Mode,
+		Progress: func(done, total int) {
+			if total <= 0 {
+				return
+			}
+			// Progress doubles as the job's heartbeat; a failed update is
+			// retried with the next batch.
+			s.db.Model(job).Updates(map[string]any{"progress": done * 100 / total, "updated_at": time.Now()})
+		},
+	}
+	if job.TriggeredBy != nil {
+		opts.TriggeredBy = *job.TriggeredBy
+	}
+
+	var summary ReconcileSummary
+	loc, runErr := time.LoadLocation(job.Timezone)
+	if runErr == nil {
+		day := time.Date(job.BusinessDate.Year(), job.BusinessDate.Month(), job.BusinessDate.Day(), 0, 0, 0, 0, loc)
+		summary, runErr = s.Reconcile(job.MerchantID, job.StoreID, day, opts)
+	}
+
+	now := time.Now()
+	updates := map[string]any{"finished_at": now}
+	if summary.RunID != 0 {
+		updates["run_id"] = summary.RunID
+	}
+	if runErr != nil {
+		updates["status"] = JobStatusFailed
+		updates["error"] = runErr.Error()
+	} else {
+		updates["status"] = JobStatusSucceeded
+		updates["progress"] = 100
+	}
+	if err := s.db.Model(job).Updates(updates).Error; err != nil {
+		return errors.Join(runErr, err)
+	}
+	return runErr
+}
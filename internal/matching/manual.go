@@ -0,0 +1,279 @@
+package matching
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"upisettle/internal/order"
+	"upisettle/internal/payment"
+)
+
+var (
+	ErrOrderSettled     = errors.New("order has no outstanding balance")
+	ErrPaymentAllocated = errors.New("payment is already fully matched")
+	ErrPaymentLinked    = errors.New("payment was recorded directly against an order")
+	ErrPaymentDuplicate = errors.New("payment is flagged as a duplicate")
+	ErrInvalidAmount    = errors.New("amount exceeds what the order or payment allows")
+)
+
+type ManualMatchRequest struct {
+	OrderID   uint `json:"order_id" binding:"required"`
+	PaymentID uint `json:"payment_id" binding:"required"`
+	// Amount is optional; it defaults to as much as both the order's
+	// outstanding balance and the payment's unallocated amount allow.
+	Amount int64 `json:"amount"`
+}
+
+// ManualMatch links an order to a payment chosen by a user, updating the
+// order and resolving the related exceptions in one transaction.
+func (s *Service) ManualMatch(merchantID, storeID, userID uint, req ManualMatchRequest) (Match, error) {
+	var m Match
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		m, err = s.manualMatch(tx, merchantID, storeID, userID, req)
+		return err
+	})
+	return m, err
+}
+
+// Unmatch removes a match, keeping it as removed by userID, rolls the order back to PARTIAL or PENDING and
+// reopens the exceptions that the match had resolved.
+func (s *Service) Unmatch(merchantID, storeID, userID, matchID uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		return s.unmatch(tx, merchantID, storeID, userID, matchID)
+	})
+}
+
+// Rematch replaces an existing match with a new pairing atomically.
+func (s *Service) Rematch(merchantID, storeID, userID, matchID uint, req ManualMatchRequest) (Match, error) {
+	var m Match
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := s.unmatch(tx, merchantID, storeID, userID, matchID); err != nil {
+			return err
+		}
+		var err error
+		m, err = s.manualMatch(tx, merchantID, storeID, userID, req)
+		return err
+	})
+	return m, err
+}
+
+func (s *Service) manualMatch(tx *gorm.DB, merchantID, storeID, userID uint, req ManualMatchRequest) (Match, error) {
+	var o order.Order
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id = ? AND merchant_id = ? AND store_id = ?", req.OrderID, merchantID, storeID).
+		First(&o).Error; err != nil {
+		return Match{}, err
+	}
+	var p payment.Payment
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id = ? AND merchant_id = ? AND store_id = ?", req.PaymentID, merchantID, storeID).
+		First(&p).Error; err != nil {
+		return Match{}, err
+	}
+	if p.OrderID != nil {
+		return Match{}, ErrPaymentLinked
+	}
+	if p.DuplicateOfID != nil {
+		return Match{}, ErrPaymentDuplicate
+	}
+
+	outstanding := o.Outstanding()
+	if outstanding <= 0 {
+		return Match{}, ErrOrderSettled
+	}
+	var allocated int64
+	if err := tx.Model(&Match{}).Where("payment_id = ?", p.ID).
+		Select("COALESCE(SUM(amount), 0)").Scan(&allocated).Error; err != nil {
+		return Match{}, err
+	}
+	available := p.Amount - allocated
+	if available <= 0 {
+		return Match{}, ErrPaymentAllocated
+	}
+
+	amount := req.Amount
+	if amount == 0 {
+		amount = min(outstanding, available)
+	}
+	if amount < 0 || amount > outstanding || amount > available {
+		return Match{}, ErrInvalidAmount
+	}
+
+	m := Match{
+		OrderID:    o.ID,
+		PaymentID:  p.ID,
+		Amount:     amount,
+		Kind:       manualMatchKind(o, amount, allocated),
+		Confidence: 1.0,
+		Reason:     "matched manually",
+		Strategy:   StrategyManual,
+		MatchedAt:  time.Now(),
+		MatchedBy:  &userID,
+	}
+	if err := tx.Create(&m).Error; err != nil {
+		return Match{}, err
+	}
+
+	o.ApplyPayment(amount, p.PaidStatus(), p.Time)
+	if err := tx.Save(&o).Error; err != nil {
+		return Match{}, err
+	}
+
+	if o.Outstanding() <= 0 {
+		if err := resolveOpenExceptions(tx, userID, "order_id = ?", o.ID); err != nil {
+			return Match{}, err
+		}
+	}
+	if available-amount <= 0 {
+		if err := resolveOpenExceptions(tx, userID, "payment_id = ?", p.ID); err != nil {
+			return Match{}, err
+		}
+	}
+	return m, nil
+}
+
+// manualMatchKind labels a manual match of amount to order o from a payment
+// that already has allocated paise matched elsewhere: COMBINED when the
+// payment pays other orders too, SPLIT when the order is paid by other
+// payments, before or after this one, and SINGLE otherwise. A payment worth
+// more than the order is still a single match until its rest is matched.
+func manualMatchKind(o order.Order, amount, allocated int64) string {
+	switch {
+	case allocated > 0:
+		return MatchKindCombined
+	case o.PaidAmount > 0 || amount < o.Outstanding():
+		return MatchKindSplit
+	default:
+		return MatchKindSingle
+	}
+}
+
+func (s *Service) unmatch(tx *gorm.DB, merchantID, storeID, userID, matchID uint) error {
+	var m Match
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Joins("JOIN orders ON orders.id = matches.order_id").
+		Where("matches.id = ? AND orders.merchant_id = ? AND orders.store_id = ?", matchID, merchantID, storeID).
+		First(&m).Error; err != nil {
+		return err
+	}
+
+	var o order.Order
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&o, m.OrderID).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Model(&m).Updates(map[string]any{
+		"removed_at": time.Now(),
+		"removed_by": userID,
+	}).Error; err != nil {
+		return err
+	}
+
+	o.RevertPayment(m.Amount)
+	if err := tx.Save(&o).Error; err != nil {
+		return err
+	}
+
+	if err := resolveDifferenceExceptions(tx, userID, m.OrderID, m.PaymentID); err != nil {
+		return err
+	}
+
+	if o.Outstanding() > 0 {
+		if err := reopenOrRaise(tx, merchantID, storeID, userID, &o.ID, nil, ExceptionUnmatchedOrder, "match removed manually"); err != nil {
+			return err
+		}
+	}
+
+	var remaining int64
+	if err := tx.Model(&Match{}).Where("payment_id = ?", m.PaymentID).Count(&remaining).Error; err != nil {
+		return err
+	}
+	if remaining == 0 {
+		if err := reopenOrRaise(tx, merchantID, storeID, userID, nil, &m.PaymentID, ExceptionUnmatchedPayment, "match removed manually"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveOpenExceptions resolves the open reconcile exceptions matching the
+// given condition, e.g. "order_id = ?".
+func resolveOpenExceptions(tx *gorm.DB, userID uint, cond string, id uint) error {
+	var open []Exception
+	if err := tx.Where("resolved = ? AND type IN ?", false, reconcileExceptionTypes).
+		Where(cond, id).
+		Find(&open).Error; err != nil {
+		return err
+	}
+	for i := range open {
+		open[i].ResolutionReason = "settled by manual match"
+		if err := transition(tx, &open[i], ExceptionStatusResolved, "", &userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// differenceExceptionTypes are raised next to a tolerated match and live as
+// long as the match does.
+var differenceExceptionTypes = []string{
+	ExceptionOverpayment,
+	ExceptionUnderpayment,
+	ExceptionRounding,
+}
+
+// resolveDifferenceExceptions closes the amount difference exceptions of a
+// match that is being removed.
+func resolveDifferenceExceptions(tx *gorm.DB, userID, orderID, paymentID uint) error {
+	var open []Exception
+	if err := tx.Where("resolved = ? AND type IN ? AND order_id = ? AND payment_id = ?", false, differenceExceptionTypes, orderID, paymentID).
+		Find(&open).Error; err != nil {
+		return err
+	}
+	for i := range open {
+		open[i].ResolutionReason = "match removed"
+		if err := transition(tx, &open[i], ExceptionStatusResolved, "", &userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reopenOrRaise reopens the most recent exception of the given type for the
+// order or payment if it was resolved, or raises a new one if there never
+// was one. Exceptions a user wrote off or ignored stay closed.
+func reopenOrRaise(tx *gorm.DB, merchantID, storeID, userID uint, orderID, paymentID *uint, typ, reason string) error {
+	q := tx.Where("merchant_id = ? AND store_id = ? AND type = ?", merchantID, storeID, typ)
+	if orderID != nil {
+		q = q.Where("order_id = ?", *orderID)
+	} else {
+		q = q.Where("payment_id = ? AND order_id IS NULL", *paymentID)
+	}
+
+	var ex Exception
+	err := q.Order("id DESC").First(&ex).Error
+	switch {
+	case err == nil:
+		if ex.Status != ExceptionStatusResolved {
+			return nil
+		}
+		return transition(tx, &ex, ExceptionStatusOpen, reason, &userID)
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		ex = Exception{
+			MerchantID: merchantID,
+			StoreID:    storeID,
+			OrderID:    orderID,
+			PaymentID:  paymentID,
+			Type:       typ,
+			Reason:     reason,
+			Status:     ExceptionStatusOpen,
+		}
+		return tx.Create(&ex).Error
+	default:
+		return err
+	}
+}
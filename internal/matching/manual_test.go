@@ -0,0 +1,30 @@
+package matching
+
+import (
+	"testing"
+
+	"upisettle/internal/order"
+)
+
+func TestManualMatchKind(t *testing.T) {
+	tests := []struct {
+		name      string
+		order     order.Order
+		amount    int64
+		allocated int64
+		want      string
+	}{
+		{"order settled by one payment, whatever its size", order.Order{Amount: 50000}, 50000, 0, MatchKindSingle},
+		{"first part of a split", order.Order{Amount: 50000}, 30000, 0, MatchKindSplit},
+		{"rest of a split", order.Order{Amount: 50000, PaidAmount: 30000}, 20000, 0, MatchKindSplit},
+		{"rest of the payment to a second order", order.Order{Amount: 10000}, 10000, 50000, MatchKindCombined},
+		{"rest of the payment part-paying a second order", order.Order{Amount: 30000}, 10000, 50000, MatchKindCombined},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := manualMatchKind(tt.order, tt.amount, tt.allocated); got != tt.want {
+				t.Errorf("manualMatchKind() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package matching
+
+import (
+	"sync"
+	"time"
+)
+
+// StoreReconcileResult is the outcome of one store in a merchant-wide run.
+type StoreReconcileResult struct {
+	StoreID   uint              `json:"store_id"`
+	StoreName string            `json:"store_name"`
+	Summary   *ReconcileSummary `json:"summary,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// MerchantReconcileTotal adds up the store summaries of a merchant-wide run.
+type MerchantReconcileTotal struct {
+	Stores             int `json:"stores"`
+	FailedStores       int `json:"failed_stores"`
+	MatchedOrders      int `json:"matched_orders"`
+	UnmatchedOrders    int `json:"unmatched_orders"`
+	UnmatchedPayments  int `json:"unmatched_payments"`
+	ResolvedExceptions int `json:"resolved_exceptions"`
+}
+
+type MerchantReconcileSummary struct {
+	Mode   string                 `json:"mode"`
+	Stores []StoreReconcileResult `json:"stores"`
+	Total  MerchantReconcileTotal `json:"total"`
+}
+
+// ReconcileMerchant reconciles every store of a merchant for a day, at most
+// s.storeWorkers stores at once. Each store runs on its own, so a failing
+// store is reported in its result and does not stop the others.
+func (s *Service) ReconcileMerchant(merchantID uint, day time.Time, opts ReconcileOptions) (MerchantReconcileSummary, error) {
+	if opts.Mode == "" {
+		opts.Mode = ModeGreedy
+	}
+	result := MerchantReconcileSummary{Mode: opts.Mode}
+	if opts.Mode != ModeGreedy && opts.Mode != ModeOptimal {
+		return result, ErrUnknownMode
+	}
+	// A preview hash belongs to a single store.
+	opts.PlanHash = ""
+
+	stores, err := s.stores.ListStores(merchantID)
+	if err != nil {
+		return result, err
+	}
+
+	result.Stores = make([]StoreReconcileResult, len(stores))
+	workers := max(1, min(s.storeWorkers, len(stores)))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				st := stores[i]
+				res := StoreReconcileResult{StoreID: st.ID, StoreName: st.Name}
+				summary, err := s.Reconcile(merchantID, st.ID, day, opts)
+				if err != nil {
+					res.Error = err.Error()
+				} else {
+					res.Summary = &summary
+				}
+				result.Stores[i] = res
+			}
+		}()
+	}
+	for i := range stores {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	for _, res := range result.Stores {
+		result.Total.Stores++
+		if res.Summary == nil {
+			result.Total.FailedStores++
+			continue
+		}
+		result.Total.MatchedOrders += res.Summary.MatchedOrders
+		result.Total.UnmatchedOrders += res.Summary.UnmatchedOrders
+		result.Total.UnmatchedPayments += res.Summary.UnmatchedPayments
+		result.Total.ResolvedExceptions += res.Summary.ResolvedExceptions
+	}
+	return result, nil
+}
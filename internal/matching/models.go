@@ -1,13 +1,37 @@
 package matching
 
-import "time"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Match kinds.
+const (
+	// MatchKindSingle is one payment settling one order.
+	MatchKindSingle = "SINGLE"
+	// MatchKindSplit is one of several payments settling the same order.
+	MatchKindSplit = "SPLIT"
+	// MatchKindCombined is one payment covering several orders.
+	MatchKindCombined = "COMBINED"
+)
 
 type Match struct {
 	ID         uint      `gorm:"primaryKey"`
 	OrderID    uint      `gorm:"not null;index"`
 	PaymentID  uint      `gorm:"not null;index"`
+	Amount     int64     `gorm:"not null"` // paise credited to the order
+	Kind       string    `gorm:"size:16;not null;default:'SINGLE'"`
 	Confidence float64   `gorm:"not null"`
+	Reason     string    `gorm:"size:255"`
+	Strategy   string    `gorm:"size:64"` // strategy that produced the match
 	MatchedAt  time.Time `gorm:"not null"`
+	RunID      *uint     `gorm:"index"` // reconciliation run that created the match
+	MatchedBy  *uint     // user who linked the pair manually; nil for engine matches
+	// RemovedAt and RemovedBy record an unmatch. Removed matches are kept
+	// for run and exception history; gorm leaves them out of queries.
+	RemovedAt gorm.DeletedAt `gorm:"index"`
+	RemovedBy *uint
 }
 
 func (Match) TableName() string {
@@ -18,23 +42,105 @@ const (
 	ExceptionUnmatchedOrder   = "UNMATCHED_ORDER"
 	ExceptionUnmatchedPayment = "UNMATCHED_PAYMENT"
 	ExceptionAmountMismatch   = "AMOUNT_MISMATCH"
+
+	// Raised next to a match whose payment differed from the order within
+	// the store's tolerance; DifferenceAmount holds paid minus due.
+	ExceptionOverpayment  = "OVERPAYMENT"
+	ExceptionUnderpayment = "UNDERPAYMENT"
+	ExceptionRounding     = "ROUNDING"
+
+	// ExceptionDuplicatePayment flags a payment that looks like a second
+	// copy of another one. Ignoring it marks the payment as genuine.
+	ExceptionDuplicatePayment = "DUPLICATE_PAYMENT"
+
+	// Raised for a counted cash drawer that does not balance;
+	// DifferenceAmount holds counted minus expected cash.
+	ExceptionCashShortage = "CASH_SHORTAGE"
+	ExceptionCashExcess   = "CASH_EXCESS"
+)
+
+// Exception workflow statuses. OPEN and IN_REVIEW count as open; the rest
+// close the exception.
+const (
+	ExceptionStatusOpen       = "OPEN"
+	ExceptionStatusInReview   = "IN_REVIEW"
+	ExceptionStatusResolved   = "RESOLVED"
+	ExceptionStatusWrittenOff = "WRITTEN_OFF"
+	ExceptionStatusIgnored    = "IGNORED"
 )
 
+// OpenExceptionStatuses are the statuses summaries count by default.
+var OpenExceptionStatuses = []string{ExceptionStatusOpen, ExceptionStatusInReview}
+
 type Exception struct {
-	ID         uint       `gorm:"primaryKey"`
-	MerchantID uint       `gorm:"not null;index"`
-	StoreID    uint       `gorm:"not null;index"`
-	OrderID    *uint      `gorm:"index"`
-	PaymentID  *uint      `gorm:"index"`
-	Type       string     `gorm:"size:64;not null"`
-	Reason     string     `gorm:"size:512"`
-	Resolved   bool       `gorm:"not null;default:false"`
-	ResolvedAt *time.Time
-	CreatedAt  time.Time
-	UpdatedAt  time.Time
+	ID               uint   `gorm:"primaryKey"`
+	MerchantID       uint   `gorm:"not null;index"`
+	StoreID          uint   `gorm:"not null;index"`
+	OrderID          *uint  `gorm:"index"`
+	PaymentID        *uint  `gorm:"index"`
+	CashDrawerID     *uint  `gorm:"index"` // drawer count behind a cash exception
+	DuplicateOfID    *uint  // earlier payment a DUPLICATE_PAYMENT exception's payment repeats
+	Type             string `gorm:"size:64;not null"`
+	Reason           string `gorm:"size:512"`
+	DifferenceAmount int64  `gorm:"not null;default:0"` // paise paid minus due, or counted minus expected for cash exceptions
+	Status           string `gorm:"size:16;not null;default:'OPEN'"`
+	ResolutionReason string `gorm:"size:255"`
+	AssigneeID       *uint  `gorm:"index"`                  // staff user working on the exception
+	Resolved         bool   `gorm:"not null;default:false"` // kept in step with Status
+	ResolvedAt       *time.Time
+	RunID            *uint `gorm:"index"` // reconciliation run that raised the exception
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
 }
 
 func (Exception) TableName() string {
 	return "exceptions"
 }
 
+// ExceptionEvent is one entry in an exception's history: a status change,
+// an assignment or a note.
+type ExceptionEvent struct {
+	ID          uint   `gorm:"primaryKey"`
+	ExceptionID uint   `gorm:"not null;index"`
+	FromStatus  string `gorm:"size:16;not null"`
+	ToStatus    string `gorm:"size:16;not null"`
+	AssigneeID  *uint
+	Note        string `gorm:"size:1024"`
+	UserID      *uint  // nil for changes made by the reconcile engine
+	CreatedAt   time.Time
+}
+
+func (ExceptionEvent) TableName() string {
+	return "exception_events"
+}
+
+// Reconciliation run statuses.
+const (
+	RunStatusRunning   = "RUNNING"
+	RunStatusSucceeded = "SUCCEEDED"
+	RunStatusFailed    = "FAILED"
+)
+
+// ReconciliationRun is the audit record of one Reconcile call.
+type ReconciliationRun struct {
+	ID                 uint      `gorm:"primaryKey"`
+	MerchantID         uint      `gorm:"not null;index"`
+	StoreID            uint      `gorm:"not null;index"`
+	BusinessDate       time.Time `gorm:"type:date;not null"`
+	TriggeredBy        *uint     // user id; nil for system-triggered runs
+	Strategy           string    `gorm:"size:32;not null"`
+	Status             string    `gorm:"size:16;not null"`
+	Error              string    `gorm:"size:1024"`
+	StartedAt          time.Time `gorm:"not null"`
+	FinishedAt         *time.Time
+	MatchedOrders      int `gorm:"not null;default:0"`
+	UnmatchedOrders    int `gorm:"not null;default:0"`
+	UnmatchedPayments  int `gorm:"not null;default:0"`
+	ResolvedExceptions int `gorm:"not null;default:0"`
+	CreatedAt          time.Time
+	UpdatedAt          time.Time
+}
+
+func (ReconciliationRun) TableName() string {
+	return "reconciliation_runs"
+}
@@ -0,0 +1,366 @@
+package matching
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"upisettle/internal/order"
+	"upisettle/internal/payment"
+)
+
+// buildPlan runs the strategies in priority order, each on whatever the
+// earlier ones left unmatched, and raises exceptions for orders left open.
+// Unmatched payments are left to the caller, which knows which of them
+// belong to the day.
+func (s *Service) buildPlan(mode string, strategies []string, orders []order.Order, payments []payment.Payment) (plan, error) {
+	var pl plan
+
+	orderByID := make(map[uint]order.Order, len(orders))
+	for _, o := range orders {
+		orderByID[o.ID] = o
+	}
+	paymentByID := make(map[uint]payment.Payment, len(payments))
+	for _, p := range payments {
+		paymentByID[p.ID] = p
+	}
+
+	settled := make(map[uint]bool)
+	used := make(map[uint]bool)
+	for _, name := range strategies {
+		m, ok := s.matcherFor(name, mode)
+		if !ok {
+			return plan{}, fmt.Errorf("%w: %s", ErrUnknownStrategy, name)
+		}
+
+		in := MatcherInput{}
+		for _, o := range orders {
+			if !settled[o.ID] {
+				in.Orders = append(in.Orders, o)
+			}
+		}
+		for _, p := range payments {
+			if !used[p.ID] {
+				in.Payments = append(in.Payments, p)
+			}
+		}
+		if len(in.Orders) == 0 && len(in.Payments) == 0 {
+			break
+		}
+
+		pl.absorb(name, m.Match(in), orderByID, paymentByID, settled, used)
+	}
+
+	return pl, nil
+}
+
+// absorb validates a strategy's proposals against what is still open and
+// adds the valid ones to the plan. Orders and payments it touches are
+// settled for the rest of the run.
+func (pl *plan) absorb(strategy string, res MatchResult, orderByID map[uint]order.Order, paymentByID map[uint]payment.Payment, settled, used map[uint]bool) {
+	orderLeft := make(map[uint]int64)
+	paymentLeft := make(map[uint]int64)
+	var accepted []plannedMatch
+	for _, pm := range res.Matches {
+		o, okOrder := orderByID[pm.OrderID]
+		p, okPayment := paymentByID[pm.PaymentID]
+		if !okOrder || !okPayment || settled[o.ID] || used[p.ID] || pm.Amount <= 0 {
+			continue
+		}
+		if _, ok := orderLeft[o.ID]; !ok {
+			orderLeft[o.ID] = o.Outstanding()
+		}
+		if _, ok := paymentLeft[p.ID]; !ok {
+			paymentLeft[p.ID] = p.Amount
+		}
+		// A tolerated match credits the order with Amount but takes
+		// Amount+Difference from the payment.
+		taken := pm.Amount + pm.Difference
+		if pm.Amount > orderLeft[o.ID] || taken <= 0 || taken > paymentLeft[p.ID] {
+			continue
+		}
+		orderLeft[o.ID] -= pm.Amount
+		paymentLeft[p.ID] -= taken
+
+		kind := pm.Kind
+		if kind == "" {
+			kind = MatchKindSingle
+		}
+		accepted = append(accepted, plannedMatch{
+			Order:      o,
+			Payment:    p,
+			Amount:     pm.Amount,
+			Difference: pm.Difference,
+			Kind:       kind,
+			Confidence: pm.Confidence,
+			Reason:     pm.Reason,
+			Strategy:   strategy,
+		})
+	}
+
+	for _, pm := range accepted {
+		pl.dropOrderException(pm.Order.ID)
+		pl.matches = append(pl.matches, pm)
+		settled[pm.Order.ID] = true
+		used[pm.Payment.ID] = true
+	}
+
+	for _, pe := range res.Exceptions {
+		if pe.OrderID == nil || settled[*pe.OrderID] || pl.hasOrderException(*pe.OrderID) {
+			continue
+		}
+		if _, ok := orderByID[*pe.OrderID]; !ok {
+			continue
+		}
+		pl.exceptions = append(pl.exceptions, plannedException{
+			OrderID:   pe.OrderID,
+			PaymentID: pe.PaymentID,
+			Type:      pe.Type,
+			Reason:    pe.Reason,
+		})
+	}
+}
+
+// result converts the plan into the exported form strategies return.
+func (pl plan) result() MatchResult {
+	var res MatchResult
+	for _, pm := range pl.matches {
+		res.Matches = append(res.Matches, ProposedMatch{
+			OrderID:    pm.Order.ID,
+			PaymentID:  pm.Payment.ID,
+			Amount:     pm.Amount,
+			Difference: pm.Difference,
+			Kind:       pm.Kind,
+			Confidence: pm.Confidence,
+			Reason:     pm.Reason,
+		})
+	}
+	for _, pe := range pl.exceptions {
+		res.Exceptions = append(res.Exceptions, ProposedException{
+			OrderID:   pe.OrderID,
+			PaymentID: pe.PaymentID,
+			Type:      pe.Type,
+			Reason:    pe.Reason,
+		})
+	}
+	return res
+}
+
+// plan is the outcome of a matching pass before anything is written.
+type plan struct {
+	matches    []plannedMatch
+	exceptions []plannedException
+
+	// scopeOrderIDs and scopePaymentIDs are the records whose open
+	// exceptions this plan owns: anything open for them that the plan does
+	// not raise again gets resolved.
+	scopeOrderIDs   []uint
+	scopePaymentIDs []uint
+}
+
+type plannedMatch struct {
+	Order   order.Order
+	Payment payment.Payment
+	Amount  int64
+	// Difference is what the payment paid beyond (or short of) Amount when
+	// it matched within the amount tolerance.
+	Difference int64
+	Kind       string
+	Confidence float64
+	Reason     string
+	Strategy   string
+}
+
+type plannedException struct {
+	OrderID   *uint
+	PaymentID *uint
+	Type      string
+	Reason    string
+}
+
+// decide turns the chosen payment for an order into a match or an
+// exception depending on the confidence threshold.
+func (s *Service) decide(pl *plan, o order.Order, chosen *payment.Payment, best, runnerUp Fit) bool {
+	conf := s.scorer.Confidence(best, runnerUp)
+	if chosen != nil && conf >= s.threshold {
+		pl.matches = append(pl.matches, scoredMatch(o, *chosen, conf))
+		return true
+	}
+
+	orderID := o.ID
+	ex := plannedException{OrderID: &orderID}
+	switch {
+	case chosen == nil && runnerUp.Score > 0:
+		// Candidates existed, but the assignment gave them to closer orders.
+		ex.Type = ExceptionAmountMismatch
+		ex.Reason = "payment candidates were assigned to closer orders"
+	case chosen == nil:
+		// No candidate payment found for this order.
+		ex.Type = ExceptionUnmatchedOrder
+		ex.Reason = "no payment candidate found for order"
+	case runnerUp.Score > 0:
+		// Several candidates scored too closely to pick one.
+		ex.Type = ExceptionAmountMismatch
+		ex.Reason = "multiple payment candidates with similar confidence"
+	default:
+		// A single candidate, but too far away in time to trust.
+		ex.Type = ExceptionUnmatchedOrder
+		ex.Reason = "payment candidate below confidence threshold"
+	}
+	pl.exceptions = append(pl.exceptions, ex)
+	return false
+}
+
+// scoredMatch is the single match of an amount + time pass. The order is
+// credited with its outstanding balance; any tolerated difference is kept
+// aside.
+func scoredMatch(o order.Order, p payment.Payment, conf float64) plannedMatch {
+	due := o.Outstanding()
+	reason := "amount matches, paid " + describeGap(o.CreatedAt, p.Time)
+	if p.Amount != due {
+		reason = "amount within tolerance, paid " + describeGap(o.CreatedAt, p.Time)
+	}
+	return plannedMatch{
+		Order:      o,
+		Payment:    p,
+		Amount:     due,
+		Difference: p.Amount - due,
+		Kind:       MatchKindSingle,
+		Confidence: conf,
+		Reason:     reason,
+	}
+}
+
+// dropOrderException removes the exception planned for an order once a
+// later pass manages to settle it.
+func (pl *plan) dropOrderException(orderID uint) {
+	kept := pl.exceptions[:0]
+	for _, ex := range pl.exceptions {
+		if ex.OrderID != nil && *ex.OrderID == orderID {
+			continue
+		}
+		kept = append(kept, ex)
+	}
+	pl.exceptions = kept
+}
+
+func (pl *plan) hasOrderException(orderID uint) bool {
+	for _, ex := range pl.exceptions {
+		if ex.OrderID != nil && *ex.OrderID == orderID {
+			return true
+		}
+	}
+	return false
+}
+
+// addUnmatchedPayments raises an UNMATCHED_PAYMENT exception for every
+// given payment the plan did not use.
+func (pl *plan) addUnmatchedPayments(payments []payment.Payment) {
+	used := make(map[uint]bool, len(pl.matches))
+	for _, pm := range pl.matches {
+		used[pm.Payment.ID] = true
+	}
+	for _, p := range payments {
+		if used[p.ID] {
+			continue
+		}
+		paymentID := p.ID
+		pl.exceptions = append(pl.exceptions, plannedException{
+			PaymentID: &paymentID,
+			Type:      ExceptionUnmatchedPayment,
+			Reason:    "no matching order found for payment",
+		})
+	}
+}
+
+// planGreedy gives each order, oldest first, its best free payment.
+func (s *Service) planGreedy(pl *plan, orders []order.Order, payments []payment.Payment, used map[uint]bool) {
+	for _, o := range orders {
+		var best *payment.Payment
+		var bestFit, runnerUp Fit
+		for i := range payments {
+			p := &payments[i]
+			if used[p.ID] {
+				continue
+			}
+			fit := s.scorer.Rate(o, *p)
+			if fit.Score <= 0 {
+				continue
+			}
+			if fit.Score > bestFit.Score {
+				runnerUp = bestFit
+				best, bestFit = p, fit
+			} else if fit.Score > runnerUp.Score {
+				runnerUp = fit
+			}
+		}
+
+		if s.decide(pl, o, best, bestFit, runnerUp) {
+			used[best.ID] = true
+		}
+	}
+}
+
+// planByPayment gives each payment, oldest first, its best open order. It
+// is planGreedy seen from the payment's side, used when a single payment is
+// matched on arrival: the runner-up is the next best order, so a payment
+// that two similar orders could take is left for the nightly run.
+func (s *Service) planByPayment(pl *plan, orders []order.Order, payments []payment.Payment, used map[uint]bool) {
+	settled := make(map[uint]bool)
+	for _, p := range payments {
+		var best *order.Order
+		var bestFit, runnerUp Fit
+		for i := range orders {
+			o := &orders[i]
+			if settled[o.ID] {
+				continue
+			}
+			fit := s.scorer.Rate(*o, p)
+			if fit.Score <= 0 {
+				continue
+			}
+			if fit.Score > bestFit.Score {
+				runnerUp = bestFit
+				best, bestFit = o, fit
+			} else if fit.Score > runnerUp.Score {
+				runnerUp = fit
+			}
+		}
+		if best == nil {
+			continue
+		}
+
+		conf := s.scorer.Confidence(bestFit, runnerUp)
+		if conf < s.threshold {
+			continue
+		}
+		pl.matches = append(pl.matches, scoredMatch(*best, p, conf))
+		settled[best.ID] = true
+		used[p.ID] = true
+	}
+}
+
+// describeGap renders the payment time relative to the order for match
+// reasons, e.g. "2m30s after order".
+func describeGap(orderAt, paidAt time.Time) string {
+	gap := paidAt.Sub(orderAt).Round(time.Second)
+	if gap < 0 {
+		return (-gap).String() + " before order"
+	}
+	return gap.String() + " after order"
+}
+
+// hash fingerprints the proposed matches and exceptions so that a preview
+// can later be applied only if nothing has changed in between.
+func (pl plan) hash() string {
+	h := sha256.New()
+	for _, pm := range pl.matches {
+		fmt.Fprintf(h, "M|%d|%d|%d|%d|%s|%s|%.6f\n", pm.Order.ID, pm.Payment.ID, pm.Amount, pm.Difference, pm.Kind, pm.Strategy, pm.Confidence)
+	}
+	for _, pe := range pl.exceptions {
+		k := keyOf(pe.Type, pe.OrderID, pe.PaymentID)
+		fmt.Fprintf(h, "E|%s|%d|%d\n", k.Type, k.OrderID, k.PaymentID)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,93 @@
+package matching
+
+import "time"
+
+type ProposedMatch struct {
+	OrderID   uint  `json:"order_id"`
+	PaymentID uint  `json:"payment_id"`
+	Amount    int64 `json:"amount"`
+	// Difference is paid minus due for matches within the amount
+	// tolerance; the engine raises an OVERPAYMENT, UNDERPAYMENT or ROUNDING
+	// exception for it.
+	Difference int64   `json:"difference,omitempty"`
+	Kind       string  `json:"kind"`
+	Confidence float64 `json:"confidence"`
+	Reason     string  `json:"reason"`
+	// Strategy is filled in by the engine; strategies leave it empty.
+	Strategy string `json:"strategy"`
+}
+
+type ProposedException struct {
+	OrderID   *uint  `json:"order_id,omitempty"`
+	PaymentID *uint  `json:"payment_id,omitempty"`
+	Type      string `json:"type"`
+	Reason    string `json:"reason"`
+	// DifferenceAmount is set for amount difference exceptions.
+	DifferenceAmount int64 `json:"difference_amount,omitempty"`
+}
+
+// ReconcilePreview is what Reconcile would do for a day. Passing PlanHash
+// back as ReconcileOptions.PlanHash applies exactly this plan.
+type ReconcilePreview struct {
+	Mode       string              `json:"mode"`
+	PlanHash   string              `json:"plan_hash"`
+	Matches    []ProposedMatch     `json:"matches"`
+	Exceptions []ProposedException `json:"exceptions"`
+}
+
+// Preview plans a reconcile run without writing to matches, orders or
+// exceptions.
+func (s *Service) Preview(merchantID, storeID uint, day time.Time, opts ReconcileOptions) (ReconcilePreview, error) {
+	if opts.Mode == "" {
+		opts.Mode = ModeGreedy
+	}
+	preview := ReconcilePreview{Mode: opts.Mode}
+
+	if opts.Mode != ModeGreedy && opts.Mode != ModeOptimal {
+		return preview, ErrUnknownMode
+	}
+
+	start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+	pl, err := s.loadPlan(merchantID, storeID, start, opts.Mode)
+	if err != nil {
+		return preview, err
+	}
+
+	preview.PlanHash = pl.hash()
+	preview.Matches = make([]ProposedMatch, 0, len(pl.matches))
+	for _, pm := range pl.matches {
+		preview.Matches = append(preview.Matches, ProposedMatch{
+			OrderID:    pm.Order.ID,
+			PaymentID:  pm.Payment.ID,
+			Amount:     pm.Amount,
+			Difference: pm.Difference,
+			Kind:       pm.Kind,
+			Confidence: pm.Confidence,
+			Reason:     pm.Reason,
+			Strategy:   pm.Strategy,
+		})
+	}
+	preview.Exceptions = make([]ProposedException, 0, len(pl.exceptions))
+	for _, pe := range pl.exceptions {
+		preview.Exceptions = append(preview.Exceptions, ProposedException{
+			OrderID:   pe.OrderID,
+			PaymentID: pe.PaymentID,
+			Type:      pe.Type,
+			Reason:    pe.Reason,
+		})
+	}
+	for _, pm := range pl.matches {
+		if pm.Difference == 0 {
+			continue
+		}
+		ex := differenceException(merchantID, storeID, nil, pm)
+		preview.Exceptions = append(preview.Exceptions, ProposedException{
+			OrderID:          ex.OrderID,
+			PaymentID:        ex.PaymentID,
+			Type:             ex.Type,
+			Reason:           ex.Reason,
+			DifferenceAmount: ex.DifferenceAmount,
+		})
+	}
+	return preview, nil
+}
@@ -0,0 +1,87 @@
+package matching
+
+import "time"
+
+// RunDetail is a reconciliation run together with the rows it created.
+type RunDetail struct {
+	Run      ReconciliationRun `json:"run"`
+	MatchIDs []uint            `json:"match_ids"`
+	// RemovedMatchIDs are the run's matches that were unmatched since.
+	RemovedMatchIDs []uint `json:"removed_match_ids"`
+	ExceptionIDs    []uint `json:"exception_ids"`
+}
+
+func (s *Service) startRun(merchantID, storeID uint, businessDate time.Time, opts ReconcileOptions) (ReconciliationRun, error) {
+	run := ReconciliationRun{
+		MerchantID:   merchantID,
+		StoreID:      storeID,
+		BusinessDate: businessDate,
+		Strategy:     opts.Mode,
+		Status:       RunStatusRunning,
+		StartedAt:    time.Now(),
+	}
+	if opts.TriggeredBy != 0 {
+		triggeredBy := opts.TriggeredBy
+		run.TriggeredBy = &triggeredBy
+	}
+	if err := s.db.Create(&run).Error; err != nil {
+		return ReconciliationRun{}, err
+	}
+	return run, nil
+}
+
+// finishRun records the outcome of a run. runErr is the error the run
+// itself failed with, if any.
+func (s *Service) finishRun(run *ReconciliationRun, summary ReconcileSummary, runErr error) error {
+	now := time.Now()
+	run.FinishedAt = &now
+	run.MatchedOrders = summary.MatchedOrders
+	run.UnmatchedOrders = summary.UnmatchedOrders
+	run.UnmatchedPayments = summary.UnmatchedPayments
+	run.ResolvedExceptions = summary.ResolvedExceptions
+	run.Status = RunStatusSucceeded
+	if runErr != nil {
+		run.Status = RunStatusFailed
+		run.Error = runErr.Error()
+	}
+	return s.db.Save(run).Error
+}
+
+// ListRuns returns the reconciliation runs of a store, newest first. A
+// non-nil day restricts the list to runs for that business date.
+func (s *Service) ListRuns(merchantID, storeID uint, day *time.Time) ([]ReconciliationRun, error) {
+	q := s.db.Where("merchant_id = ? AND store_id = ?", merchantID, storeID)
+	if day != nil {
+		q = q.Where("business_date = ?", day.Format("2006-01-02"))
+	}
+
+	var runs []ReconciliationRun
+	if err := q.Order("started_at DESC").Find(&runs).Error; err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+// GetRun returns a run with the IDs of the matches and exceptions it created,
+// including matches removed since.
+func (s *Service) GetRun(merchantID, storeID, runID uint) (RunDetail, error) {
+	var detail RunDetail
+	if err := s.db.Where("id = ? AND merchant_id = ? AND store_id = ?", runID, merchantID, storeID).
+		First(&detail.Run).Error; err != nil {
+		return detail, err
+	}
+
+	if err := s.db.Unscoped().Model(&Match{}).Where("run_id = ?", runID).Order("id ASC").
+		Pluck("id", &detail.MatchIDs).Error; err != nil {
+		return detail, err
+	}
+	if err := s.db.Unscoped().Model(&Match{}).Where("run_id = ? AND removed_at IS NOT NULL", runID).Order("id ASC").
+		Pluck("id", &detail.RemovedMatchIDs).Error; err != nil {
+		return detail, err
+	}
+	if err := s.db.Model(&Exception{}).Where("run_id = ?", runID).Order("id ASC").
+		Pluck("id", &detail.ExceptionIDs).Error; err != nil {
+		return detail, err
+	}
+	return detail, nil
+}
@@ -0,0 +1,114 @@
+package matching
+
+import (
+	"time"
+
+	"upisettle/internal/order"
+	"upisettle/internal/payment"
+)
+
+// timeSlack is added to both gaps when comparing candidates, since SMS
+// timestamps are often only minute-granular.
+const timeSlack = time.Minute
+
+// Scorer rates how likely it is that a payment settles an order.
+type Scorer struct {
+	// TimeWindow is the largest gap between order creation and payment
+	// time that still counts as a candidate.
+	TimeWindow time.Duration
+	// ToleranceAbs (paise) and TolerancePct (percent of the balance) let a
+	// payment differ from the order's outstanding balance; the larger of
+	// the two applies. Both zero means amounts must be equal.
+	ToleranceAbs int64
+	TolerancePct float64
+}
+
+// toleratedFactor discounts pairs whose amounts only match within the
+// tolerance, so an exact amount wins over a tolerated one at the same time.
+const toleratedFactor = 0.9
+
+// Fit describes how well a payment fits an order: its Score and what went
+// into it. For a group of payments or orders it holds their means.
+type Fit struct {
+	Score     float64       // see Scorer.Score
+	Gap       time.Duration // time between order creation and payment
+	Tolerated bool          // the amount only matches within the tolerance
+}
+
+// Score returns a value in [0, 1]. Zero means the pair is not a candidate
+// at all; 1 means the payment equals the order's outstanding balance and
+// arrived at the same instant. The time component
+// decays linearly from 1 to 0 across the window.
+func (sc Scorer) Score(o order.Order, p payment.Payment) float64 {
+	return sc.Rate(o, p).Score
+}
+
+// Rate is Score together with the time gap and amount tolerance behind it.
+func (sc Scorer) Rate(o order.Order, p payment.Payment) Fit {
+	due := o.Outstanding()
+	fit := sc.timeFit(o.CreatedAt, p.Time)
+	if p.Amount != due {
+		if !sc.Tolerates(due, p.Amount) {
+			return Fit{}
+		}
+		fit.Score *= toleratedFactor
+		fit.Tolerated = true
+	}
+	return fit
+}
+
+// Tolerates reports whether paid is close enough to due to settle it.
+func (sc Scorer) Tolerates(due, paid int64) bool {
+	if due <= 0 || paid <= 0 {
+		return false
+	}
+	diff := paid - due
+	if diff < 0 {
+		diff = -diff
+	}
+	allowed := sc.ToleranceAbs
+	if pct := int64(float64(due) * sc.TolerancePct / 100); pct > allowed {
+		allowed = pct
+	}
+	return diff <= allowed
+}
+
+// timeFit rates a pair by time alone.
+func (sc Scorer) timeFit(orderAt, paidAt time.Time) Fit {
+	gap := paidAt.Sub(orderAt)
+	if gap < 0 {
+		gap = -gap
+	}
+	if sc.TimeWindow <= 0 || gap > sc.TimeWindow {
+		return Fit{Gap: gap}
+	}
+	return Fit{Score: 1 - float64(gap)/float64(sc.TimeWindow), Gap: gap}
+}
+
+// Confidence turns the best and runner-up candidates for an order into the
+// confidence stored on a Match. A lone candidate keeps its score; otherwise
+// the score is discounted by how close the runner-up is, measured as the
+// ratio of their time gaps so that busy counters with many same-price
+// items still get confident matches when one payment is clearly nearest.
+// A runner-up whose amount fits worse than the best's competes less, one
+// whose amount fits better competes more, by the tolerated-pair factor.
+func (sc Scorer) Confidence(best, runnerUp Fit) float64 {
+	if best.Score <= 0 {
+		return 0
+	}
+	if runnerUp.Score <= 0 {
+		return best.Score
+	}
+	ratio := float64(best.Gap+timeSlack) / float64(runnerUp.Gap+timeSlack)
+	switch {
+	case runnerUp.Tolerated && !best.Tolerated:
+		ratio *= toleratedFactor
+	case best.Tolerated && !runnerUp.Tolerated:
+		ratio /= toleratedFactor
+	}
+	c := best.Score * (1 - ratio)
+	if c < 0 {
+		return 0
+	}
+	return c
+}
@@ -0,0 +1,41 @@
+package matching
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestConfidence(t *testing.T) {
+	sc := Scorer{TimeWindow: 2 * time.Hour}
+	exact := func(gap time.Duration) Fit {
+		return Fit{Score: 1 - float64(gap)/float64(sc.TimeWindow), Gap: gap}
+	}
+	tolerated := func(gap time.Duration) Fit {
+		f := exact(gap)
+		f.Score *= toleratedFactor
+		f.Tolerated = true
+		return f
+	}
+
+	tests := []struct {
+		name     string
+		best     Fit
+		runnerUp Fit
+		want     float64
+	}{
+		{"no candidate", Fit{}, Fit{}, 0},
+		{"lone tolerated candidate keeps its score", tolerated(0), Fit{}, 0.9},
+		{"clearly nearest exact payment", exact(time.Minute), exact(19 * time.Minute), exact(time.Minute).Score * (1 - 2.0/20)},
+		{"tolerated runner-up at the same instant", exact(10 * time.Minute), tolerated(0), 0},
+		{"exact runner-up much later than a tolerated best", tolerated(0), exact(29 * time.Minute), 0.9 * (1 - 1.0/30/toleratedFactor)},
+		{"tolerated runner-up competes less", exact(0), tolerated(9 * time.Minute), 1 - 1.0/10*toleratedFactor},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sc.Confidence(tt.best, tt.runnerUp); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("Confidence() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,157 +1,337 @@
 package matching
 
 import (
+	"errors"
 	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
+	"upisettle/internal/config"
+	"upisettle/internal/merchant"
 	"upisettle/internal/order"
 	"upisettle/internal/payment"
 )
 
+var (
+	ErrUnknownMode = errors.New("unknown reconcile mode")
+	ErrPlanChanged = errors.New("reconcile plan changed since preview")
+	// ErrReconcileConflict means a concurrent change matched one of the
+	// run's payments first; the run was rolled back and can be retried.
+	ErrReconcileConflict = errors.New("payments were matched concurrently, please retry")
+
+	ErrUnknownStrategy = errors.New("unknown matching strategy")
+)
+
+// Reconcile modes.
+const (
+	// ModeGreedy walks orders by creation time and gives each one its best
+	// free payment.
+	ModeGreedy = "greedy"
+	// ModeOptimal solves the whole store-day as a bipartite assignment
+	// minimising total time distance.
+	ModeOptimal = "optimal"
+)
+
 type Service struct {
-	db *gorm.DB
+	db             *gorm.DB
+	scorer         Scorer
+	combinedScorer Scorer
+	threshold      float64
+	lookback       time.Duration
+	lookahead      time.Duration
+	custom         map[string]Matcher
+	stores         *merchant.Service
+	storeWorkers   int
+}
+
+func NewService(db *gorm.DB, cfg config.Config) *Service {
+	return &Service{
+		db: db,
+		scorer: Scorer{
+			TimeWindow:   cfg.MatchTimeWindow,
+			ToleranceAbs: cfg.MatchTolerancePaise,
+			TolerancePct: cfg.MatchTolerancePct,
+		},
+		combinedScorer: Scorer{TimeWindow: cfg.MatchCombinedWindow},
+		threshold:      cfg.MatchAutoThreshold,
+		lookback:       cfg.MatchLookback,
+		lookahead:      cfg.MatchLookahead,
+		custom:         make(map[string]Matcher),
+		stores:         merchant.NewService(db),
+		storeWorkers:   cfg.MerchantReconcileWorkers,
+	}
+}
+
+// withDB returns a copy of the service that works on db, typically a
+// transaction.
+func (s *Service) withDB(db *gorm.DB) *Service {
+	scoped := *s
+	scoped.db = db
+	return &scoped
 }
 
-func NewService(db *gorm.DB) *Service {
-	return &Service{db: db}
+type ReconcileOptions struct {
+	Mode string
+	// TriggeredBy is the user who started the run; zero for system runs.
+	TriggeredBy uint
+	// PlanHash, when set, must equal the hash of a previous Preview; the
+	// run fails with ErrPlanChanged if the plan differs from what was shown.
+	PlanHash string
+	// Progress, if set, is called as the run's writes go through with the
+	// number of rows done out of total.
+	Progress func(done, total int)
 }
 
 type ReconcileSummary struct {
-	MatchedOrders     int `json:"matched_orders"`
-	UnmatchedOrders   int `json:"unmatched_orders"`
-	UnmatchedPayments int `json:"unmatched_payments"`
+	RunID             uint   `json:"run_id"`
+	Mode              string `json:"mode"`
+	MatchedOrders     int    `json:"matched_orders"`
+	UnmatchedOrders   int    `json:"unmatched_orders"`
+	UnmatchedPayments int    `json:"unmatched_payments"`
+	// ResolvedExceptions counts open exceptions from earlier runs that no
+	// longer apply and were closed by this run.
+	ResolvedExceptions int `json:"resolved_exceptions"`
 }
 
-// Reconcile performs a simple matching for a given merchant, store and date.
-func (s *Service) Reconcile(merchantID, storeID uint, day time.Time) (ReconcileSummary, error) {
-	summary := ReconcileSummary{}
+// Reconcile scores pending orders against the day's payments for a given
+// merchant, store and date and auto-matches confident pairs.
+func (s *Service) Reconcile(merchantID, storeID uint, day time.Time, opts ReconcileOptions) (ReconcileSummary, error) {
+	if opts.Mode == "" {
+		opts.Mode = ModeGreedy
+	}
+	summary := ReconcileSummary{Mode: opts.Mode}
+
+	if opts.Mode != ModeGreedy && opts.Mode != ModeOptimal {
+		return summary, ErrUnknownMode
+	}
 
 	start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+
+	run, err := s.startRun(merchantID, storeID, start, opts)
+	if err != nil {
+		return summary, err
+	}
+	summary.RunID = run.ID
+
+	// The run writes everything or nothing. Runs for the same store and day
+	// wait for each other; the unique indexes on matches catch the rest.
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := lockStoreDay(tx, storeID, start); err != nil {
+			return err
+		}
+		return s.withDB(tx).reconcileDay(merchantID, storeID, start, opts, run.ID, &summary)
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			err = ErrReconcileConflict
+		}
+		// Nothing was written; don't report counts for the rolled-back work.
+		summary = ReconcileSummary{RunID: run.ID, Mode: opts.Mode}
+	}
+	if finishErr := s.finishRun(&run, summary, err); err == nil {
+		err = finishErr
+	}
+	return summary, err
+}
+
+// lockStoreDay takes a transaction-scoped Postgres advisory lock on a
+// store's business day. The key is the calendar date of day as written in
+// its own location (20240312), so every run of the same business date takes
+// the same lock whichever timezone its start is expressed in.
+func lockStoreDay(tx *gorm.DB, storeID uint, day time.Time) error {
+	date := day.Year()*10000 + int(day.Month())*100 + day.Day()
+	return tx.Exec("SELECT pg_advisory_xact_lock(?, ?)", int32(storeID), int32(date)).Error
+}
+
+// reconcileDay plans the day and writes the plan under the given run.
+func (s *Service) reconcileDay(merchantID, storeID uint, start time.Time, opts ReconcileOptions, runID uint, summary *ReconcileSummary) error {
+	pl, err := s.loadPlan(merchantID, storeID, start, opts.Mode)
+	if err != nil {
+		return err
+	}
+	if opts.PlanHash != "" && opts.PlanHash != pl.hash() {
+		return ErrPlanChanged
+	}
+	if err := s.applyPlan(merchantID, storeID, &runID, pl, opts.Progress, summary); err != nil {
+		return err
+	}
+	if err := s.flagDuplicates(merchantID, storeID, start, &runID); err != nil {
+		return err
+	}
+	// Cash recorded or paid out after the drawer was counted changes what
+	// it should have held.
+	return s.recheckCashDrawer(merchantID, storeID, start)
+}
+
+// loadPlan loads the day's open orders and free payments and plans the
+// matches without writing anything. Payments from the store's lookback and
+// lookahead windows around the day are candidates too; matching one of them
+// credits the order's day, and they only raise exceptions on their own day.
+func (s *Service) loadPlan(merchantID, storeID uint, start time.Time, mode string) (plan, error) {
 	end := start.Add(24 * time.Hour)
 
+	settings, err := s.settingsFor(merchantID, storeID)
+	if err != nil {
+		return plan{}, err
+	}
+
+	// Inside a run the rows are locked until commit, so a manual match
+	// can't change them between planning and writing.
 	var orders []order.Order
-	if err := s.db.
-		Where("merchant_id = ? AND store_id = ? AND created_at >= ? AND created_at < ? AND status = ?", merchantID, storeID, start, end, order.StatusPending).
+	if err := s.db.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("merchant_id = ? AND store_id = ? AND created_at >= ? AND created_at < ? AND status IN ?", merchantID, storeID, start, end, []string{order.StatusPending, order.StatusPartial}).
 		Order("created_at ASC").
 		Find(&orders).Error; err != nil {
-		return summary, err
+		return plan{}, err
 	}
 
 	var payments []payment.Payment
-	if err := s.db.
-		Where("merchant_id = ? AND store_id = ? AND time >= ? AND time < ?", merchantID, storeID, start, end).
+	if err := s.db.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("merchant_id = ? AND store_id = ? AND time >= ? AND time < ?", merchantID, storeID, start.Add(-settings.lookback()), end.Add(settings.lookahead())).
 		Order("time ASC").
 		Find(&payments).Error; err != nil {
-		return summary, err
+		return plan{}, err
+	}
+
+	// Every order of the day, whatever its status, so that exceptions for
+	// orders settled since the last run can be resolved.
+	var dayOrderIDs []uint
+	if err := s.db.Model(&order.Order{}).
+		Where("merchant_id = ? AND store_id = ? AND created_at >= ? AND created_at < ?", merchantID, storeID, start, end).
+		Pluck("id", &dayOrderIDs).Error; err != nil {
+		return plan{}, err
 	}
 
 	// Load existing matches to avoid duplicating work.
 	var matches []Match
-	if len(orders) > 0 {
-		orderIDs := make([]uint, 0, len(orders))
-		for _, o := range orders {
-			orderIDs = append(orderIDs, o.ID)
+	if len(payments) > 0 {
+		paymentIDs := make([]uint, 0, len(payments))
+		for _, p := range payments {
+			paymentIDs = append(paymentIDs, p.ID)
 		}
-		if err := s.db.Where("order_id IN ?", orderIDs).Find(&matches).Error; err != nil && err != gorm.ErrRecordNotFound {
-			return summary, err
+		if err := s.db.Where("payment_id IN ?", paymentIDs).Find(&matches).Error; err != nil && err != gorm.ErrRecordNotFound {
+			return plan{}, err
 		}
 	}
 
-	existingOrderMatched := make(map[uint]bool)
 	existingPaymentMatched := make(map[uint]bool)
 	for _, m := range matches {
-		existingOrderMatched[m.OrderID] = true
 		existingPaymentMatched[m.PaymentID] = true
 	}
 
-	usedPayment := make(map[uint]bool)
-
-	// For each pending order, find a payment with the same amount within the day that is not yet matched.
+	freeOrders := make([]order.Order, 0, len(orders))
 	for _, o := range orders {
-		if existingOrderMatched[o.ID] {
-			continue
+		if o.Outstanding() > 0 {
+			freeOrders = append(freeOrders, o)
 		}
-
-		var candidates []payment.Payment
-		for _, p := range payments {
-			if existingPaymentMatched[p.ID] || usedPayment[p.ID] {
-				continue
-			}
-			if p.Amount == o.Amount {
-				candidates = append(candidates, p)
+	}
+	// Payments recorded directly against an order (cash) are already
+	// settled; suspected duplicates are never matched.
+	freePayments := make([]payment.Payment, 0, len(payments))
+	var dayFreePayments []payment.Payment
+	var dayPaymentIDs []uint
+	for _, p := range payments {
+		inDay := !p.Time.Before(start) && p.Time.Before(end)
+		if inDay {
+			dayPaymentIDs = append(dayPaymentIDs, p.ID)
+		}
+		if p.OrderID == nil && p.DuplicateOfID == nil && !existingPaymentMatched[p.ID] {
+			freePayments = append(freePayments, p)
+			if inDay {
+				dayFreePayments = append(dayFreePayments, p)
 			}
 		}
+	}
 
-		if len(candidates) == 1 {
-			p := candidates[0]
-			now := time.Now()
-			m := Match{
-				OrderID:    o.ID,
-				PaymentID:  p.ID,
-				Confidence: 1.0,
-				MatchedAt:  now,
-			}
-			if err := s.db.Create(&m).Error; err != nil {
-				return summary, err
-			}
+	pl, err := s.withSettings(settings).buildPlan(mode, settings.Strategies, freeOrders, freePayments)
+	if err != nil {
+		return plan{}, err
+	}
+	pl.addUnmatchedPayments(dayFreePayments)
+
+	pl.scopeOrderIDs = dayOrderIDs
+	pl.scopePaymentIDs = dayPaymentIDs
+	// A payment from a neighbouring day matched here may still carry an
+	// UNMATCHED_PAYMENT exception from its own day's run; own it so that
+	// exception gets resolved.
+	for _, pm := range pl.matches {
+		if pm.Payment.Time.Before(start) || !pm.Payment.Time.Before(end) {
+			pl.scopePaymentIDs = append(pl.scopePaymentIDs, pm.Payment.ID)
+		}
+	}
+	return pl, nil
+}
 
-			usedPayment[p.ID] = true
+// writeBatchSize is how many rows applyPlan inserts per statement.
+const writeBatchSize = 500
 
-			// Update order status and paid_at.
-			o.Status = order.StatusPaidUPI
-			o.PaidAt = &p.Time
-			if err := s.db.Save(&o).Error; err != nil {
-				return summary, err
-			}
-			summary.MatchedOrders++
-		} else if len(candidates) == 0 {
-			// No candidate payment found for this order.
-			ex := Exception{
-				MerchantID: merchantID,
-				StoreID:    storeID,
-				OrderID:    &o.ID,
-				Type:       ExceptionUnmatchedOrder,
-				Reason:     "no payment candidate found for order",
-			}
-			if err := s.db.Create(&ex).Error; err != nil {
-				return summary, err
-			}
-			summary.UnmatchedOrders++
-		} else {
-			// Multiple candidates; ambiguous amount.
-			ex := Exception{
-				MerchantID: merchantID,
-				StoreID:    storeID,
-				OrderID:    &o.ID,
-				Type:       ExceptionAmountMismatch,
-				Reason:     "multiple payment candidates with same amount",
-			}
-			if err := s.db.Create(&ex).Error; err != nil {
-				return summary, err
-			}
-			summary.UnmatchedOrders++
+// applyPlan writes the planned matches and exceptions, tagging new rows
+// with the run that created them, if any. Matches are inserted in batches so that
+// busy store-days don't take one round trip per row.
+func (s *Service) applyPlan(merchantID, storeID uint, runID *uint, pl plan, progress func(done, total int), summary *ReconcileSummary) error {
+	matches := make([]Match, 0, len(pl.matches))
+	var differences []Exception
+	touched := make(map[uint]*order.Order)
+	var touchedIDs []uint
+	now := time.Now()
+	for _, pm := range pl.matches {
+		matches = append(matches, Match{
+			OrderID:    pm.Order.ID,
+			PaymentID:  pm.Payment.ID,
+			Amount:     pm.Amount,
+			Kind:       pm.Kind,
+			Confidence: pm.Confidence,
+			Reason:     pm.Reason,
+			Strategy:   pm.Strategy,
+			MatchedAt:  now,
+			RunID:      runID,
+		})
+		if pm.Difference != 0 {
+			differences = append(differences, differenceException(merchantID, storeID, runID, pm))
+		}
+
+		o, ok := touched[pm.Order.ID]
+		if !ok {
+			oc := pm.Order
+			o = &oc
+			touched[o.ID] = o
+			touchedIDs = append(touchedIDs, o.ID)
 		}
+		o.ApplyPayment(pm.Amount, pm.Payment.PaidStatus(), pm.Payment.Time)
 	}
 
-	// Any payments not used or previously matched get an UNMATCHED_PAYMENT exception.
-	for _, p := range payments {
-		if existingPaymentMatched[p.ID] || usedPayment[p.ID] {
-			continue
+	total := len(matches) + len(touchedIDs)
+	report := func(done int) {
+		if progress != nil {
+			progress(done, total)
 		}
-		ex := Exception{
-			MerchantID: merchantID,
-			StoreID:    storeID,
-			PaymentID:  &p.ID,
-			Type:       ExceptionUnmatchedPayment,
-			Reason:     "no matching order found for payment",
+	}
+
+	for i := 0; i < len(matches); i += writeBatchSize {
+		end := min(i+writeBatchSize, len(matches))
+		if err := s.db.Create(matches[i:end]).Error; err != nil {
+			return err
 		}
-		if err := s.db.Create(&ex).Error; err != nil {
-			return summary, err
+		report(end)
+	}
+	if len(differences) > 0 {
+		if err := s.db.CreateInBatches(differences, writeBatchSize).Error; err != nil {
+			return err
 		}
-		summary.UnmatchedPayments++
 	}
 
-	return summary, nil
-}
+	// Update order status, paid amount and paid_at.
+	for i, id := range touchedIDs {
+		if err := s.db.Save(touched[id]).Error; err != nil {
+			return err
+		}
+		summary.MatchedOrders++
+		if (i+1)%writeBatchSize == 0 {
+			report(len(matches) + i + 1)
+		}
+	}
+	report(total)
 
+	return s.syncExceptions(merchantID, storeID, runID, pl, summary)
+}
@@ -0,0 +1,171 @@
+package matching
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidWindow    = errors.New("lookback and lookahead must not be negative")
+	ErrInvalidTolerance = errors.New("amount tolerance must not be negative")
+)
+
+// Settings holds per-merchant or per-store matching configuration. A row
+// with a nil StoreID applies to every store of the merchant; a store row
+// overrides it field by field. Empty fields inherit.
+type Settings struct {
+	ID               uint     `gorm:"primaryKey"`
+	MerchantID       uint     `gorm:"not null;index"`
+	StoreID          *uint    `gorm:"index"`
+	Strategies       string   `gorm:"size:512"` // comma-separated, highest priority first
+	LookbackMinutes  *int     // how far before the day payments are still candidates
+	LookaheadMinutes *int     // how far after the day payments are still candidates
+	TolerancePaise   *int64   // absolute amount difference still matched
+	TolerancePct     *float64 // amount difference still matched, percent of the bill
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+}
+
+func (Settings) TableName() string {
+	return "matching_settings"
+}
+
+// StrategyList returns the configured strategies in priority order.
+func (st Settings) StrategyList() []string {
+	var names []string
+	for _, n := range strings.Split(st.Strategies, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+type SettingsRequest struct {
+	Strategies       []string `json:"strategies"`
+	LookbackMinutes  *int     `json:"lookback_minutes"`
+	LookaheadMinutes *int     `json:"lookahead_minutes"`
+	TolerancePaise   *int64   `json:"tolerance_paise"`
+	TolerancePct     *float64 `json:"tolerance_pct"`
+}
+
+// EffectiveSettings is the configuration a store's runs actually use. Source
+// is the most specific row found: "store", "merchant" or "default".
+type EffectiveSettings struct {
+	Source           string   `json:"source"`
+	Strategies       []string `json:"strategies"`
+	LookbackMinutes  int      `json:"lookback_minutes"`
+	LookaheadMinutes int      `json:"lookahead_minutes"`
+	TolerancePaise   int64    `json:"tolerance_paise"`
+	TolerancePct     float64  `json:"tolerance_pct"`
+}
+
+func (es EffectiveSettings) lookback() time.Duration {
+	return time.Duration(es.LookbackMinutes) * time.Minute
+}
+
+func (es EffectiveSettings) lookahead() time.Duration {
+	return time.Duration(es.LookaheadMinutes) * time.Minute
+}
+
+// GetSettings returns the effective matching settings of a store.
+func (s *Service) GetSettings(merchantID, storeID uint) (EffectiveSettings, error) {
+	return s.settingsFor(merchantID, storeID)
+}
+
+// SaveSettings stores the matching settings of a store, or the merchant-wide
+// default when storeID is nil.
+func (s *Service) SaveSettings(merchantID uint, storeID *uint, req SettingsRequest) (Settings, error) {
+	for _, name := range req.Strategies {
+		if !s.knownStrategy(name) {
+			return Settings{}, fmt.Errorf("%w: %s", ErrUnknownStrategy, name)
+		}
+	}
+	if (req.LookbackMinutes != nil && *req.LookbackMinutes < 0) || (req.LookaheadMinutes != nil && *req.LookaheadMinutes < 0) {
+		return Settings{}, ErrInvalidWindow
+	}
+	if (req.TolerancePaise != nil && *req.TolerancePaise < 0) || (req.TolerancePct != nil && *req.TolerancePct < 0) {
+		return Settings{}, ErrInvalidTolerance
+	}
+
+	var st Settings
+	q := s.db.Where("merchant_id = ?", merchantID)
+	if storeID != nil {
+		q = q.Where("store_id = ?", *storeID)
+	} else {
+		q = q.Where("store_id IS NULL")
+	}
+	if err := q.First(&st).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return Settings{}, err
+	}
+
+	st.MerchantID = merchantID
+	st.StoreID = storeID
+	st.Strategies = strings.Join(req.Strategies, ",")
+	st.LookbackMinutes = req.LookbackMinutes
+	st.LookaheadMinutes = req.LookaheadMinutes
+	st.TolerancePaise = req.TolerancePaise
+	st.TolerancePct = req.TolerancePct
+	if err := s.db.Save(&st).Error; err != nil {
+		return Settings{}, err
+	}
+	return st, nil
+}
+
+// settingsFor resolves the settings of a store: each field comes from the
+// store row, else the merchant-wide row, else the built-in defaults.
+func (s *Service) settingsFor(merchantID, storeID uint) (EffectiveSettings, error) {
+	var rows []Settings
+	if err := s.db.Where("merchant_id = ? AND (store_id = ? OR store_id IS NULL)", merchantID, storeID).
+		Order("store_id IS NULL").
+		Find(&rows).Error; err != nil {
+		return EffectiveSettings{}, err
+	}
+
+	es := EffectiveSettings{
+		Source:           "default",
+		Strategies:       DefaultStrategies,
+		LookbackMinutes:  int(s.lookback / time.Minute),
+		LookaheadMinutes: int(s.lookahead / time.Minute),
+		TolerancePaise:   s.scorer.ToleranceAbs,
+		TolerancePct:     s.scorer.TolerancePct,
+	}
+	// Walk from the merchant row to the store row so the store wins.
+	for i := len(rows) - 1; i >= 0; i-- {
+		st := rows[i]
+		if st.StoreID != nil {
+			es.Source = "store"
+		} else {
+			es.Source = "merchant"
+		}
+		if names := st.StrategyList(); len(names) > 0 {
+			es.Strategies = names
+		}
+		if st.LookbackMinutes != nil {
+			es.LookbackMinutes = *st.LookbackMinutes
+		}
+		if st.LookaheadMinutes != nil {
+			es.LookaheadMinutes = *st.LookaheadMinutes
+		}
+		if st.TolerancePaise != nil {
+			es.TolerancePaise = *st.TolerancePaise
+		}
+		if st.TolerancePct != nil {
+			es.TolerancePct = *st.TolerancePct
+		}
+	}
+	return es, nil
+}
+
+// withSettings returns a copy of the service whose scorer uses the store's
+// amount tolerance.
+func (s *Service) withSettings(es EffectiveSettings) *Service {
+	tuned := *s
+	tuned.scorer.ToleranceAbs = es.TolerancePaise
+	tuned.scorer.TolerancePct = es.TolerancePct
+	return &tuned
+}
@@ -0,0 +1,129 @@
+package matching
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"upisettle/internal/order"
+	"upisettle/internal/payment"
+)
+
+const (
+	// maxSplitParts caps how many payments may settle a single order.
+	maxSplitParts = 4
+	// maxSplitCandidates caps the payments searched per order, nearest first.
+	maxSplitCandidates = 12
+)
+
+type splitCandidate struct {
+	payment payment.Payment
+	fit     Fit
+}
+
+// planSplits tries to settle each order left without a match by two or
+// more free payments that together equal its outstanding balance, e.g. a
+// large bill paid as two UPI transfers. The subset with the best mean time
+// score wins; a close second subset lowers the confidence like any other
+// runner-up.
+func (s *Service) planSplits(pl *plan, orders []order.Order, payments []payment.Payment, used map[uint]bool) {
+	matched := make(map[uint]bool)
+	for _, pm := range pl.matches {
+		matched[pm.Order.ID] = true
+	}
+
+	for _, o := range orders {
+		outstanding := o.Outstanding()
+		if matched[o.ID] || outstanding <= 0 {
+			continue
+		}
+
+		var cands []splitCandidate
+		for _, p := range payments {
+			if used[p.ID] || p.Amount <= 0 || p.Amount >= outstanding {
+				continue
+			}
+			if fit := s.scorer.timeFit(o.CreatedAt, p.Time); fit.Score > 0 {
+				cands = append(cands, splitCandidate{payment: p, fit: fit})
+			}
+		}
+		if len(cands) < 2 {
+			continue
+		}
+		sort.SliceStable(cands, func(i, j int) bool { return cands[i].fit.Score > cands[j].fit.Score })
+		if len(cands) > maxSplitCandidates {
+			cands = cands[:maxSplitCandidates]
+		}
+
+		amounts := make([]int64, len(cands))
+		fits := make([]Fit, len(cands))
+		for i, c := range cands {
+			amounts[i], fits[i] = c.payment.Amount, c.fit
+		}
+		best, bestFit, runnerUp := bestSubset(amounts, fits, outstanding, maxSplitParts)
+		if best == nil {
+			continue
+		}
+		conf := s.scorer.Confidence(bestFit, runnerUp)
+		if conf < s.threshold {
+			continue
+		}
+
+		pl.dropOrderException(o.ID)
+		for _, i := range best {
+			c := cands[i]
+			pl.matches = append(pl.matches, plannedMatch{
+				Order:      o,
+				Payment:    c.payment,
+				Amount:     c.payment.Amount,
+				Kind:       MatchKindSplit,
+				Confidence: conf,
+				Reason:     fmt.Sprintf("one of %d payments adding up to the order amount", len(best)),
+			})
+			used[c.payment.ID] = true
+		}
+		matched[o.ID] = true
+	}
+}
+
+// bestSubset searches subsets of two to maxParts items whose amounts sum to
+// target and returns the indices of the one with the best mean score, its
+// mean fit, and the runner-up subset's mean fit.
+func bestSubset(amounts []int64, fits []Fit, target int64, maxParts int) ([]int, Fit, Fit) {
+	var best []int
+	var bestFit, runnerUp Fit
+
+	chosen := make([]int, 0, maxParts)
+	var walk func(start int, remaining int64, sum Fit)
+	walk = func(start int, remaining int64, sum Fit) {
+		if remaining == 0 {
+			if len(chosen) < 2 {
+				return
+			}
+			n := len(chosen)
+			mean := Fit{Score: sum.Score / float64(n), Gap: sum.Gap / time.Duration(n)}
+			if mean.Score > bestFit.Score {
+				runnerUp = bestFit
+				bestFit = mean
+				best = append(best[:0:0], chosen...)
+			} else if mean.Score > runnerUp.Score {
+				runnerUp = mean
+			}
+			return
+		}
+		if len(chosen) == maxParts {
+			return
+		}
+		for i := start; i < len(amounts); i++ {
+			if amounts[i] > remaining {
+				continue
+			}
+			chosen = append(chosen, i)
+			walk(i+1, remaining-amounts[i], Fit{Score: sum.Score + fits[i].Score, Gap: sum.Gap + fits[i].Gap})
+			chosen = chosen[:len(chosen)-1]
+		}
+	}
+	walk(0, target, Fit{})
+
+	return best, bestFit, runnerUp
+}
@@ -0,0 +1,84 @@
+package matching
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestBestSubset(t *testing.T) {
+	tests := []struct {
+		name         string
+		amounts      []int64
+		scores       []float64
+		target       int64
+		maxParts     int
+		want         []int
+		wantScore    float64
+		wantRunnerUp float64
+	}{
+		{
+			name:     "no items",
+			target:   1000,
+			maxParts: 4,
+		},
+		{
+			name:     "a single item is not a split",
+			amounts:  []int64{1000, 300},
+			scores:   []float64{0.9, 0.8},
+			target:   1000,
+			maxParts: 4,
+		},
+		{
+			name:      "two parts",
+			amounts:   []int64{600, 400, 700},
+			scores:    []float64{0.8, 0.6, 0.9},
+			target:    1000,
+			maxParts:  4,
+			want:      []int{0, 1},
+			wantScore: 0.7,
+		},
+		{
+			name:         "best mean wins, second is runner-up",
+			amounts:      []int64{500, 500, 300, 200},
+			scores:       []float64{0.9, 0.9, 0.2, 0.2},
+			target:       1000,
+			maxParts:     4,
+			want:         []int{0, 1},
+			wantScore:    0.9,
+			wantRunnerUp: 1.3 / 3, // 500+300+200 either way
+		},
+		{
+			name:     "too many parts",
+			amounts:  []int64{250, 250, 250, 250},
+			scores:   []float64{1, 1, 1, 1},
+			target:   1000,
+			maxParts: 3,
+		},
+		{
+			name:     "nothing adds up",
+			amounts:  []int64{300, 300, 300},
+			scores:   []float64{1, 1, 1},
+			target:   1000,
+			maxParts: 4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fits := make([]Fit, len(tt.scores))
+			for i, score := range tt.scores {
+				fits[i] = Fit{Score: score}
+			}
+			got, best, runnerUp := bestSubset(tt.amounts, fits, tt.target, tt.maxParts)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("bestSubset() = %v, want %v", got, tt.want)
+			}
+			if math.Abs(best.Score-tt.wantScore) > 1e-9 {
+				t.Errorf("score = %v, want %v", best.Score, tt.wantScore)
+			}
+			if math.Abs(runnerUp.Score-tt.wantRunnerUp) > 1e-9 {
+				t.Errorf("runner-up = %v, want %v", runnerUp.Score, tt.wantRunnerUp)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package matching
+
+import (
+	"strings"
+
+	"upisettle/internal/order"
+	"upisettle/internal/payment"
+)
+
+// Built-in strategy names.
+const (
+	// StrategyUPIRef matches an order whose external_ref equals the UPI
+	// reference of the payment.
+	StrategyUPIRef = "upi_ref"
+	// StrategyNoteRef matches an order whose external_ref appears in the
+	// remark the customer typed in their UPI app.
+	StrategyNoteRef = "note_ref"
+	// StrategyRepeatVPA matches an order tagged with a regular customer's
+	// VPA to a payment from that VPA.
+	StrategyRepeatVPA = "repeat_vpa"
+	// StrategyAmountTime is the amount + time window scorer, run in the
+	// reconcile mode (greedy or optimal).
+	StrategyAmountTime = "amount_time"
+	// StrategySplit settles one order with several payments.
+	StrategySplit = "split"
+	// StrategyCombined settles several orders with one payment.
+	StrategyCombined = "combined"
+	// StrategyManual marks matches linked by a user.
+	StrategyManual = "manual"
+)
+
+// DefaultStrategies is the priority order used when neither the store nor
+// the merchant has configured one: hard evidence first, then scoring.
+var DefaultStrategies = []string{
+	StrategyUPIRef,
+	StrategyNoteRef,
+	StrategyRepeatVPA,
+	StrategyAmountTime,
+	StrategySplit,
+	StrategyCombined,
+}
+
+// MatcherInput is what a strategy gets to work with: the open orders and
+// free payments that earlier strategies in the run left unmatched.
+type MatcherInput struct {
+	Orders   []order.Order
+	Payments []payment.Payment
+}
+
+// MatchResult is what a strategy proposes. Exceptions are only kept for
+// orders that no later strategy manages to settle.
+type MatchResult struct {
+	Matches    []ProposedMatch
+	Exceptions []ProposedException
+}
+
+// Matcher is a pluggable matching strategy. Strategies run in the priority
+// order configured for the store; the engine validates every proposal and
+// records the strategy's Name on the matches it creates.
+type Matcher interface {
+	Name() string
+	Match(in MatcherInput) MatchResult
+}
+
+// RegisterMatcher adds a custom strategy that stores can then list in their
+// matching settings. A strategy with the same name as an existing one
+// replaces it.
+func (s *Service) RegisterMatcher(m Matcher) {
+	s.custom[m.Name()] = m
+}
+
+// knownStrategy reports whether name can be used in matching settings.
+func (s *Service) knownStrategy(name string) bool {
+	for _, b := range DefaultStrategies {
+		if b == name {
+			return true
+		}
+	}
+	_, ok := s.custom[name]
+	return ok
+}
+
+// matcherFor returns the strategy with the given name, configured for the
+// run's mode.
+func (s *Service) matcherFor(name, mode string) (Matcher, bool) {
+	switch name {
+	case StrategyUPIRef:
+		return refMatcher{name: name, confidence: 1.0, matches: upiRefMatches}, true
+	case StrategyNoteRef:
+		return refMatcher{name: name, confidence: 0.95, matches: noteRefMatches}, true
+	case StrategyRepeatVPA:
+		return repeatVPAMatcher{scorer: s.scorer}, true
+	case StrategyAmountTime:
+		switch mode {
+		case ModeOptimal:
+			return planMatcher{name: name, fn: s.planOptimal}, true
+		case modeIncremental:
+			return planMatcher{name: name, fn: s.planByPayment}, true
+		}
+		return planMatcher{name: name, fn: s.planGreedy}, true
+	case StrategySplit:
+		return planMatcher{name: name, fn: s.planSplits}, true
+	case StrategyCombined:
+		return planMatcher{name: name, fn: s.planCombined}, true
+	}
+	m, ok := s.custom[name]
+	return m, ok
+}
+
+// planMatcher adapts the engine's own plan passes to the Matcher interface.
+type planMatcher struct {
+	name string
+	fn   func(pl *plan, orders []order.Order, payments []payment.Payment, used map[uint]bool)
+}
+
+func (m planMatcher) Name() string {
+	return m.name
+}
+
+func (m planMatcher) Match(in MatcherInput) MatchResult {
+	var pl plan
+	m.fn(&pl, in.Orders, in.Payments, make(map[uint]bool))
+	return pl.result()
+}
+
+// refMatcher pairs a payment with the single open order whose external_ref
+// it carries. The payment must not exceed the order's outstanding balance.
+type refMatcher struct {
+	name       string
+	confidence float64
+	matches    func(o order.Order, p payment.Payment) bool
+}
+
+func (m refMatcher) Name() string {
+	return m.name
+}
+
+func (m refMatcher) Match(in MatcherInput) MatchResult {
+	var res MatchResult
+	taken := make(map[uint]bool)
+	for _, p := range in.Payments {
+		var found *order.Order
+		count := 0
+		for i := range in.Orders {
+			o := &in.Orders[i]
+			if o.ExternalRef == "" || taken[o.ID] || !m.matches(*o, p) {
+				continue
+			}
+			found = o
+			count++
+		}
+		if count != 1 || p.Amount <= 0 || p.Amount > found.Outstanding() {
+			continue
+		}
+
+		kind := MatchKindSingle
+		if p.Amount < found.Outstanding() {
+			kind = MatchKindSplit
+		}
+		res.Matches = append(res.Matches, ProposedMatch{
+			OrderID:    found.ID,
+			PaymentID:  p.ID,
+			Amount:     p.Amount,
+			Kind:       kind,
+			Confidence: m.confidence,
+			Reason:     "payment carries order reference " + found.ExternalRef,
+		})
+		taken[found.ID] = true
+	}
+	return res
+}
+
+func upiRefMatches(o order.Order, p payment.Payment) bool {
+	return p.UPIRef != "" && strings.EqualFold(strings.TrimSpace(o.ExternalRef), strings.TrimSpace(p.UPIRef))
+}
+
+// minNoteRefLength keeps very short refs like "1" from matching any note.
+const minNoteRefLength = 3
+
+func noteRefMatches(o order.Order, p payment.Payment) bool {
+	ref := strings.TrimSpace(o.ExternalRef)
+	if len(ref) < minNoteRefLength || p.Note == "" {
+		return false
+	}
+	return strings.Contains(strings.ToLower(p.Note), strings.ToLower(ref))
+}
+
+// repeatVPAMatcher pairs a payment with the single open order tagged with
+// the payer's VPA, for regulars the counter already knows.
+type repeatVPAMatcher struct {
+	scorer Scorer
+}
+
+func (repeatVPAMatcher) Name() string {
+	return StrategyRepeatVPA
+}
+
+func (m repeatVPAMatcher) Match(in MatcherInput) MatchResult {
+	var res MatchResult
+	taken := make(map[uint]bool)
+	for _, p := range in.Payments {
+		if p.PayerVPA == "" {
+			continue
+		}
+		var found *order.Order
+		count := 0
+		for i := range in.Orders {
+			o := &in.Orders[i]
+			if taken[o.ID] || !strings.EqualFold(o.CustomerVPA, p.PayerVPA) || m.scorer.Score(*o, p) <= 0 {
+				continue
+			}
+			found = o
+			count++
+		}
+		if count != 1 {
+			continue
+		}
+		due := found.Outstanding()
+		res.Matches = append(res.Matches, ProposedMatch{
+			OrderID:    found.ID,
+			PaymentID:  p.ID,
+			Amount:     due,
+			Difference: p.Amount - due,
+			Kind:       MatchKindSingle,
+			Confidence: 0.9,
+			Reason:     "paid by the order's customer VPA " + p.PayerVPA,
+		})
+		taken[found.ID] = true
+	}
+	return res
+}
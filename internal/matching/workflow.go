@@ -0,0 +1,186 @@
+package matching
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"upisettle/internal/auth"
+	"upisettle/internal/payment"
+)
+
+var (
+	ErrUnknownStatus          = errors.New("unknown exception status")
+	ErrInvalidTransition      = errors.New("invalid exception status transition")
+	ErrResolutionReasonNeeded = errors.New("resolution_reason is required to close an exception")
+	ErrUnknownAssignee        = errors.New("assignee is not a user of this merchant")
+	ErrDuplicateMatched       = errors.New("payment was matched since its duplicate flag was ignored; unmatch it first")
+)
+
+// exceptionTransitions lists the statuses each status may move to.
+var exceptionTransitions = map[string][]string{
+	ExceptionStatusOpen:       {ExceptionStatusInReview, ExceptionStatusResolved, ExceptionStatusWrittenOff, ExceptionStatusIgnored},
+	ExceptionStatusInReview:   {ExceptionStatusOpen, ExceptionStatusResolved, ExceptionStatusWrittenOff, ExceptionStatusIgnored},
+	ExceptionStatusResolved:   {ExceptionStatusOpen},
+	ExceptionStatusWrittenOff: {ExceptionStatusOpen},
+	ExceptionStatusIgnored:    {ExceptionStatusOpen},
+}
+
+// isClosedStatus reports whether status takes the exception off the open
+// list.
+func isClosedStatus(status string) bool {
+	return status == ExceptionStatusResolved || status == ExceptionStatusWrittenOff || status == ExceptionStatusIgnored
+}
+
+func canTransition(from, to string) bool {
+	for _, s := range exceptionTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+type UpdateExceptionRequest struct {
+	Status           string `json:"status"`
+	ResolutionReason string `json:"resolution_reason"`
+	AssigneeID       *uint  `json:"assignee_id"`
+	Note             string `json:"note"`
+}
+
+// UpdateException moves an exception through the workflow: it can change
+// the status, assign it to a staff user and attach a note. Every call that
+// changes something is recorded in the exception's history; one that asks
+// for nothing returns the exception as it is.
+func (s *Service) UpdateException(merchantID, storeID, userID, exceptionID uint, req UpdateExceptionRequest) (Exception, error) {
+	if _, ok := exceptionTransitions[req.Status]; req.Status != "" && !ok {
+		return Exception{}, ErrUnknownStatus
+	}
+
+	var ex Exception
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND merchant_id = ? AND store_id = ?", exceptionID, merchantID, storeID).
+			First(&ex).Error; err != nil {
+			return err
+		}
+
+		from := ex.Status
+		to := from
+		if (req.Status == "" || req.Status == from) && req.AssigneeID == nil && req.Note == "" {
+			return nil
+		}
+		if req.Status != "" && req.Status != from {
+			if !canTransition(from, req.Status) {
+				return ErrInvalidTransition
+			}
+			if isClosedStatus(req.Status) && req.ResolutionReason == "" {
+				return ErrResolutionReasonNeeded
+			}
+			to = req.Status
+		}
+
+		if req.AssigneeID != nil {
+			var count int64
+			if err := tx.Model(&auth.User{}).
+				Where("id = ? AND merchant_id = ?", *req.AssigneeID, merchantID).
+				Count(&count).Error; err != nil {
+				return err
+			}
+			if count == 0 {
+				return ErrUnknownAssignee
+			}
+			ex.AssigneeID = req.AssigneeID
+		}
+
+		if to != from {
+			ex.ResolutionReason = req.ResolutionReason
+		}
+		if ex.Type == ExceptionDuplicatePayment && from != to && ex.PaymentID != nil {
+			if err := syncDuplicateOf(tx, ex, from, to); err != nil {
+				return err
+			}
+		}
+		return transition(tx, &ex, to, req.Note, &userID)
+	})
+	return ex, err
+}
+
+// syncDuplicateOf keeps the payment behind a DUPLICATE_PAYMENT exception in
+// step with it: ignoring the flag means the payment is genuine after all,
+// reopening an ignored flag marks it as a duplicate again. A payment that
+// was matched in between has to be unmatched before the flag is reopened.
+func syncDuplicateOf(tx *gorm.DB, ex Exception, from, to string) error {
+	switch {
+	case to == ExceptionStatusIgnored:
+		return tx.Model(&payment.Payment{}).Where("id = ?", *ex.PaymentID).
+			Update("duplicate_of_id", nil).Error
+	case from == ExceptionStatusIgnored && ex.DuplicateOfID != nil:
+		var p payment.Payment
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&p, *ex.PaymentID).Error; err != nil {
+			return err
+		}
+		var matched int64
+		if err := tx.Model(&Match{}).Where("payment_id = ?", p.ID).Count(&matched).Error; err != nil {
+			return err
+		}
+		if matched > 0 || p.OrderID != nil {
+			return ErrDuplicateMatched
+		}
+		return tx.Model(&p).Update("duplicate_of_id", *ex.DuplicateOfID).Error
+	}
+	return nil
+}
+
+// ListExceptionHistory returns the history of an exception, oldest first.
+func (s *Service) ListExceptionHistory(merchantID, storeID, exceptionID uint) ([]ExceptionEvent, error) {
+	var ex Exception
+	if err := s.db.Where("id = ? AND merchant_id = ? AND store_id = ?", exceptionID, merchantID, storeID).
+		First(&ex).Error; err != nil {
+		return nil, err
+	}
+
+	var events []ExceptionEvent
+	if err := s.db.Where("exception_id = ?", ex.ID).Order("id ASC").Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// transition moves ex to status, keeping Resolved and ResolvedAt in step,
+// saves it and appends a history event. userID is nil for changes made by
+// the reconcile engine.
+func transition(tx *gorm.DB, ex *Exception, status, note string, userID *uint) error {
+	from := ex.Status
+	if from == "" {
+		from = ExceptionStatusOpen
+	}
+
+	ex.Status = status
+	if isClosedStatus(status) {
+		if !ex.Resolved {
+			now := time.Now()
+			ex.ResolvedAt = &now
+		}
+		ex.Resolved = true
+	} else {
+		ex.Resolved = false
+		ex.ResolvedAt = nil
+		ex.ResolutionReason = ""
+	}
+	if err := tx.Save(ex).Error; err != nil {
+		return err
+	}
+
+	event := ExceptionEvent{
+		ExceptionID: ex.ID,
+		FromStatus:  from,
+		ToStatus:    status,
+		AssigneeID:  ex.AssigneeID,
+		Note:        note,
+		UserID:      userID,
+	}
+	return tx.Create(&event).Error
+}
@@ -1,9 +1,12 @@
 package merchant
 
 import (
+	"errors"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 
 	"upisettle/internal/auth"
 )
@@ -56,3 +59,23 @@ func RegisterHTTP(rg *gin.RouterGroup, svc *Service) {
 	})
 }
 
+// QueryDay reads the YYYY-MM-DD query param as a business day of the
+// merchant (see BusinessDay). If the param is missing or invalid it answers
+// the request itself and returns false.
+func QueryDay(c *gin.Context, db *gorm.DB, merchantID uint, param string) (time.Time, bool) {
+	date := c.Query(param)
+	if date == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": param + " query param is required (YYYY-MM-DD)"})
+		return time.Time{}, false
+	}
+	day, err := BusinessDay(db, merchantID, date)
+	if errors.Is(err, ErrInvalidDate) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + param + " format, expected YYYY-MM-DD"})
+		return time.Time{}, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return time.Time{}, false
+	}
+	return day, true
+}
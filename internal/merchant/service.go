@@ -1,9 +1,14 @@
 package merchant
 
 import (
+	"errors"
+	"time"
+
 	"gorm.io/gorm"
 )
 
+var ErrInvalidDate = errors.New("invalid date format, expected YYYY-MM-DD")
+
 type Service struct {
 	db *gorm.DB
 }
@@ -37,3 +42,27 @@ func (s *Service) ListStores(merchantID uint) ([]Store, error) {
 	return stores, nil
 }
 
+
+// Location returns the timezone the merchant's business days are counted in.
+func Location(db *gorm.DB, merchantID uint) (*time.Location, error) {
+	var m Merchant
+	if err := db.Select("timezone").First(&m, merchantID).Error; err != nil {
+		return nil, err
+	}
+	return time.LoadLocation(m.Timezone)
+}
+
+// BusinessDay reads a YYYY-MM-DD date as the start of that day in the
+// merchant's timezone, so "2024-03-12" for a merchant in Asia/Kolkata is
+// 2024-03-12 00:00 IST rather than UTC midnight.
+func BusinessDay(db *gorm.DB, merchantID uint, date string) (time.Time, error) {
+	loc, err := Location(db, merchantID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	day, err := time.ParseInLocation("2006-01-02", date, loc)
+	if err != nil {
+		return time.Time{}, ErrInvalidDate
+	}
+	return day, nil
+}
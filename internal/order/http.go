@@ -3,11 +3,11 @@ package order
 import (
 	"net/http"
 	"strconv"
-	"time"
 
 	"github.com/gin-gonic/gin"
 
 	"upisettle/internal/auth"
+	"upisettle/internal/merchant"
 )
 
 func RegisterHTTP(rg *gin.RouterGroup, svc *Service) {
@@ -65,14 +65,8 @@ func RegisterHTTP(rg *gin.RouterGroup, svc *Service) {
 		}
 		storeID := uint(storeIDUint64)
 
-		dateStr := c.Query("date")
-		if dateStr == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "date query param is required (YYYY-MM-DD)"})
-			return
-		}
-		day, err := time.Parse("2006-01-02", dateStr)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid date format, expected YYYY-MM-DD"})
+		day, ok := merchant.QueryDay(c, svc.db, merchantID, "date")
+		if !ok {
 			return
 		}
 
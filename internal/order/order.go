@@ -16,9 +16,11 @@ type Order struct {
 	MerchantID  uint      `gorm:"not null;index"`
 	StoreID     uint      `gorm:"not null;index"`
 	ExternalRef string    `gorm:"size:255"` // optional link to POS ref
+	CustomerVPA string    `gorm:"size:255"` // optional VPA of a known regular customer
 	Amount      int64     `gorm:"not null"` // store in smallest currency unit (paise)
 	Currency    string    `gorm:"size:10;default:'INR'"`
 	Status      string    `gorm:"size:32;not null;default:'PENDING'"`
+	PaidAmount  int64     `gorm:"not null;default:0"` // paise received so far
 	CreatedAt   time.Time
 	PaidAt      *time.Time
 	UpdatedAt   time.Time
@@ -28,3 +30,39 @@ func (Order) TableName() string {
 	return "orders"
 }
 
+
+// Outstanding returns the amount still owed on the order.
+func (o *Order) Outstanding() int64 {
+	return o.Amount - o.PaidAmount
+}
+
+// ApplyPayment adds amount to the paid total. Once the order is fully paid
+// it moves to paidStatus with PaidAt set to at; until then it is PARTIAL.
+func (o *Order) ApplyPayment(amount int64, paidStatus string, at time.Time) {
+	o.PaidAmount += amount
+	if o.Outstanding() > 0 {
+		o.Status = StatusPartial
+		return
+	}
+	o.Status = paidStatus
+	o.PaidAt = &at
+}
+
+// RevertPayment undoes ApplyPayment for amount, e.g. when a match is
+// removed. The order falls back to PARTIAL or PENDING unless other payments
+// still cover it.
+func (o *Order) RevertPayment(amount int64) {
+	o.PaidAmount -= amount
+	if o.PaidAmount < 0 {
+		o.PaidAmount = 0
+	}
+	if o.Outstanding() <= 0 {
+		return
+	}
+	o.PaidAt = nil
+	if o.PaidAmount == 0 {
+		o.Status = StatusPending
+	} else {
+		o.Status = StatusPartial
+	}
+}
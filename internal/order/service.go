@@ -17,6 +17,7 @@ func NewService(db *gorm.DB) *Service {
 type CreateOrderRequest struct {
 	Amount      int64  `json:"amount" binding:"required"`
 	ExternalRef string `json:"external_ref"`
+	CustomerVPA string `json:"customer_vpa"`
 }
 
 func (s *Service) CreateOrder(merchantID, storeID uint, req CreateOrderRequest) (Order, error) {
@@ -24,6 +25,7 @@ func (s *Service) CreateOrder(merchantID, storeID uint, req CreateOrderRequest)
 		MerchantID:  merchantID,
 		StoreID:     storeID,
 		ExternalRef: req.ExternalRef,
+		CustomerVPA: req.CustomerVPA,
 		Amount:      req.Amount,
 		Status:      StatusPending,
 	}
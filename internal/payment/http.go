@@ -1,13 +1,18 @@
 package payment
 
 import (
+	"errors"
+	"io"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 
 	"upisettle/internal/auth"
+	"upisettle/internal/merchant"
+	"upisettle/internal/payment/statement"
 )
 
 func RegisterHTTP(rg *gin.RouterGroup, svc *Service) {
@@ -47,6 +52,11 @@ func RegisterHTTP(rg *gin.RouterGroup, svc *Service) {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		if p.Duplicate {
+			// Same UPI ref sent again: answer with the payment we already have.
+			c.JSON(http.StatusOK, p)
+			return
+		}
 		c.JSON(http.StatusCreated, p)
 	})
 
@@ -78,10 +88,609 @@ func RegisterHTTP(rg *gin.RouterGroup, svc *Service) {
 
 		p, err := svc.CreateCashPayment(merchantID, storeID, req)
 		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+				return
+			}
+			if errors.Is(err, ErrOrderAlreadyPaid) || errors.Is(err, ErrCashOverpayment) {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+				return
+			}
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 		c.JSON(http.StatusCreated, p)
 	})
+
+	rg.POST("/stores/:storeId/cash-payouts", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+		userID := c.GetUint(auth.ContextUserIDKey)
+
+		storeIDParam := c.Param("storeId")
+		storeIDUint64, err := strconv.ParseUint(storeIDParam, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid storeId"})
+			return
+		}
+		storeID := uint(storeIDUint64)
+
+		var req CreateCashPayoutRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		p, err := svc.CreateCashPayout(merchantID, storeID, userID, req)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, p)
+	})
+
+	rg.GET("/stores/:storeId/cash-payouts", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+
+		storeIDParam := c.Param("storeId")
+		storeIDUint64, err := strconv.ParseUint(storeIDParam, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid storeId"})
+			return
+		}
+		storeID := uint(storeIDUint64)
+
+		day, ok := merchant.QueryDay(c, svc.db, merchantID, "date")
+		if !ok {
+			return
+		}
+
+		payouts, err := svc.ListCashPayouts(merchantID, storeID, day)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, payouts)
+	})
+
+	// Raw credit-alert SMS forwarded by the phone; the server parses it.
+	rg.POST("/stores/:storeId/sms", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+
+		storeIDParam := c.Param("storeId")
+		storeIDUint64, err := strconv.ParseUint(storeIDParam, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid storeId"})
+			return
+		}
+		storeID := uint(storeIDUint64)
+
+		var req IngestSMSRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		res, err := svc.IngestSMS(merchantID, storeID, req)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		switch res.Status {
+		case SMSStatusCreated:
+			c.JSON(http.StatusCreated, res)
+		case SMSStatusReview:
+			c.JSON(http.StatusAccepted, res)
+		default:
+			c.JSON(http.StatusOK, res)
+		}
+	})
+
+	rg.GET("/stores/:storeId/sms-reviews", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+
+		storeIDParam := c.Param("storeId")
+		storeIDUint64, err := strconv.ParseUint(storeIDParam, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid storeId"})
+			return
+		}
+		storeID := uint(storeIDUint64)
+
+		reviews, err := svc.ListSMSReviews(merchantID, storeID, c.Query("status"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, reviews)
+	})
+
+	rg.POST("/stores/:storeId/sms-reviews/:reviewId/resolve", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+		userID := c.GetUint(auth.ContextUserIDKey)
+
+		storeIDParam := c.Param("storeId")
+		storeIDUint64, err := strconv.ParseUint(storeIDParam, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid storeId"})
+			return
+		}
+		storeID := uint(storeIDUint64)
+
+		reviewIDUint64, err := strconv.ParseUint(c.Param("reviewId"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid reviewId"})
+			return
+		}
+
+		var req CreatePaymentRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		p, err := svc.ResolveSMSReview(merchantID, storeID, userID, uint(reviewIDUint64), req)
+		if err != nil {
+			writeReviewError(c, err)
+			return
+		}
+		if p.Duplicate {
+			c.JSON(http.StatusOK, p)
+			return
+		}
+		c.JSON(http.StatusCreated, p)
+	})
+
+	rg.POST("/stores/:storeId/sms-reviews/:reviewId/dismiss", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+		userID := c.GetUint(auth.ContextUserIDKey)
+
+		storeIDParam := c.Param("storeId")
+		storeIDUint64, err := strconv.ParseUint(storeIDParam, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid storeId"})
+			return
+		}
+		storeID := uint(storeIDUint64)
+
+		reviewIDUint64, err := strconv.ParseUint(c.Param("reviewId"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid reviewId"})
+			return
+		}
+
+		review, err := svc.DismissSMSReview(merchantID, storeID, userID, uint(reviewIDUint64))
+		if err != nil {
+			writeReviewError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, review)
+	})
+
+	// Re-runs the current SMS parser over archived messages and shows where
+	// it disagrees with the stored payments. Nothing is written.
+	rg.GET("/raw-messages/reparse", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+		if c.GetString(auth.ContextRoleKey) != "owner" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "only the merchant owner can re-parse messages"})
+			return
+		}
+
+		opts, ok := reparseOptions(c, svc, merchantID)
+		if !ok {
+			return
+		}
+
+		report, err := svc.Reparse(merchantID, opts)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	})
+
+	// Same as the GET, and applies the CHANGED diffs of the listed messages
+	// to their payments.
+	rg.POST("/raw-messages/reparse", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+		if c.GetString(auth.ContextRoleKey) != "owner" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "only the merchant owner can re-parse messages"})
+			return
+		}
+
+		opts, ok := reparseOptions(c, svc, merchantID)
+		if !ok {
+			return
+		}
+
+		var req ApplyReparseRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		opts.Apply = req.MessageIDs
+
+		report, err := svc.Reparse(merchantID, opts)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	})
+
+	rg.GET("/statement-layouts", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+
+		layouts, err := svc.ListStatementLayouts(merchantID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, layouts)
+	})
+
+	rg.PUT("/statement-layouts/:name", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+
+		var req StatementLayoutRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		layout, err := svc.SaveStatementLayout(merchantID, c.Param("name"), req)
+		if err != nil {
+			if errors.Is(err, statement.ErrInvalidLayout) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, layout)
+	})
+
+	// Bank statement download (CSV or XLSX) as the "file" form field; its UPI
+	// credits become payments. ?layout= names the layout when the header
+	// isn't recognised on its own.
+	rg.POST("/stores/:storeId/statements", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+
+		storeIDParam := c.Param("storeId")
+		storeIDUint64, err := strconv.ParseUint(storeIDParam, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid storeId"})
+			return
+		}
+		storeID := uint(storeIDUint64)
+
+		fh, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "file form field is required"})
+			return
+		}
+		if fh.Size > MaxStatementSize {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "statement file is too large"})
+			return
+		}
+		f, err := fh.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		defer f.Close()
+		data, err := io.ReadAll(io.LimitReader(f, MaxStatementSize))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		report, err := svc.ImportStatement(merchantID, storeID, data, c.Query("layout"))
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrLayoutNotFound):
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			case errors.Is(err, ErrUnreadableStatement), errors.Is(err, statement.ErrUnknownLayout):
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	})
+
+	// Webhook endpoints hold secrets, so only the owner manages them.
+	rg.POST("/webhook-endpoints", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+		if c.GetString(auth.ContextRoleKey) != "owner" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "only the merchant owner can manage webhooks"})
+			return
+		}
+
+		var req CreateWebhookEndpointRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		e, err := svc.CreateWebhookEndpoint(merchantID, req)
+		if err != nil {
+			writeWebhookError(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, e)
+	})
+
+	rg.GET("/webhook-endpoints", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+		if c.GetString(auth.ContextRoleKey) != "owner" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "only the merchant owner can manage webhooks"})
+			return
+		}
+
+		endpoints, err := svc.ListWebhookEndpoints(merchantID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, endpoints)
+	})
+
+	rg.PUT("/webhook-endpoints/:endpointId/routes", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+		if c.GetString(auth.ContextRoleKey) != "owner" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "only the merchant owner can manage webhooks"})
+			return
+		}
+
+		endpointIDUint64, err := strconv.ParseUint(c.Param("endpointId"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid endpointId"})
+			return
+		}
+
+		var req WebhookRouteRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		route, err := svc.SaveWebhookRoute(merchantID, uint(endpointIDUint64), req)
+		if err != nil {
+			writeWebhookError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, route)
+	})
+
+	rg.GET("/webhook-events", func(c *gin.Context) {
+		rawMerchantID, ok := c.Get(auth.ContextMerchantIDKey)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing merchant context"})
+			return
+		}
+		merchantID, ok := rawMerchantID.(uint)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid merchant context"})
+			return
+		}
+
+		events, err := svc.ListWebhookEvents(merchantID, c.Query("status"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, events)
+	})
+}
+
+// RegisterWebhookHTTP mounts the webhook receiver. Providers can't hold a
+// user's token, so rg must not require one; deliveries are authenticated by
+// their signature instead.
+func RegisterWebhookHTTP(rg *gin.RouterGroup, svc *Service) {
+	rg.POST("/webhooks/:provider/:key", func(c *gin.Context) {
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, MaxWebhookSize))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		res, err := svc.ReceiveWebhook(c.Param("provider"), c.Param("key"), c.Request.Header, body)
+		if err != nil {
+			writeWebhookError(c, err)
+			return
+		}
+		// Anything but a 2xx makes the provider deliver again; an event
+		// waiting for a route is accepted and kept instead.
+		if res.Status == WebhookStatusUnrouted {
+			c.JSON(http.StatusAccepted, res)
+			return
+		}
+		c.JSON(http.StatusOK, res)
+	})
+}
+
+func writeWebhookError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "webhook endpoint not found"})
+	case errors.Is(err, ErrUnknownProvider), errors.Is(err, ErrStoreNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrInvalidSignature):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrWebhookInProgress):
+		// The provider delivers again and gets the outcome then.
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrInvalidPayload):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
 }
 
+func writeReviewError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "message not found"})
+	case errors.Is(err, ErrReviewClosed):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// reparseOptions reads the from/to dates (inclusive, in the merchant's
+// timezone) and optional store_id of a re-parse request, answering the
+// request itself if they are invalid.
+func reparseOptions(c *gin.Context, svc *Service, merchantID uint) (ReparseOptions, bool) {
+	var opts ReparseOptions
+	from, ok := merchant.QueryDay(c, svc.db, merchantID, "from")
+	if !ok {
+		return opts, false
+	}
+	to, ok := merchant.QueryDay(c, svc.db, merchantID, "to")
+	if !ok {
+		return opts, false
+	}
+	if to.Before(from) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to must not be before from"})
+		return opts, false
+	}
+	opts.From, opts.To = from, to.AddDate(0, 0, 1)
+
+	if raw := c.Query("store_id"); raw != "" {
+		storeID, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid store_id"})
+			return opts, false
+		}
+		opts.StoreID = uint(storeID)
+	}
+	return opts, true
+}
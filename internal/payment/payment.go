@@ -1,6 +1,10 @@
 package payment
 
-import "time"
+import (
+	"time"
+
+	"upisettle/internal/order"
+)
 
 const (
 	ChannelUPI  = "UPI"
@@ -19,7 +23,15 @@ type Payment struct {
 	UPIRef       string    `gorm:"size:128;index"`
 	PayerVPA     string    `gorm:"size:255"`
 	PayerName    string    `gorm:"size:255"`
-	RawMessageID string    `gorm:"size:255"` // SMS/email source id if applicable
+	Note         string    `gorm:"size:255"` // remark the payer typed in their UPI app
+	RawMessageID *uint     `gorm:"index"`    // archived message the payment was parsed from
+	OrderID      *uint     `gorm:"index"`    // set when recorded directly against an order (cash)
+
+	// DuplicateOfID is set when the payment looks like a second copy of
+	// another one (same amount and payer VPA seconds apart, no UPI ref).
+	// Duplicates are never matched or counted in totals.
+	DuplicateOfID *uint `gorm:"index"`
+
 	CreatedAt    time.Time
 	UpdatedAt    time.Time
 }
@@ -28,3 +40,11 @@ func (Payment) TableName() string {
 	return "payments"
 }
 
+
+// PaidStatus returns the order status a payment on this channel settles to.
+func (p Payment) PaidStatus() string {
+	if p.Channel == ChannelCash {
+		return order.StatusPaidCash
+	}
+	return order.StatusPaidUPI
+}
@@ -0,0 +1,63 @@
+package payment
+
+import "time"
+
+// CashPayout is cash taken out of a store's drawer during the day (change
+// runs, supplier payments, petty expenses). Payouts lower the cash the
+// drawer is expected to hold at closing.
+type CashPayout struct {
+	ID         uint      `gorm:"primaryKey"`
+	MerchantID uint      `gorm:"not null;index"`
+	StoreID    uint      `gorm:"not null;index"`
+	Amount     int64     `gorm:"not null"` // paise
+	Reason     string    `gorm:"size:255"`
+	Time       time.Time `gorm:"not null;index"`
+	PaidBy     *uint     // user who took the cash out
+	CreatedAt  time.Time
+}
+
+func (CashPayout) TableName() string {
+	return "cash_payouts"
+}
+
+type CreateCashPayoutRequest struct {
+	Amount int64  `json:"amount" binding:"required,gt=0"`
+	Reason string `json:"reason" binding:"required"`
+	// Time defaults to now.
+	Time time.Time `json:"time"`
+}
+
+// CreateCashPayout records cash taken out of the drawer.
+func (s *Service) CreateCashPayout(merchantID, storeID, userID uint, req CreateCashPayoutRequest) (CashPayout, error) {
+	if req.Time.IsZero() {
+		req.Time = time.Now()
+	}
+	p := CashPayout{
+		MerchantID: merchantID,
+		StoreID:    storeID,
+		Amount:     req.Amount,
+		Reason:     req.Reason,
+		Time:       req.Time,
+	}
+	if userID != 0 {
+		p.PaidBy = &userID
+	}
+	if err := s.db.Create(&p).Error; err != nil {
+		return CashPayout{}, err
+	}
+	return p, nil
+}
+
+// ListCashPayouts returns a store's payouts for a day, oldest first.
+func (s *Service) ListCashPayouts(merchantID, storeID uint, day time.Time) ([]CashPayout, error) {
+	start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+	end := start.Add(24 * time.Hour)
+
+	var payouts []CashPayout
+	if err := s.db.Where("merchant_id = ? AND store_id = ? AND time >= ? AND time < ?", merchantID, storeID, start, end).
+		Order("time ASC").
+		Find(&payouts).Error; err != nil {
+		return nil, err
+	}
+	return payouts, nil
+}
@@ -0,0 +1,290 @@
+package payment
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+
+	"upisettle/internal/payment/sms"
+)
+
+// RawMessage is an inbound message exactly as it arrived. Every SMS is
+// archived before it is parsed, so payments read with an outdated template
+// can be parsed again and corrected.
+type RawMessage struct {
+	ID          uint      `gorm:"primaryKey"`
+	MerchantID  uint      `gorm:"not null;index"`
+	StoreID     uint      `gorm:"not null;index"`
+	Sender      string    `gorm:"size:64;not null"`
+	Body        string    `gorm:"type:text;not null"`
+	DeviceID    string    `gorm:"size:255"` // phone that forwarded the message
+	MessageID   string    `gorm:"size:255"` // device's id for the SMS
+	ReceivedAt  time.Time `gorm:"not null;index"`
+	ContentHash string    `gorm:"size:64;not null;index"` // sha256 of sender and body
+	// DuplicateOfID is the earlier copy of the same message, set when this
+	// one is a redelivery. Payments and reviews link to the earlier copy.
+	DuplicateOfID *uint `gorm:"index"`
+	CreatedAt     time.Time
+}
+
+func (RawMessage) TableName() string {
+	return "raw_messages"
+}
+
+// duplicateMessageWindow is how far apart the received times of two
+// messages without a device message id may be for them to count as one
+// message forwarded twice. Banks send identical texts for separate
+// payments (same amount, no ref), so content alone is not enough.
+const duplicateMessageWindow = 5 * time.Minute
+
+func contentHash(sender, body string) string {
+	sum := sha256.Sum256([]byte(sender + "\n" + body))
+	return hex.EncodeToString(sum[:])
+}
+
+// archiveMessage stores an inbound SMS. Every delivery is stored; one that
+// repeats an earlier message, by the device's message id when it sends one
+// or else by content received within duplicateMessageWindow, is linked to
+// it and returned with original set to the earlier copy.
+func (s *Service) archiveMessage(merchantID, storeID uint, req IngestSMSRequest) (msg RawMessage, original *RawMessage, err error) {
+	hash := contentHash(req.Sender, req.Body)
+	q := s.db.Where("merchant_id = ? AND store_id = ? AND content_hash = ? AND duplicate_of_id IS NULL", merchantID, storeID, hash)
+	if req.MessageID != "" {
+		q = q.Where("device_id = ? AND message_id = ?", req.DeviceID, req.MessageID)
+	} else {
+		q = q.Where("received_at BETWEEN ? AND ?", req.ReceivedAt.Add(-duplicateMessageWindow), req.ReceivedAt.Add(duplicateMessageWindow))
+	}
+	var earlier RawMessage
+	err = q.Order("id ASC").First(&earlier).Error
+	switch {
+	case err == nil:
+		original = &earlier
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return RawMessage{}, nil, err
+	}
+
+	msg = RawMessage{
+		MerchantID:  merchantID,
+		StoreID:     storeID,
+		Sender:      req.Sender,
+		Body:        req.Body,
+		DeviceID:    req.DeviceID,
+		MessageID:   req.MessageID,
+		ReceivedAt:  req.ReceivedAt,
+		ContentHash: hash,
+	}
+	if original != nil {
+		msg.DuplicateOfID = &original.ID
+	}
+	if err := s.db.Create(&msg).Error; err != nil {
+		return RawMessage{}, nil, err
+	}
+	return msg, original, nil
+}
+
+// Re-parse outcomes.
+const (
+	// ReparseChanged: the message has a payment and the current parser
+	// reads it differently. Applying it corrects the payment.
+	ReparseChanged = "CHANGED"
+	// ReparseUnreadable: the message has a payment but the current parser
+	// can no longer read it.
+	ReparseUnreadable = "UNREADABLE"
+	// ReparseNowReadable: the message has no payment but the current
+	// parser reads a credit in it; enter it from the review queue.
+	ReparseNowReadable = "NOW_READABLE"
+)
+
+type ReparseOptions struct {
+	// StoreID restricts the run to one store; zero means all stores.
+	StoreID  uint
+	From, To time.Time // received time range, To exclusive
+	// Apply lists the messages whose CHANGED diffs should be written to
+	// their payments. Without it nothing is written.
+	Apply []uint
+}
+
+type ApplyReparseRequest struct {
+	MessageIDs []uint `json:"message_ids" binding:"required,min=1"`
+}
+
+// FieldChange is one payment field the current parser reads differently.
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+type ReparseDiff struct {
+	MessageID  uint          `json:"message_id"`
+	StoreID    uint          `json:"store_id"`
+	Sender     string        `json:"sender"`
+	ReceivedAt time.Time     `json:"received_at"`
+	PaymentID  *uint         `json:"payment_id,omitempty"`
+	Outcome    string        `json:"outcome"`
+	Changes    []FieldChange `json:"changes,omitempty"`
+	Error      string        `json:"error,omitempty"` // parse error, or why applying was skipped
+	Applied    bool          `json:"applied"`
+}
+
+type ReparseReport struct {
+	Scanned   int           `json:"scanned"`
+	Unchanged int           `json:"unchanged"`
+	Applied   int           `json:"applied"`
+	Diffs     []ReparseDiff `json:"diffs"`
+}
+
+// Reparse runs the current parser over the archived messages received in
+// a range and reports where it disagrees with what was stored. CHANGED
+// diffs for the messages listed in opts.Apply are written to their
+// payments; an amount is only corrected on a payment that is not matched
+// yet, and a ref already taken by another payment is left alone.
+func (s *Service) Reparse(merchantID uint, opts ReparseOptions) (ReparseReport, error) {
+	var report ReparseReport
+
+	// Redeliveries have nothing of their own to correct.
+	q := s.db.Where("merchant_id = ? AND received_at >= ? AND received_at < ? AND duplicate_of_id IS NULL", merchantID, opts.From, opts.To)
+	if opts.StoreID != 0 {
+		q = q.Where("store_id = ?", opts.StoreID)
+	}
+	var msgs []RawMessage
+	if err := q.Order("received_at ASC").Find(&msgs).Error; err != nil {
+		return report, err
+	}
+	report.Scanned = len(msgs)
+	if len(msgs) == 0 {
+		return report, nil
+	}
+
+	ids := make([]uint, 0, len(msgs))
+	for _, m := range msgs {
+		ids = append(ids, m.ID)
+	}
+	var payments []Payment
+	if err := s.db.Where("raw_message_id IN ?", ids).Find(&payments).Error; err != nil {
+		return report, err
+	}
+	byMessage := make(map[uint]Payment, len(payments))
+	for _, p := range payments {
+		byMessage[*p.RawMessageID] = p
+	}
+	apply := make(map[uint]bool, len(opts.Apply))
+	for _, id := range opts.Apply {
+		apply[id] = true
+	}
+
+	for _, m := range msgs {
+		d := ReparseDiff{MessageID: m.ID, StoreID: m.StoreID, Sender: m.Sender, ReceivedAt: m.ReceivedAt}
+		p, hasPayment := byMessage[m.ID]
+		credit, err := sms.Parse(m.Sender, m.Body, m.ReceivedAt)
+		switch {
+		case !hasPayment && err != nil:
+			report.Unchanged++
+			continue
+		case !hasPayment:
+			// A copy of a payment that came in through another message.
+			if credit.UPIRef != "" {
+				if _, err := s.findByUPIRef(merchantID, credit.UPIRef); err == nil {
+					report.Unchanged++
+					continue
+				} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+					return report, err
+				}
+			}
+			d.Outcome = ReparseNowReadable
+			d.Changes = diffPayment(Payment{}, RequestFromCredit(credit))
+		case err != nil:
+			d.PaymentID = &p.ID
+			d.Outcome = ReparseUnreadable
+			d.Error = err.Error()
+		default:
+			d.PaymentID = &p.ID
+			d.Changes = diffPayment(p, RequestFromCredit(credit))
+			if len(d.Changes) == 0 {
+				report.Unchanged++
+				continue
+			}
+			d.Outcome = ReparseChanged
+			if apply[m.ID] {
+				if err := s.applyReparse(p, RequestFromCredit(credit)); err != nil {
+					var skip reparseSkip
+					if !errors.As(err, &skip) {
+						return report, err
+					}
+					d.Error = skip.reason
+				} else {
+					d.Applied = true
+					report.Applied++
+				}
+			}
+		}
+		report.Diffs = append(report.Diffs, d)
+	}
+	return report, nil
+}
+
+// reparseSkip is a correction that can't be applied to one payment; the
+// run carries on with the others.
+type reparseSkip struct {
+	reason string
+}
+
+func (e reparseSkip) Error() string {
+	return e.reason
+}
+
+func diffPayment(p Payment, req CreatePaymentRequest) []FieldChange {
+	var changes []FieldChange
+	add := func(field, was, now string) {
+		if was != now {
+			changes = append(changes, FieldChange{Field: field, Old: was, New: now})
+		}
+	}
+	add("channel", p.Channel, req.Channel)
+	add("amount", strconv.FormatInt(p.Amount, 10), strconv.FormatInt(req.Amount, 10))
+	add("upi_ref", p.UPIRef, req.UPIRef)
+	add("payer_vpa", p.PayerVPA, req.PayerVPA)
+	add("payer_name", p.PayerName, req.PayerName)
+	if p.Time.IsZero() || !p.Time.Truncate(time.Second).Equal(req.Time.Truncate(time.Second)) {
+		old := ""
+		if !p.Time.IsZero() {
+			old = p.Time.Format(time.RFC3339)
+		}
+		changes = append(changes, FieldChange{Field: "time", Old: old, New: req.Time.Format(time.RFC3339)})
+	}
+	return changes
+}
+
+// applyReparse writes a corrected reading to a payment.
+func (s *Service) applyReparse(p Payment, req CreatePaymentRequest) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if req.Amount != p.Amount {
+			// Matches belong to the matching package, which depends on this
+			// one; only whether any exist matters here.
+			var matched int64
+			if err := tx.Table("matches").Where("payment_id = ? AND removed_at IS NULL", p.ID).Count(&matched).Error; err != nil {
+				return err
+			}
+			if matched > 0 || p.OrderID != nil {
+				return reparseSkip{reason: "payment is matched; unmatch it before correcting the amount"}
+			}
+		}
+		err := tx.Model(&p).Updates(map[string]any{
+			"channel":    req.Channel,
+			"amount":     req.Amount,
+			"time":       req.Time,
+			"upi_ref":    req.UPIRef,
+			"payer_vpa":  req.PayerVPA,
+			"payer_name": req.PayerName,
+		}).Error
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return reparseSkip{reason: fmt.Sprintf("UPI ref %s already belongs to another payment", req.UPIRef)}
+		}
+		return err
+	})
+}
@@ -1,21 +1,75 @@
 package payment
 
 import (
+	"errors"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"upisettle/internal/order"
 )
 
+var (
+	ErrOrderAlreadyPaid = errors.New("order is already fully paid")
+	ErrCashOverpayment  = errors.New("cash payment is more than the order's outstanding amount")
+)
+
+// nearDuplicateWindow is how far apart two payments without a UPI ref, with
+// the same amount and payer VPA, may be and still count as one payment
+// reported twice (SMS retries, two staff phones).
+const nearDuplicateWindow = 30 * time.Second
+
 type Service struct {
-	db *gorm.DB
+	db      *gorm.DB
+	matcher Matcher
 }
 
 func NewService(db *gorm.DB) *Service {
 	return &Service{db: db}
 }
 
+// Matcher matches a newly ingested payment against open orders. The
+// matching package implements it; it is injected with SetMatcher because
+// matching depends on payment and not the other way round.
+type Matcher interface {
+	MatchPayment(p Payment) (MatchResult, error)
+}
+
+// MatchResult is what matching did with a payment right after ingestion.
+type MatchResult struct {
+	Matched bool           `json:"matched"`
+	Orders  []MatchedOrder `json:"orders,omitempty"`
+}
+
+// MatchedOrder is an order the payment was matched to.
+type MatchedOrder struct {
+	OrderID     uint    `json:"order_id"`
+	ExternalRef string  `json:"external_ref,omitempty"`
+	Amount      int64   `json:"amount"` // paise credited to the order
+	Status      string  `json:"status"` // order status after the match
+	Confidence  float64 `json:"confidence"`
+	Strategy    string  `json:"strategy"`
+}
+
+// SetMatcher enables matching of payments as they are ingested.
+func (s *Service) SetMatcher(m Matcher) {
+	s.matcher = m
+}
+
+// CreatedPayment is a stored payment together with the outcome of matching
+// it on ingestion. Match is nil when no matcher is configured; a matching
+// failure does not undo the payment and is reported in MatchError.
+// Duplicate is set when the UPI ref was already ingested; Payment is then
+// the existing row and nothing was stored.
+type CreatedPayment struct {
+	Payment
+	Duplicate  bool         `json:"duplicate,omitempty"`
+	Match      *MatchResult `json:"match,omitempty"`
+	MatchError string       `json:"match_error,omitempty"`
+}
+
 type CreatePaymentRequest struct {
 	Channel   string    `json:"channel" binding:"required"` // UPI, CASH, OTHER
 	Amount    int64     `json:"amount" binding:"required"`
@@ -23,6 +77,14 @@ type CreatePaymentRequest struct {
 	UPIRef    string    `json:"upi_ref"`
 	PayerVPA  string    `json:"payer_vpa"`
 	PayerName string    `json:"payer_name"`
+	Note      string    `json:"note"`
+	// RawMessageID links the payment to the archived message it was
+	// parsed from; only the server sets it.
+	RawMessageID *uint `json:"-"`
+	// NoMatch stores the payment without matching it on ingestion, for
+	// payments whose time is a guess; the matcher would otherwise pair
+	// them by closeness to a time they don't have. Only the server sets it.
+	NoMatch bool `json:"-"`
 }
 
 type CreateCashPaymentRequest struct {
@@ -30,44 +92,97 @@ type CreateCashPaymentRequest struct {
 	Amount  int64 `json:"amount" binding:"required"`
 }
 
-func (s *Service) CreatePayment(merchantID, storeID uint, req CreatePaymentRequest) (Payment, error) {
+// CreatePayment stores a payment and, once it is committed, tries to match
+// it against open orders. A UPI ref the merchant already has is merged into
+// the existing payment; a near-duplicate is stored but marked with
+// DuplicateOfID and flagged by the matcher or, failing that, by the day's
+// reconcile run.
+func (s *Service) CreatePayment(merchantID, storeID uint, req CreatePaymentRequest) (CreatedPayment, error) {
+	req.UPIRef = strings.TrimSpace(req.UPIRef)
+	if req.UPIRef != "" {
+		existing, err := s.findByUPIRef(merchantID, req.UPIRef)
+		if err == nil {
+			return CreatedPayment{Payment: existing, Duplicate: true}, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return CreatedPayment{}, err
+		}
+	}
+
 	p := Payment{
-		MerchantID: merchantID,
-		StoreID:    storeID,
-		Channel:    req.Channel,
-		Amount:     req.Amount,
-		Time:       req.Time,
-		UPIRef:     req.UPIRef,
-		PayerVPA:   req.PayerVPA,
-		PayerName:  req.PayerName,
+		MerchantID:   merchantID,
+		StoreID:      storeID,
+		Channel:      req.Channel,
+		Amount:       req.Amount,
+		Time:         req.Time,
+		UPIRef:       req.UPIRef,
+		PayerVPA:     req.PayerVPA,
+		PayerName:    req.PayerName,
+		Note:         req.Note,
+		RawMessageID: req.RawMessageID,
 	}
 	if p.Currency == "" {
 		p.Currency = "INR"
 	}
+	if p.UPIRef == "" && p.PayerVPA != "" {
+		var original Payment
+		err := s.db.Where("merchant_id = ? AND amount = ? AND payer_vpa = ? AND COALESCE(upi_ref, '') = '' AND duplicate_of_id IS NULL AND time BETWEEN ? AND ?",
+			merchantID, p.Amount, p.PayerVPA, p.Time.Add(-nearDuplicateWindow), p.Time.Add(nearDuplicateWindow)).
+			Order("id ASC").
+			First(&original).Error
+		if err == nil {
+			p.DuplicateOfID = &original.ID
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return CreatedPayment{}, err
+		}
+	}
 	if err := s.db.Create(&p).Error; err != nil {
-		return Payment{}, err
+		// Lost a race with another copy of the same UPI ref.
+		if errors.Is(err, gorm.ErrDuplicatedKey) && p.UPIRef != "" {
+			if existing, findErr := s.findByUPIRef(merchantID, p.UPIRef); findErr == nil {
+				return CreatedPayment{Payment: existing, Duplicate: true}, nil
+			}
+		}
+		return CreatedPayment{}, err
+	}
+
+	// A near-duplicate is never matched, only flagged, so it goes to the
+	// matcher even with NoMatch; without a matcher the next reconcile run
+	// flags it.
+	created := CreatedPayment{Payment: p}
+	if s.matcher != nil && (!req.NoMatch || p.DuplicateOfID != nil) {
+		res, err := s.matcher.MatchPayment(p)
+		if err != nil {
+			created.MatchError = err.Error()
+		} else {
+			created.Match = &res
+		}
 	}
-	return p, nil
+	return created, nil
 }
 
-// CreateCashPayment records a cash payment and marks the order as paid cash.
+// CreateCashPayment records a cash payment against an order. A payment that
+// covers the outstanding balance marks the order as paid cash; a smaller one
+// leaves it PARTIAL so the rest can be settled by UPI or further cash. A
+// payment of more than is outstanding is refused with ErrCashOverpayment.
 func (s *Service) CreateCashPayment(merchantID, storeID uint, req CreateCashPaymentRequest) (Payment, error) {
 	var payment Payment
 
 	err := s.db.Transaction(func(tx *gorm.DB) error {
 		var o order.Order
-		if err := tx.Where("id = ? AND merchant_id = ? AND store_id = ?", req.OrderID, merchantID, storeID).
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND merchant_id = ? AND store_id = ?", req.OrderID, merchantID, storeID).
 			First(&o).Error; err != nil {
 			return err
 		}
-
-		now := time.Now()
-		o.Status = order.StatusPaidCash
-		o.PaidAt = &now
-		if err := tx.Save(&o).Error; err != nil {
-			return err
+		if o.Outstanding() <= 0 {
+			return ErrOrderAlreadyPaid
+		}
+		if req.Amount > o.Outstanding() {
+			return ErrCashOverpayment
 		}
 
+		now := time.Now()
 		payment = Payment{
 			MerchantID: merchantID,
 			StoreID:    storeID,
@@ -75,11 +190,18 @@ func (s *Service) CreateCashPayment(merchantID, storeID uint, req CreateCashPaym
 			Amount:     req.Amount,
 			Currency:   "INR",
 			Time:       now,
+			OrderID:    &o.ID,
 		}
 		if err := tx.Create(&payment).Error; err != nil {
 			return err
 		}
-		return nil
+
+		o.ApplyPayment(req.Amount, order.StatusPaidCash, now)
+		return tx.Model(&o).Updates(map[string]any{
+			"paid_amount": o.PaidAmount,
+			"status":      o.Status,
+			"paid_at":     o.PaidAt,
+		}).Error
 	})
 
 	if err != nil {
@@ -88,3 +210,10 @@ func (s *Service) CreateCashPayment(merchantID, storeID uint, req CreateCashPaym
 	return payment, nil
 }
 
+// findByUPIRef returns the merchant's payment with the given UPI ref.
+func (s *Service) findByUPIRef(merchantID uint, upiRef string) (Payment, error) {
+	var p Payment
+	err := s.db.Where("merchant_id = ? AND upi_ref = ? AND duplicate_of_id IS NULL", merchantID, upiRef).
+		First(&p).Error
+	return p, err
+}
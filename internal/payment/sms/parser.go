@@ -0,0 +1,262 @@
+// Package sms turns credit-alert SMS from Indian banks and UPI apps into
+// payment fields. Each known sender has its own templates; messages from
+// other senders, or in a layout a bank has since changed, fall back to a
+// generic reading that still needs a credit keyword, an amount and a
+// reference.
+package sms
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotCredit means the message was understood but does not report
+	// money coming in: a debit alert, an OTP or a promotion.
+	ErrNotCredit = errors.New("message is not a credit alert")
+	// ErrUnrecognized means no template matched the message.
+	ErrUnrecognized = errors.New("message format not recognised")
+)
+
+// IST is the timezone bank SMS dates and times are written in.
+var IST = time.FixedZone("IST", 5*3600+30*60)
+
+// Credit is what a credit alert says about a payment.
+type Credit struct {
+	Source    string // bank or app that sent the alert, e.g. "HDFC"
+	Amount    int64  // paise
+	UPIRef    string // 12-digit UPI reference (RRN), if any
+	PayerVPA  string
+	PayerName string
+	Time      time.Time // when the money came in, per the message
+	UPI       bool      // the credit came through UPI
+}
+
+// Parse reads a credit alert. sender is the SMS sender ID as the phone
+// shows it ("VM-HDFCBK", "AD-SBIUPI-S"); received is when the phone got
+// the message and is used when the message carries no usable time.
+func Parse(sender, body string, received time.Time) (Credit, error) {
+	text := normalize(body)
+	// Debits are ruled out first: some of them also say "credited to" the
+	// payee, and a missed credit only goes to review while a debit read as
+	// a credit would become a payment.
+	if notCredit.MatchString(text) {
+		return Credit{}, ErrNotCredit
+	}
+
+	// A known sender is only read with its own templates, so one bank's
+	// layout can't be mistaken for another's.
+	src := sourceFor(sender)
+	for i := range sources {
+		s := &sources[i]
+		if src != nil && s != src {
+			continue
+		}
+		for _, re := range s.patterns {
+			if m := re.FindStringSubmatch(text); m != nil {
+				return build(s.name, re, m, text, received)
+			}
+		}
+	}
+	if m := genericCredit.FindStringSubmatch(text); m != nil {
+		name := senderHeader(sender)
+		if src != nil {
+			name = src.name
+		}
+		c, err := build(name, genericCredit, m, text, received)
+		if err == nil && c.UPIRef == "" && !c.UPI {
+			// Without a reference or a UPI mention too much of the
+			// message is a guess.
+			return Credit{}, ErrUnrecognized
+		}
+		return c, err
+	}
+	return Credit{}, ErrUnrecognized
+}
+
+// normalize folds whitespace so templates don't have to care about line
+// breaks, and spells out the rupee sign.
+func normalize(body string) string {
+	body = strings.ReplaceAll(body, "₹", "Rs ")
+	return strings.Join(strings.Fields(body), " ")
+}
+
+// senderHeader returns the DLT header of a sender ID, dropping the
+// operator prefix ("VM-") and the category suffix ("-S").
+func senderHeader(sender string) string {
+	parts := strings.Split(strings.ToUpper(strings.TrimSpace(sender)), "-")
+	if len(parts) >= 2 && len(parts[0]) == 2 {
+		return parts[1]
+	}
+	return parts[0]
+}
+
+// sourceFor finds the source whose header the sender ID carries.
+func sourceFor(sender string) *source {
+	header := senderHeader(sender)
+	for i := range sources {
+		for _, h := range sources[i].headers {
+			if header == h {
+				return &sources[i]
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	vpaRe   = regexp.MustCompile(`[A-Za-z0-9][A-Za-z0-9.\-_]{1,255}@[A-Za-z][A-Za-z0-9]{1,63}`)
+	refRe   = regexp.MustCompile(`(?i)(?:UPI[\s:/-]*(?:Ref(?:erence)?|txn|transaction)?(?:\s*(?:No|Number|ID|Id))?\.?|Ref\.?\s*(?:No|Number)?\.?|RRN|Refno)\s*[:.\-]?\s*(\d{12})\b`)
+	dateRe  = regexp.MustCompile(`(?i)\b(\d{1,2}[-/ ]?(?:\d{2}|[A-Za-z]{3})[-/ ]?\d{2,4})\b`)
+	clockRe = regexp.MustCompile(`\b(\d{1,2}:\d{2}(?::\d{2})?)\b`)
+	upiRe   = regexp.MustCompile(`(?i)\bUPI\b`)
+)
+
+// build turns a template match into a Credit, filling the fields the
+// template didn't capture from the rest of the message.
+func build(source string, re *regexp.Regexp, m []string, text string, received time.Time) (Credit, error) {
+	// A name can appear in several alternatives; take the one that matched.
+	group := func(name string) string {
+		for i, n := range re.SubexpNames() {
+			if n == name && i < len(m) && m[i] != "" {
+				return strings.TrimSpace(m[i])
+			}
+		}
+		return ""
+	}
+
+	amount, err := parseAmount(group("amount"))
+	if err != nil || amount <= 0 {
+		return Credit{}, ErrUnrecognized
+	}
+	c := Credit{
+		Source:    source,
+		Amount:    amount,
+		UPIRef:    group("ref"),
+		PayerVPA:  group("vpa"),
+		PayerName: cleanName(group("name")),
+	}
+	if c.UPIRef == "" {
+		if rm := refRe.FindStringSubmatch(text); rm != nil {
+			c.UPIRef = rm[1]
+		}
+	}
+	if c.PayerVPA == "" {
+		c.PayerVPA = vpaRe.FindString(text)
+	}
+	// A "name" that is really the VPA.
+	if strings.Contains(c.PayerName, "@") {
+		if c.PayerVPA == "" {
+			c.PayerVPA = c.PayerName
+		}
+		c.PayerName = ""
+	}
+	c.PayerVPA = strings.ToLower(c.PayerVPA)
+	c.UPI = c.PayerVPA != "" || upiRe.MatchString(text)
+
+	date, clock := group("date"), group("time")
+	if date == "" {
+		if dm := dateRe.FindStringSubmatch(text); dm != nil {
+			date = dm[1]
+		}
+	}
+	if clock == "" {
+		if cm := clockRe.FindStringSubmatch(text); cm != nil {
+			clock = cm[1]
+		}
+	}
+	c.Time = messageTime(date, clock, received)
+	return c, nil
+}
+
+// parseAmount reads "1,250.50" as 125050 paise without going through a
+// float.
+func parseAmount(s string) (int64, error) {
+	s = strings.ReplaceAll(s, ",", "")
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" {
+		whole = "0"
+	}
+	if len(frac) > 2 {
+		return 0, ErrUnrecognized
+	}
+	frac += strings.Repeat("0", 2-len(frac))
+	rupees, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	paise, err := strconv.ParseInt(frac, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return rupees*100 + paise, nil
+}
+
+func cleanName(s string) string {
+	s = strings.Trim(s, " .,:-/")
+	if s == "" || strings.EqualFold(s, "NA") {
+		return ""
+	}
+	return s
+}
+
+var dateLayouts = []string{
+	"02-01-06", "02-01-2006", "02/01/06", "02/01/2006",
+	"02Jan06", "02Jan2006", "02-Jan-06", "02-Jan-2006", "02 Jan 06", "02 Jan 2006",
+	"2Jan06", "2-Jan-06", "2 Jan 2006",
+}
+
+var clockLayouts = []string{"15:04:05", "15:04"}
+
+// maxClockSkew is how far ahead of the phone's clock a message time may be
+// before it is distrusted.
+const maxClockSkew = 5 * time.Minute
+
+// messageTime works out when the money came in. A message dated the day it
+// arrived without a time of day is taken to be as recent as its arrival;
+// one dated an earlier day gets the time it states, or the end of that day,
+// the closest it can be to the arrival.
+func messageTime(date, clock string, received time.Time) time.Time {
+	if received.IsZero() {
+		received = time.Now()
+	}
+	received = received.In(IST)
+
+	var day time.Time
+	for _, layout := range dateLayouts {
+		if t, err := time.ParseInLocation(layout, date, IST); err == nil {
+			day = t
+			break
+		}
+	}
+	if day.IsZero() {
+		return received
+	}
+
+	var tod time.Time
+	hasClock := false
+	for _, layout := range clockLayouts {
+		if t, err := time.Parse(layout, clock); err == nil {
+			tod, hasClock = t, true
+			break
+		}
+	}
+
+	sameDay := day.Year() == received.Year() && day.YearDay() == received.YearDay()
+	var t time.Time
+	switch {
+	case hasClock:
+		t = time.Date(day.Year(), day.Month(), day.Day(), tod.Hour(), tod.Minute(), tod.Second(), 0, IST)
+	case sameDay:
+		return received
+	default:
+		t = time.Date(day.Year(), day.Month(), day.Day(), 23, 59, 59, 0, IST)
+	}
+	if t.After(received.Add(maxClockSkew)) {
+		return received
+	}
+	return t
+}
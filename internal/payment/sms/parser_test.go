@@ -0,0 +1,170 @@
+package sms
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	received := time.Date(2024, 3, 12, 18, 0, 0, 0, IST)
+	tests := []struct {
+		name    string
+		sender  string
+		body    string
+		want    Credit
+		wantErr error
+	}{
+		{
+			name:   "HDFC money received",
+			sender: "VM-HDFCBK",
+			body:   "Money Received - INR 250.00 in your HDFC Bank A/c xx1234 on 12-03-24 from rahul@okaxis (UPI Ref No 407212345678)",
+			want:   Credit{Source: "HDFC", Amount: 25000, UPIRef: "407212345678", PayerVPA: "rahul@okaxis", Time: received, UPI: true},
+		},
+		{
+			name:   "HDFC credited by VPA",
+			sender: "VM-HDFCBK",
+			body:   "Rs. 500.00 credited to HDFC Bank A/c XX1234 on 12-03-24 by a/c linked to VPA rahul@okicici (UPI Ref No 407212345678).",
+			want:   Credit{Source: "HDFC", Amount: 50000, UPIRef: "407212345678", PayerVPA: "rahul@okicici", Time: received, UPI: true},
+		},
+		{
+			name:   "HDFC deposited, month name date",
+			sender: "VM-HDFCBK",
+			body:   "Update! INR 1,200.00 deposited in HDFC Bank A/c XX1234 on 12-MAR-24 for UPI-407212345678-RAHUL KUMAR-rahul@okaxis.",
+			want:   Credit{Source: "HDFC", Amount: 120000, UPIRef: "407212345678", PayerVPA: "rahul@okaxis", PayerName: "RAHUL KUMAR", Time: received, UPI: true},
+		},
+		{
+			name:   "SBI trf from",
+			sender: "AD-SBIUPI-S",
+			body:   "Dear UPI user A/C X1234 credited by 250.00 on date 12Mar24 trf from RAHUL KUMAR Refno 407212345678. If not u? call 1800111109. -SBI",
+			want:   Credit{Source: "SBI", Amount: 25000, UPIRef: "407212345678", PayerName: "RAHUL KUMAR", Time: received, UPI: true},
+		},
+		{
+			name:   "SBI short form",
+			sender: "AD-SBIUPI-S",
+			body:   "Dear SBI UPI User, ur A/cX1234 credited by Rs500 on 12Mar24 by (Ref no 407212345678)",
+			want:   Credit{Source: "SBI", Amount: 50000, UPIRef: "407212345678", Time: received, UPI: true},
+		},
+		{
+			name:   "ICICI credited with",
+			sender: "JD-ICICIB",
+			body:   "Dear Customer, Acct XX123 is credited with Rs 250.00 on 12-Mar-24 from RAHUL KUMAR. UPI:407212345678-ICICI Bank.",
+			want:   Credit{Source: "ICICI", Amount: 25000, UPIRef: "407212345678", PayerName: "RAHUL KUMAR", Time: received, UPI: true},
+		},
+		{
+			name:   "ICICI info line",
+			sender: "JD-ICICIB",
+			body:   "ICICI Bank Account XX123 credited:Rs. 1,250.00 on 12-Mar-24. Info:UPI-407212345678-RAHUL KUMAR. Available Balance is Rs. 5,000.00.",
+			want:   Credit{Source: "ICICI", Amount: 125000, UPIRef: "407212345678", PayerName: "RAHUL KUMAR", Time: received, UPI: true},
+		},
+		{
+			name:   "Axis with time of day",
+			sender: "AX-AXISBK",
+			body:   "INR 250.00 credited to A/c no. XX1234 on 12-03-24 at 14:22:05 IST. Info- UPI/P2M/407212345678/RAHUL KUMAR/Payment fr/AXIS BANK - Axis Bank",
+			want:   Credit{Source: "AXIS", Amount: 25000, UPIRef: "407212345678", PayerName: "RAHUL KUMAR", Time: time.Date(2024, 3, 12, 14, 22, 5, 0, IST), UPI: true},
+		},
+		{
+			name:   "Kotak",
+			sender: "VK-KOTAKB",
+			body:   "Received Rs.250.00 in your Kotak Bank A/c X1234 from rahul@ybl on 12-03-24.UPI Ref:407212345678.",
+			want:   Credit{Source: "KOTAK", Amount: 25000, UPIRef: "407212345678", PayerVPA: "rahul@ybl", Time: received, UPI: true},
+		},
+		{
+			name:   "Paytm bank",
+			sender: "VM-PAYTMB",
+			body:   "Received Rs.250 from RAHUL KUMAR in your Paytm Payments Bank a/c. UPI Ref No: 407212345678",
+			want:   Credit{Source: "PAYTM", Amount: 25000, UPIRef: "407212345678", PayerName: "RAHUL KUMAR", Time: received, UPI: true},
+		},
+		{
+			name:   "Paytm for Business with rupee sign",
+			sender: "VM-PAYTMB",
+			body:   "₹250 received from rahul@ybl on 12-03-24 14:22. UPI Ref No: 407212345678 - Paytm for Business",
+			want:   Credit{Source: "PAYTM", Amount: 25000, UPIRef: "407212345678", PayerVPA: "rahul@ybl", Time: time.Date(2024, 3, 12, 14, 22, 0, 0, IST), UPI: true},
+		},
+		{
+			name:   "PhonePe",
+			sender: "VM-PHONPE",
+			body:   "Received Rs 250 from Rahul Kumar on PhonePe. UPI Ref 407212345678",
+			want:   Credit{Source: "PHONEPE", Amount: 25000, UPIRef: "407212345678", PayerName: "Rahul Kumar", Time: received, UPI: true},
+		},
+		{
+			name:   "Google Pay",
+			sender: "VM-GPAYBZ",
+			body:   "You received Rs.250.00 from Rahul Kumar (rahul@okhdfcbank) on Google Pay. UPI transaction ID: 407212345678",
+			want:   Credit{Source: "GPAY", Amount: 25000, UPIRef: "407212345678", PayerVPA: "rahul@okhdfcbank", PayerName: "Rahul Kumar", Time: received, UPI: true},
+		},
+		{
+			name:   "unknown sender falls back to generic reading",
+			sender: "VM-FOOBNK",
+			body:   "Rs 300 credited to your a/c via UPI Ref No 407212345678",
+			want:   Credit{Source: "FOOBNK", Amount: 30000, UPIRef: "407212345678", Time: received, UPI: true},
+		},
+		{
+			name:    "generic credit without ref or UPI",
+			sender:  "VM-FOOBNK",
+			body:    "Rs 300 credited to your account",
+			wantErr: ErrUnrecognized,
+		},
+		{
+			name:    "debit",
+			sender:  "VM-HDFCBK",
+			body:    "Rs 250.00 debited from A/c XX1234 on 12-03-24 to VPA shop@okaxis (UPI Ref No 407212345678)",
+			wantErr: ErrNotCredit,
+		},
+		{
+			name:    "OTP",
+			sender:  "VM-HDFCBK",
+			body:    "123456 is your OTP for the transaction of Rs 250.00. Do not share it.",
+			wantErr: ErrNotCredit,
+		},
+		{
+			name:    "not a bank message",
+			sender:  "VM-HDFCBK",
+			body:    "Your HDFC Bank credit card statement is ready.",
+			wantErr: ErrUnrecognized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.sender, tt.body, received)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Parse() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if !got.Time.Equal(tt.want.Time) {
+				t.Errorf("Time = %v, want %v", got.Time, tt.want.Time)
+			}
+			got.Time, tt.want.Time = time.Time{}, time.Time{}
+			if got != tt.want {
+				t.Errorf("Parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessageTime(t *testing.T) {
+	received := time.Date(2024, 3, 12, 18, 0, 0, 0, IST)
+	tests := []struct {
+		name  string
+		date  string
+		clock string
+		want  time.Time
+	}{
+		{"no date", "", "", received},
+		{"today without time", "12-03-24", "", received},
+		{"today with time", "12-03-24", "14:22", time.Date(2024, 3, 12, 14, 22, 0, 0, IST)},
+		{"earlier day without time", "11Mar24", "", time.Date(2024, 3, 11, 23, 59, 59, 0, IST)},
+		{"earlier day with time", "11-03-2024", "09:15:30", time.Date(2024, 3, 11, 9, 15, 30, 0, IST)},
+		{"time ahead of arrival", "12-03-24", "19:30", received},
+		{"unreadable date", "31-02-24", "", received},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := messageTime(tt.date, tt.clock, received); !got.Equal(tt.want) {
+				t.Errorf("messageTime(%q, %q) = %v, want %v", tt.date, tt.clock, got, tt.want)
+			}
+		})
+	}
+}
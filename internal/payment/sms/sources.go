@@ -0,0 +1,119 @@
+package sms
+
+import "regexp"
+
+// source is a bank or UPI app whose credit alerts Parse knows. Its
+// templates capture some of the named groups amount, ref, vpa, name, date
+// and time; amount is required and the rest is looked for in the whole
+// message when a template doesn't capture it.
+type source struct {
+	name     string
+	headers  []string // DLT sender headers, without operator prefix or suffix
+	patterns []*regexp.Regexp
+}
+
+// Template building blocks.
+const (
+	amt     = `(?:Rs\.?|INR)\s?(?P<amount>\d[\d,]*(?:\.\d{1,2})?)`
+	bareAmt = `(?:(?:Rs\.?|INR)\s?)?(?P<amount>\d[\d,]*(?:\.\d{1,2})?)`
+	ref     = `(?P<ref>\d{12})`
+	vpa     = `(?P<vpa>[A-Za-z0-9][A-Za-z0-9.\-_]+@[A-Za-z][A-Za-z0-9]+)`
+	numDate = `(?P<date>\d{2}[-/]\d{2}[-/]\d{2,4})`
+	monDate = `(?P<date>\d{1,2}[- ]?[A-Za-z]{3}[- ]?\d{2,4})`
+	clock   = `(?P<time>\d{1,2}:\d{2}(?::\d{2})?)`
+	acct    = `A/?[Cc](?:count|ct)?\.?\s?(?:no\.?\s?)?[Xx*]*\d+`
+)
+
+func templates(patterns ...string) []*regexp.Regexp {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		res = append(res, regexp.MustCompile(`(?i)`+p))
+	}
+	return res
+}
+
+var sources = []source{
+	{
+		name:    "HDFC",
+		headers: []string{"HDFCBK", "HDFCBN"},
+		patterns: templates(
+			// Money Received - INR 250.00 in your HDFC Bank A/c xx1234 on 12-03-24 from rahul@okaxis (UPI Ref No 407212345678)
+			`Money Received - `+amt+` in your HDFC Bank `+acct+` on `+numDate+` from `+vpa+`.*?UPI Ref No\.? `+ref,
+			// Rs. 500.00 credited to HDFC Bank A/c XX1234 on 12-03-24 by a/c linked to VPA rahul@okicici (UPI Ref No 407212345678).
+			amt+` credited to (?:your )?HDFC Bank `+acct+` on `+numDate+` by .*?VPA `+vpa+`.*?UPI Ref No\.? `+ref,
+			// Update! INR 1,200.00 deposited in HDFC Bank A/c XX1234 on 12-MAR-24 for UPI-407212345678-RAHUL KUMAR-rahul@okaxis.
+			amt+` deposited in (?:your )?HDFC Bank `+acct+` on `+monDate+` for UPI-`+ref+`-(?P<name>[^-]+)-`+vpa,
+		),
+	},
+	{
+		name:    "SBI",
+		headers: []string{"SBIUPI", "SBIINB", "SBIPSG", "CBSSBI", "SBMSMS"},
+		patterns: templates(
+			// Dear UPI user A/C X1234 credited by 250.00 on date 12Mar24 trf from RAHUL KUMAR Refno 407212345678. If not u? call 1800111109. -SBI
+			acct+` (?:has been )?credited by `+bareAmt+` on date `+monDate+` trf from (?P<name>.+?) Ref ?no `+ref,
+			// Dear SBI UPI User, ur A/cX1234 credited by Rs500 on 12Mar24 by (Ref no 407212345678)
+			`ur `+acct+` credited by `+amt+` on `+monDate+` by .*?Ref ?no `+ref,
+		),
+	},
+	{
+		name:    "ICICI",
+		headers: []string{"ICICIB", "ICICIT", "ICICIO"},
+		patterns: templates(
+			// Dear Customer, Acct XX123 is credited with Rs 250.00 on 12-Mar-24 from RAHUL KUMAR. UPI:407212345678-ICICI Bank.
+			acct+` is credited with `+amt+` on `+monDate+` from (?P<name>.+?)\. UPI:\s?`+ref,
+			// ICICI Bank Account XX123 credited:Rs. 1,250.00 on 12-Mar-24. Info:UPI-407212345678-RAHUL KUMAR. Available Balance is Rs. 5,000.00.
+			`ICICI Bank Account \S+ credited:\s?`+amt+` on `+monDate+`\. Info:\s?UPI-`+ref+`-(?P<name>[^.]+)`,
+		),
+	},
+	{
+		name:    "AXIS",
+		headers: []string{"AXISBK", "AXISBN", "AXISMR"},
+		patterns: templates(
+			// INR 250.00 credited to A/c no. XX1234 on 12-03-24 at 14:22:05 IST. Info- UPI/P2M/407212345678/RAHUL KUMAR/Payment fr/AXIS BANK - Axis Bank
+			amt + ` credited to ` + acct + ` on ` + numDate + `,? (?:at )?` + clock + `(?: IST)?\.? Info-?\s?UPI/P2[AM]/` + ref + `/(?P<name>[^/]+)`,
+		),
+	},
+	{
+		name:    "KOTAK",
+		headers: []string{"KOTAKB", "KMBLUP"},
+		patterns: templates(
+			// Received Rs.250.00 in your Kotak Bank A/c X1234 from rahul@ybl on 12-03-24.UPI Ref:407212345678.
+			`Received ` + amt + ` in your Kotak Bank ` + acct + ` from ` + vpa + ` on ` + numDate + `\.?\s?UPI Ref:?\s?` + ref,
+		),
+	},
+	{
+		name:    "PAYTM",
+		headers: []string{"PAYTMB", "IPAYTM", "PYTMBZ"},
+		patterns: templates(
+			// Received Rs.250 from RAHUL KUMAR in your Paytm Payments Bank a/c. UPI Ref No: 407212345678
+			`Received `+amt+` from (?P<name>.+?) (?:in|to) your Paytm.*?UPI Ref(?: No)?:?\s?`+ref,
+			// Rs.250 received from rahul@ybl on 12-03-24 14:22. UPI Ref No: 407212345678 - Paytm for Business
+			amt+` received from `+vpa+`.*?UPI Ref(?: No)?:?\s?`+ref,
+		),
+	},
+	{
+		name:    "PHONEPE",
+		headers: []string{"PHONPE", "PHNPEB"},
+		patterns: templates(
+			// Received Rs 250 from Rahul Kumar on PhonePe. UPI Ref 407212345678
+			`Received ` + amt + ` from (?P<name>.+?) (?:on|via) PhonePe.*?Ref(?: No)?:?\s?` + ref,
+		),
+	},
+	{
+		name:    "GPAY",
+		headers: []string{"GPAYBZ", "GOOGPY"},
+		patterns: templates(
+			// You received Rs.250.00 from Rahul Kumar (rahul@okhdfcbank) on Google Pay. UPI transaction ID: 407212345678
+			`received ` + amt + ` from (?P<name>.+?) \(` + vpa + `\).*?UPI transaction ID:?\s?` + ref,
+		),
+	},
+}
+
+var (
+	// notCredit spots debit alerts, OTPs and mandates.
+	notCredit = regexp.MustCompile(`(?i)\b(?:debited|withdrawn|spent|sent\s+(?:Rs|INR)|paid\s+(?:Rs|INR)|OTP|one time password|mandate|collect request|requested money)\b`)
+
+	// genericCredit is the fallback for senders and layouts without a
+	// template: a credit keyword near an amount.
+	genericCredit = regexp.MustCompile(`(?i)(?:` + amt + `.{0,60}?\b(?:credited|received|deposited)\b|\b(?:credited|received|deposited)\b.{0,60}?` + amt + `)`)
+)
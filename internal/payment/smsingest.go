@@ -0,0 +1,241 @@
+package payment
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+
+	"upisettle/internal/payment/sms"
+)
+
+var ErrReviewClosed = errors.New("message has already been reviewed")
+
+// SMS ingestion outcomes.
+const (
+	SMSStatusCreated   = "CREATED"   // a new payment was stored
+	SMSStatusDuplicate = "DUPLICATE" // the UPI ref was already ingested
+	SMSStatusIgnored   = "IGNORED"   // not a credit alert (debit, OTP, ...)
+	SMSStatusReview    = "REVIEW"    // unparseable, queued for review
+)
+
+// SMS review statuses.
+const (
+	ReviewStatusPending   = "PENDING"
+	ReviewStatusResolved  = "RESOLVED"  // a user entered the payment by hand
+	ReviewStatusDismissed = "DISMISSED" // a user decided it is not a payment
+)
+
+// SMSReview is an inbound SMS the parser could not read. It waits for a
+// user to enter the payment it describes, or dismiss it.
+type SMSReview struct {
+	ID         uint      `gorm:"primaryKey"`
+	MerchantID uint      `gorm:"not null;index"`
+	StoreID    uint      `gorm:"not null;index"`
+	Sender     string    `gorm:"size:64;not null"`
+	Body       string    `gorm:"type:text;not null"`
+	MessageID  string    `gorm:"size:255"` // device's id for the SMS
+	ReceivedAt time.Time `gorm:"not null"`
+	// RawMessageID is the archived copy of the message.
+	RawMessageID *uint
+	Error        string `gorm:"size:255"`
+	Status       string `gorm:"size:16;not null;default:'PENDING'"`
+	PaymentID    *uint  // payment entered for the message when resolved
+	ReviewedBy   *uint
+	ReviewedAt   *time.Time
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+func (SMSReview) TableName() string {
+	return "sms_reviews"
+}
+
+type IngestSMSRequest struct {
+	Sender string `json:"sender" binding:"required"` // e.g. "VM-HDFCBK"
+	Body   string `json:"body" binding:"required"`
+	// ReceivedAt is when the phone got the message; defaults to now.
+	ReceivedAt time.Time `json:"received_at"`
+	MessageID  string    `json:"message_id"`
+	DeviceID   string    `json:"device_id"`
+}
+
+// SMSResult is what happened to an inbound SMS. Payment is set for CREATED
+// and DUPLICATE, ReviewID for REVIEW.
+type SMSResult struct {
+	Status   string          `json:"status"`
+	Payment  *CreatedPayment `json:"payment,omitempty"`
+	ReviewID uint            `json:"review_id,omitempty"`
+	Reason   string          `json:"reason,omitempty"`
+}
+
+// RequestFromCredit turns a parsed credit alert into a payment request.
+func RequestFromCredit(c sms.Credit) CreatePaymentRequest {
+	channel := ChannelOther
+	if c.UPI {
+		channel = ChannelUPI
+	}
+	return CreatePaymentRequest{
+		Channel:   channel,
+		Amount:    c.Amount,
+		Time:      c.Time,
+		UPIRef:    c.UPIRef,
+		PayerVPA:  c.PayerVPA,
+		PayerName: c.PayerName,
+	}
+}
+
+// IngestSMS archives a raw credit-alert SMS, parses it and stores the
+// payment it reports, exactly as CreatePayment would. Messages that are not
+// credits are ignored; messages the parser can't read are queued for
+// review. A message sent again gets the outcome of its first copy.
+func (s *Service) IngestSMS(merchantID, storeID uint, req IngestSMSRequest) (SMSResult, error) {
+	if req.ReceivedAt.IsZero() {
+		req.ReceivedAt = time.Now()
+	}
+
+	msg, original, err := s.archiveMessage(merchantID, storeID, req)
+	if err != nil {
+		return SMSResult{}, err
+	}
+	if original != nil {
+		msg = *original
+		var p Payment
+		err := s.db.Where("raw_message_id = ?", msg.ID).Order("id ASC").First(&p).Error
+		if err == nil {
+			return SMSResult{Status: SMSStatusDuplicate, Payment: &CreatedPayment{Payment: p, Duplicate: true}}, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return SMSResult{}, err
+		}
+		var review SMSReview
+		err = s.db.Where("raw_message_id = ?", msg.ID).Order("id ASC").First(&review).Error
+		if err == nil {
+			return SMSResult{Status: SMSStatusReview, ReviewID: review.ID, Reason: review.Error}, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return SMSResult{}, err
+		}
+	}
+
+	credit, err := sms.Parse(req.Sender, req.Body, req.ReceivedAt)
+	switch {
+	case errors.Is(err, sms.ErrNotCredit):
+		return SMSResult{Status: SMSStatusIgnored, Reason: err.Error()}, nil
+	case err != nil:
+		review := SMSReview{
+			MerchantID:   merchantID,
+			StoreID:      storeID,
+			Sender:       req.Sender,
+			Body:         req.Body,
+			MessageID:    req.MessageID,
+			ReceivedAt:   req.ReceivedAt,
+			RawMessageID: &msg.ID,
+			Error:        err.Error(),
+			Status:       ReviewStatusPending,
+		}
+		if err := s.db.Create(&review).Error; err != nil {
+			return SMSResult{}, err
+		}
+		return SMSResult{Status: SMSStatusReview, ReviewID: review.ID, Reason: review.Error}, nil
+	}
+
+	preq := RequestFromCredit(credit)
+	preq.RawMessageID = &msg.ID
+	created, err := s.CreatePayment(merchantID, storeID, preq)
+	if err != nil {
+		return SMSResult{}, err
+	}
+	res := SMSResult{Status: SMSStatusCreated, Payment: &created}
+	if created.Duplicate {
+		res.Status = SMSStatusDuplicate
+	}
+	return res, nil
+}
+
+// ListSMSReviews returns a store's queued messages, oldest first,
+// optionally filtered by status.
+func (s *Service) ListSMSReviews(merchantID, storeID uint, status string) ([]SMSReview, error) {
+	q := s.db.Where("merchant_id = ? AND store_id = ?", merchantID, storeID)
+	if status != "" {
+		q = q.Where("status = ?", status)
+	}
+	var reviews []SMSReview
+	if err := q.Order("received_at ASC").Limit(500).Find(&reviews).Error; err != nil {
+		return nil, err
+	}
+	return reviews, nil
+}
+
+// ResolveSMSReview stores the payment a user read from a queued message
+// and closes the review. The review is claimed first so that two users
+// working the queue can't both enter the payment.
+func (s *Service) ResolveSMSReview(merchantID, storeID, userID, reviewID uint, req CreatePaymentRequest) (CreatedPayment, error) {
+	review, err := s.pendingReview(merchantID, storeID, reviewID)
+	if err != nil {
+		return CreatedPayment{}, err
+	}
+	if err := s.closeReview(&review, ReviewStatusResolved, userID); err != nil {
+		return CreatedPayment{}, err
+	}
+
+	req.RawMessageID = review.RawMessageID
+	created, err := s.CreatePayment(merchantID, storeID, req)
+	if err != nil {
+		s.db.Model(&review).Updates(map[string]any{"status": ReviewStatusPending, "reviewed_by": nil, "reviewed_at": nil})
+		return CreatedPayment{}, err
+	}
+	if err := s.db.Model(&review).Update("payment_id", created.ID).Error; err != nil {
+		return CreatedPayment{}, err
+	}
+	return created, nil
+}
+
+// DismissSMSReview closes a queued message that reports no payment.
+func (s *Service) DismissSMSReview(merchantID, storeID, userID, reviewID uint) (SMSReview, error) {
+	review, err := s.pendingReview(merchantID, storeID, reviewID)
+	if err != nil {
+		return SMSReview{}, err
+	}
+	if err := s.closeReview(&review, ReviewStatusDismissed, userID); err != nil {
+		return SMSReview{}, err
+	}
+	return review, nil
+}
+
+func (s *Service) pendingReview(merchantID, storeID, reviewID uint) (SMSReview, error) {
+	var review SMSReview
+	if err := s.db.Where("id = ? AND merchant_id = ? AND store_id = ?", reviewID, merchantID, storeID).
+		First(&review).Error; err != nil {
+		return SMSReview{}, err
+	}
+	if review.Status != ReviewStatusPending {
+		return SMSReview{}, ErrReviewClosed
+	}
+	return review, nil
+}
+
+// closeReview moves a pending review to status. The update is conditional
+// so that two users reviewing the same message can't both close it.
+func (s *Service) closeReview(review *SMSReview, status string, userID uint) error {
+	now := time.Now()
+	review.Status = status
+	review.ReviewedAt = &now
+	if userID != 0 {
+		review.ReviewedBy = &userID
+	}
+	res := s.db.Model(&SMSReview{}).
+		Where("id = ? AND status = ?", review.ID, ReviewStatusPending).
+		Updates(map[string]any{
+			"status":      review.Status,
+			"reviewed_by": review.ReviewedBy,
+			"reviewed_at": review.ReviewedAt,
+		})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrReviewClosed
+	}
+	return nil
+}
@@ -0,0 +1,404 @@
+// Package statement reads bank account statements downloaded from Indian
+// net banking as CSV or XLSX. A Layout says which columns of the
+// transaction table hold the date, narration and amounts; the table is
+// found under whatever account details the bank prints above it, and the
+// UPI reference, payer VPA and name are taken from the narration.
+package statement
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrUnknownLayout means no layout's headers were found in the file.
+	ErrUnknownLayout = errors.New("statement layout not recognised")
+	ErrInvalidLayout = errors.New("layout needs date and narration columns, and credit or amount and dr/cr columns")
+)
+
+// IST is the timezone statement dates are written in.
+var IST = time.FixedZone("IST", 5*3600+30*60)
+
+// Layout maps the header of a bank's transaction table to transaction
+// fields. Headers are compared ignoring case, spaces and punctuation; a
+// table must have the date, narration and credit columns, the others are
+// read when present.
+// Credits come from either a Credit column (with an optional Debit column)
+// or an Amount column whose DrCr column says "CR" or "DR".
+type Layout struct {
+	Name      string
+	Date      string
+	Time      string // optional; most statements only carry the date
+	Narration string
+	Ref       string // optional cheque/reference column
+	Credit    string
+	Debit     string
+	Amount    string
+	DrCr      string
+	// DateFormat is the Go layout of the date column; common formats are
+	// tried when it is empty or doesn't fit.
+	DateFormat string
+}
+
+// Validate reports whether the layout names enough columns to read
+// credits.
+func (l Layout) Validate() error {
+	if l.Date == "" || l.Narration == "" {
+		return ErrInvalidLayout
+	}
+	if l.Credit == "" && (l.Amount == "" || l.DrCr == "") {
+		return ErrInvalidLayout
+	}
+	return nil
+}
+
+// Layouts are the statement downloads of the common banks. A bank can
+// have one per download format.
+var Layouts = []Layout{
+	{
+		Name:       "HDFC",
+		Date:       "Date",
+		Narration:  "Narration",
+		Ref:        "Chq./Ref.No.",
+		Debit:      "Withdrawal Amt.",
+		Credit:     "Deposit Amt.",
+		DateFormat: "02/01/06",
+	},
+	{
+		Name:       "HDFC",
+		Date:       "Date",
+		Narration:  "Narration",
+		Ref:        "Chq/Ref Number",
+		Debit:      "Debit Amount",
+		Credit:     "Credit Amount",
+		DateFormat: "02/01/06",
+	},
+	{
+		Name:       "SBI",
+		Date:       "Txn Date",
+		Narration:  "Description",
+		Ref:        "Ref No./Cheque No.",
+		Debit:      "Debit",
+		Credit:     "Credit",
+		DateFormat: "2 Jan 2006",
+	},
+	{
+		Name:       "ICICI",
+		Date:       "Transaction Date",
+		Narration:  "Transaction Remarks",
+		Ref:        "Cheque Number",
+		Debit:      "Withdrawal Amount (INR )",
+		Credit:     "Deposit Amount (INR )",
+		DateFormat: "02/01/2006",
+	},
+	{
+		Name:       "AXIS",
+		Date:       "Tran Date",
+		Narration:  "PARTICULARS",
+		Ref:        "CHQNO",
+		Debit:      "DR",
+		Credit:     "CR",
+		DateFormat: "02-01-2006",
+	},
+	{
+		Name:       "KOTAK",
+		Date:       "Transaction Date",
+		Narration:  "Description",
+		Ref:        "Chq / Ref No.",
+		Amount:     "Amount",
+		DrCr:       "Dr / Cr",
+		DateFormat: "02-01-2006",
+	},
+}
+
+// Line is one transaction row of a statement. Err is set when the row
+// couldn't be read; the other fields are then whatever was readable.
+type Line struct {
+	Row  int // 1-based row number in the file
+	Date time.Time
+	// Timed is false when the statement gives no time of day and Date is
+	// put at noon.
+	Timed     bool
+	Narration string
+	Ref       string
+	Credit    int64 // paise
+	Debit     int64 // paise
+	UPI       bool
+	UPIRef    string
+	PayerVPA  string
+	PayerName string
+	Err       error
+}
+
+// Statement is a parsed file.
+type Statement struct {
+	Layout string
+	Lines  []Line
+}
+
+// headerScanRows is how far down a file the transaction table's header is
+// looked for.
+const headerScanRows = 40
+
+// Parse finds the first of layouts whose header row appears in rows and
+// reads the transaction lines under it. Blank rows and the rows of
+// asterisks some banks draw around the table end it, unless they come
+// before the first line.
+func Parse(rows [][]string, layouts []Layout) (Statement, error) {
+	for i := 0; i < len(rows) && i < headerScanRows; i++ {
+		for _, l := range layouts {
+			cols, ok := l.columns(rows[i])
+			if !ok {
+				continue
+			}
+			st := Statement{Layout: l.Name}
+			for j := i + 1; j < len(rows); j++ {
+				if endOfTable(rows[j]) {
+					if len(st.Lines) == 0 {
+						continue
+					}
+					break
+				}
+				st.Lines = append(st.Lines, l.line(cols, rows[j], j+1))
+			}
+			return st, nil
+		}
+	}
+	return Statement{}, ErrUnknownLayout
+}
+
+// columnSet holds the index of each layout column in a header row, -1 for
+// the ones the layout doesn't use.
+type columnSet struct {
+	date, time, narration, ref, credit, debit, amount, drcr int
+}
+
+func (l Layout) columns(header []string) (columnSet, bool) {
+	find := func(name string) int {
+		if name == "" {
+			return -1
+		}
+		key := headerKey(name)
+		for i, h := range header {
+			if headerKey(h) == key {
+				return i
+			}
+		}
+		return -1
+	}
+	cs := columnSet{
+		date:      find(l.Date),
+		time:      find(l.Time),
+		narration: find(l.Narration),
+		ref:       find(l.Ref),
+		credit:    find(l.Credit),
+		debit:     find(l.Debit),
+		amount:    find(l.Amount),
+		drcr:      find(l.DrCr),
+	}
+	return cs, cs.date >= 0 && cs.narration >= 0 && (cs.credit >= 0 || cs.amount >= 0 && cs.drcr >= 0)
+}
+
+func headerKey(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func endOfTable(row []string) bool {
+	for _, c := range row {
+		c = strings.TrimSpace(c)
+		if c != "" && strings.Trim(c, "*-") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func (l Layout) line(cs columnSet, row []string, n int) Line {
+	cell := func(i int) string {
+		if i < 0 || i >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
+	ln := Line{Row: n, Narration: strings.Join(strings.Fields(cell(cs.narration)), " "), Ref: cell(cs.ref)}
+
+	var err error
+	if cs.credit >= 0 {
+		if ln.Credit, err = parseAmount(cell(cs.credit)); err != nil {
+			ln.Err = errors.New("unreadable credit amount")
+			return ln
+		}
+		if ln.Debit, err = parseAmount(cell(cs.debit)); err != nil {
+			ln.Err = errors.New("unreadable debit amount")
+			return ln
+		}
+	} else {
+		amount, err := parseAmount(cell(cs.amount))
+		if err != nil {
+			ln.Err = errors.New("unreadable amount")
+			return ln
+		}
+		switch strings.ToUpper(strings.Trim(cell(cs.drcr), ". ")) {
+		case "CR", "C", "CREDIT":
+			ln.Credit = amount
+		case "DR", "D", "DEBIT":
+			ln.Debit = amount
+		default:
+			ln.Err = errors.New("unreadable Dr/Cr marker")
+			return ln
+		}
+	}
+
+	if ln.Date, ln.Timed, err = parseDate(cell(cs.date), cell(cs.time), l.DateFormat); err != nil {
+		ln.Err = err
+		return ln
+	}
+
+	ln.UPIRef, ln.PayerVPA, ln.PayerName, ln.UPI = readNarration(ln.Narration)
+	if ln.UPIRef == "" && ln.UPI && refRe.MatchString(ln.Ref) {
+		ln.UPIRef = refRe.FindString(ln.Ref)
+	}
+	return ln
+}
+
+// parseAmount reads "1,250.50" as 125050 paise; an empty cell is zero.
+// Some banks suffix the amount with "Cr" or "Dr", which is dropped.
+func parseAmount(s string) (int64, error) {
+	s = strings.TrimSpace(strings.ReplaceAll(s, ",", ""))
+	s = strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "CR"), "DR")
+	s = strings.TrimSpace(strings.TrimPrefix(s, "INR"))
+	if s == "" || s == "-" {
+		return 0, nil
+	}
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" {
+		whole = "0"
+	}
+	if len(frac) > 2 {
+		// Spreadsheets store 250.1 as 250.09999999999999.
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || f < 0 {
+			return 0, errors.New("invalid amount")
+		}
+		return int64(f*100 + 0.5), nil
+	}
+	frac += strings.Repeat("0", 2-len(frac))
+	rupees, err := strconv.ParseUint(whole, 10, 63)
+	if err != nil {
+		return 0, err
+	}
+	paise, err := strconv.ParseUint(frac, 10, 8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(rupees*100 + paise), nil
+}
+
+var dateFormats = []string{
+	"02/01/06", "02/01/2006", "02-01-06", "02-01-2006", "2006-01-02",
+	"02 Jan 2006", "2 Jan 2006", "02-Jan-2006", "02-Jan-06", "02 Jan 06", "02/Jan/2006",
+	"02/01/2006 15:04:05", "02-01-2006 15:04:05", "2006-01-02 15:04:05",
+}
+
+var clockFormats = []string{"15:04:05", "15:04", "03:04 PM", "03:04:05 PM"}
+
+// excelEpoch is day zero of the serial numbers XLSX files store dates as.
+var excelEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, IST)
+
+// parseDate reads a statement date. Lines without a time of day are put at
+// noon, the least wrong guess for a payment that could have come in at any
+// hour of that day, with timed false.
+func parseDate(date, clock, format string) (t time.Time, timed bool, err error) {
+	var day time.Time
+	formats := dateFormats
+	if format != "" {
+		formats = append([]string{format}, dateFormats...)
+	}
+	for _, f := range formats {
+		if t, err := time.ParseInLocation(f, date, IST); err == nil {
+			day = t
+			break
+		}
+	}
+	if day.IsZero() {
+		serial, err := strconv.ParseFloat(date, 64)
+		if err != nil || serial < 1 || serial > 2958465 {
+			return time.Time{}, false, errors.New("unreadable date")
+		}
+		day = excelEpoch.Add(time.Duration(serial * float64(24*time.Hour))).Round(time.Second)
+	}
+	if day.Hour() != 0 || day.Minute() != 0 || day.Second() != 0 {
+		return day, true, nil
+	}
+	for _, f := range clockFormats {
+		if t, err := time.Parse(f, strings.ToUpper(clock)); err == nil {
+			return time.Date(day.Year(), day.Month(), day.Day(), t.Hour(), t.Minute(), t.Second(), 0, IST), true, nil
+		}
+	}
+	return time.Date(day.Year(), day.Month(), day.Day(), 12, 0, 0, 0, IST), false, nil
+}
+
+var (
+	upiRe = regexp.MustCompile(`(?i)(?:^|[^A-Za-z])UPI(?:[^A-Za-z]|$)`)
+	refRe = regexp.MustCompile(`\b\d{12}\b`)
+	vpaRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.\-_]{1,255}@[A-Za-z][A-Za-z0-9]{1,63}$`)
+	// ifscRe spots the bank branch codes some narrations carry.
+	ifscRe = regexp.MustCompile(`^[A-Z]{4}0[A-Z0-9]{6}$`)
+)
+
+// narrationWords are the fixed parts of UPI narrations, never a payer's
+// name.
+var narrationWords = map[string]bool{
+	"UPI": true, "CR": true, "DR": true, "P2M": true, "P2A": true, "IN": true,
+	"TO TRANSFER": true, "BY TRANSFER": true, "TRANSFER": true, "PAYMENT": true,
+	"PAYMENT FR": true, "PAYMENT FROM PHONE": true, "PAY": true, "COLLECT": true,
+	"SENT": true, "RECEIVED": true, "UPIINTENT": true, "NA": true, "NO REMARKS": true,
+}
+
+// readNarration takes the UPI fields out of a narration such as
+//
+//	UPI-RAHUL KUMAR-rahul@okaxis-SBIN0001234-407212345678-PAYMENT
+//	TO TRANSFER-UPI/CR/407212345678/RAHUL KU/SBIN/rahul@oksbi/Payment--
+//	UPI/P2M/407212345678/RAHUL KUMAR/Payment fr/AXIS BANK
+//
+// The payer name is the first part that reads like one.
+func readNarration(n string) (ref, vpa, name string, upi bool) {
+	if !upiRe.MatchString(n) {
+		return "", "", "", false
+	}
+	ref = refRe.FindString(n)
+	// Narrations are split on "/" or, where a bank uses none, on "-".
+	sep := "/"
+	if !strings.Contains(n, sep) {
+		sep = "-"
+	}
+	for _, part := range strings.Split(n, sep) {
+		part = strings.TrimSpace(part)
+		if vpa == "" && vpaRe.MatchString(part) {
+			vpa = strings.ToLower(part)
+			continue
+		}
+		if name != "" {
+			continue
+		}
+		upper := strings.ToUpper(part)
+		if len(part) < 3 || narrationWords[upper] || ifscRe.MatchString(upper) ||
+			strings.HasSuffix(upper, "BANK") || strings.ContainsAny(part, "@0123456789") {
+			continue
+		}
+		if strings.Trim(part, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz .") != "" {
+			continue
+		}
+		name = part
+	}
+	return ref, vpa, name, true
+}
@@ -0,0 +1,191 @@
+package statement
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var errAny = errors.New("any error")
+
+func TestParse(t *testing.T) {
+	hdfcHeader := []string{"Date", "Narration", "Chq./Ref.No.", "Value Dt", "Withdrawal Amt.", "Deposit Amt.", "Closing Balance"}
+	noon := time.Date(2024, 3, 12, 12, 0, 0, 0, IST)
+
+	tests := []struct {
+		name       string
+		rows       [][]string
+		wantLayout string
+		want       []Line
+		wantErr    error
+	}{
+		{
+			name: "HDFC with account details and separator rows",
+			rows: [][]string{
+				{"HDFC BANK Ltd."},
+				{"Account No :", "50100012341234"},
+				{},
+				hdfcHeader,
+				{"********", "********", "********", "********", "********", "********", "********"},
+				{"12/03/24", "UPI-RAHUL KUMAR-rahul@okaxis-SBIN0001234-407212345678-PAYMENT", "0000407212345678", "12/03/24", "", "250.00", "10,250.00"},
+				{"12/03/24", "NEFT-N071240001-ACME TRADERS", "N071240001", "12/03/24", "1,000.00", "", "9,250.00"},
+				{"12/03/24", "UPI-BROKEN", "", "12/03/24", "", "two fifty", ""},
+				{"********", "********", "********", "********", "********", "********", "********"},
+				{"STATEMENT SUMMARY :-"},
+			},
+			wantLayout: "HDFC",
+			want: []Line{
+				{Row: 6, Date: noon, Narration: "UPI-RAHUL KUMAR-rahul@okaxis-SBIN0001234-407212345678-PAYMENT", Ref: "0000407212345678", Credit: 25000,
+					UPI: true, UPIRef: "407212345678", PayerVPA: "rahul@okaxis", PayerName: "RAHUL KUMAR"},
+				{Row: 7, Date: noon, Narration: "NEFT-N071240001-ACME TRADERS", Ref: "N071240001", Debit: 100000},
+				{Row: 8, Narration: "UPI-BROKEN", Err: errAny},
+			},
+		},
+		{
+			name: "Kotak amount with Dr/Cr column",
+			rows: [][]string{
+				{"Sl. No.", "Transaction Date", "Value Date", "Description", "Chq / Ref No.", "Amount", "Dr / Cr", "Balance"},
+				{"1", "12-03-2024", "12-03-2024", "UPI/RAHUL KUMAR/407212345678/Payment", "UPI-407212345678", "250.00", "CR", "10,250.00"},
+				{"2", "12-03-2024", "12-03-2024", "UPI/SHOP/407212345679/Pay", "UPI-407212345679", "90.00", "DR", "10,160.00"},
+				{"3", "12-03-2024", "12-03-2024", "UPI/ODD/407212345670/Pay", "", "10.00", "XX", "10,150.00"},
+			},
+			wantLayout: "KOTAK",
+			want: []Line{
+				{Row: 2, Date: noon, Narration: "UPI/RAHUL KUMAR/407212345678/Payment", Ref: "UPI-407212345678", Credit: 25000,
+					UPI: true, UPIRef: "407212345678", PayerName: "RAHUL KUMAR"},
+				{Row: 3, Date: noon, Narration: "UPI/SHOP/407212345679/Pay", Ref: "UPI-407212345679", Debit: 9000,
+					UPI: true, UPIRef: "407212345679", PayerName: "SHOP"},
+				{Row: 4, Narration: "UPI/ODD/407212345670/Pay", Err: errAny},
+			},
+		},
+		{
+			name:    "no known header",
+			rows:    [][]string{{"Posted", "Details", "Money"}, {"12/03/24", "UPI-RAHUL", "250"}},
+			wantErr: ErrUnknownLayout,
+		},
+		{
+			name:    "header too far down",
+			rows:    append(make([][]string, headerScanRows), hdfcHeader),
+			wantErr: ErrUnknownLayout,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, err := Parse(tt.rows, Layouts)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Parse() error = %v, want %v", err, tt.wantErr)
+			}
+			if st.Layout != tt.wantLayout {
+				t.Errorf("Layout = %q, want %q", st.Layout, tt.wantLayout)
+			}
+			if len(st.Lines) != len(tt.want) {
+				t.Fatalf("got %d lines, want %d: %+v", len(st.Lines), len(tt.want), st.Lines)
+			}
+			for i, got := range st.Lines {
+				want := tt.want[i]
+				if (got.Err != nil) != (want.Err != nil) {
+					t.Errorf("line %d: Err = %v, want error %v", i, got.Err, want.Err != nil)
+				}
+				if !got.Date.Equal(want.Date) {
+					t.Errorf("line %d: Date = %v, want %v", i, got.Date, want.Date)
+				}
+				got.Err, want.Err = nil, nil
+				got.Date, want.Date = time.Time{}, time.Time{}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("line %d = %+v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	tests := []struct {
+		name      string
+		date      string
+		clock     string
+		format    string
+		want      time.Time
+		wantTimed bool
+		wantErr   bool
+	}{
+		{"layout format, no time", "12/03/24", "", "02/01/06", time.Date(2024, 3, 12, 12, 0, 0, 0, IST), false, false},
+		{"time column", "12/03/24", "14:22:05", "02/01/06", time.Date(2024, 3, 12, 14, 22, 5, 0, IST), true, false},
+		{"12-hour time column", "12/03/24", "02:30 pm", "02/01/06", time.Date(2024, 3, 12, 14, 30, 0, 0, IST), true, false},
+		{"month name", "12 Mar 2024", "", "2 Jan 2006", time.Date(2024, 3, 12, 12, 0, 0, 0, IST), false, false},
+		{"date with time of day", "12-03-2024 14:22:05", "", "02-01-2006", time.Date(2024, 3, 12, 14, 22, 5, 0, IST), true, false},
+		{"common format when the layout's doesn't fit", "2024-03-12", "", "02/01/06", time.Date(2024, 3, 12, 12, 0, 0, 0, IST), false, false},
+		{"excel serial", "45363", "", "", time.Date(2024, 3, 12, 12, 0, 0, 0, IST), false, false},
+		{"excel serial with time", "45363.6", "", "", time.Date(2024, 3, 12, 14, 24, 0, 0, IST), true, false},
+		{"unreadable", "yesterday", "", "", time.Time{}, false, true},
+		{"serial out of range", "0", "", "", time.Time{}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, timed, err := parseDate(tt.date, tt.clock, tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDate() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) || timed != tt.wantTimed {
+				t.Errorf("parseDate() = %v, %v, want %v, %v", got, timed, tt.want, tt.wantTimed)
+			}
+		})
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"1,250.50", 125050, false},
+		{"250", 25000, false},
+		{"250.5", 25050, false},
+		{".75", 75, false},
+		{"", 0, false},
+		{"-", 0, false},
+		{"250.00 Cr", 25000, false},
+		{"90.00Dr", 9000, false},
+		{"INR 99", 9900, false},
+		{"250.09999999999999", 25010, false},
+		{"two fifty", 0, true},
+		{"-250", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseAmount(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAmount(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseAmount(%q) = %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadNarration(t *testing.T) {
+	tests := []struct {
+		narration string
+		ref       string
+		vpa       string
+		name      string
+		upi       bool
+	}{
+		{"UPI-RAHUL KUMAR-rahul@okaxis-SBIN0001234-407212345678-PAYMENT", "407212345678", "rahul@okaxis", "RAHUL KUMAR", true},
+		{"TO TRANSFER-UPI/CR/407212345678/RAHUL KU/SBIN/rahul@oksbi/Payment--", "407212345678", "rahul@oksbi", "RAHUL KU", true},
+		{"UPI/P2M/407212345678/RAHUL KUMAR/Payment fr/AXIS BANK", "407212345678", "", "RAHUL KUMAR", true},
+		{"NEFT-N071240001-ACME TRADERS", "", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.narration, func(t *testing.T) {
+			ref, vpa, name, upi := readNarration(tt.narration)
+			if ref != tt.ref || vpa != tt.vpa || name != tt.name || upi != tt.upi {
+				t.Errorf("readNarration() = %q, %q, %q, %v, want %q, %q, %q, %v",
+					ref, vpa, name, upi, tt.ref, tt.vpa, tt.name, tt.upi)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package payment
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"upisettle/internal/payment/statement"
+)
+
+var (
+	ErrUnreadableStatement = errors.New("statement file could not be read")
+	ErrLayoutNotFound      = errors.New("no statement layout with that name")
+)
+
+// MaxStatementSize is the largest statement file accepted for import.
+const MaxStatementSize = 10 << 20
+
+// StatementLayout is a merchant's own column mapping, for a bank or a
+// download format the built-in layouts don't know. Columns are named by
+// their header text.
+type StatementLayout struct {
+	ID              uint   `gorm:"primaryKey"`
+	MerchantID      uint   `gorm:"not null;uniqueIndex:idx_statement_layouts_name"`
+	Name            string `gorm:"size:64;not null;uniqueIndex:idx_statement_layouts_name"`
+	DateColumn      string `gorm:"size:128;not null"`
+	TimeColumn      string `gorm:"size:128"`
+	NarrationColumn string `gorm:"size:128;not null"`
+	RefColumn       string `gorm:"size:128"`
+	CreditColumn    string `gorm:"size:128"` // or AmountColumn with DrCrColumn
+	DebitColumn     string `gorm:"size:128"`
+	AmountColumn    string `gorm:"size:128"`
+	DrCrColumn      string `gorm:"size:128"`
+	DateFormat      string `gorm:"size:32"` // Go time layout, e.g. "02/01/2006"
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+func (StatementLayout) TableName() string {
+	return "statement_layouts"
+}
+
+func (l StatementLayout) layout() statement.Layout {
+	return statement.Layout{
+		Name:       l.Name,
+		Date:       l.DateColumn,
+		Time:       l.TimeColumn,
+		Narration:  l.NarrationColumn,
+		Ref:        l.RefColumn,
+		Credit:     l.CreditColumn,
+		Debit:      l.DebitColumn,
+		Amount:     l.AmountColumn,
+		DrCr:       l.DrCrColumn,
+		DateFormat: l.DateFormat,
+	}
+}
+
+type StatementLayoutRequest struct {
+	DateColumn      string `json:"date_column" binding:"required"`
+	TimeColumn      string `json:"time_column"`
+	NarrationColumn string `json:"narration_column" binding:"required"`
+	RefColumn       string `json:"ref_column"`
+	CreditColumn    string `json:"credit_column"`
+	DebitColumn     string `json:"debit_column"`
+	AmountColumn    string `json:"amount_column"`
+	DrCrColumn      string `json:"dr_cr_column"`
+	DateFormat      string `json:"date_format"`
+}
+
+// ListStatementLayouts returns the merchant's layouts followed by the
+// built-in ones, which have no ID. Import tries them in this order.
+func (s *Service) ListStatementLayouts(merchantID uint) ([]StatementLayout, error) {
+	var layouts []StatementLayout
+	if err := s.db.Where("merchant_id = ?", merchantID).Order("name ASC").Find(&layouts).Error; err != nil {
+		return nil, err
+	}
+	for _, l := range statement.Layouts {
+		layouts = append(layouts, StatementLayout{
+			Name:            l.Name,
+			DateColumn:      l.Date,
+			TimeColumn:      l.Time,
+			NarrationColumn: l.Narration,
+			RefColumn:       l.Ref,
+			CreditColumn:    l.Credit,
+			DebitColumn:     l.Debit,
+			AmountColumn:    l.Amount,
+			DrCrColumn:      l.DrCr,
+			DateFormat:      l.DateFormat,
+		})
+	}
+	return layouts, nil
+}
+
+// SaveStatementLayout creates or replaces the merchant's layout called
+// name. A merchant layout named like a built-in one is tried before it.
+func (s *Service) SaveStatementLayout(merchantID uint, name string, req StatementLayoutRequest) (StatementLayout, error) {
+	var l StatementLayout
+	err := s.db.Where("merchant_id = ? AND name = ?", merchantID, name).First(&l).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return StatementLayout{}, err
+	}
+
+	l.MerchantID = merchantID
+	l.Name = name
+	l.DateColumn = req.DateColumn
+	l.TimeColumn = req.TimeColumn
+	l.NarrationColumn = req.NarrationColumn
+	l.RefColumn = req.RefColumn
+	l.CreditColumn = req.CreditColumn
+	l.DebitColumn = req.DebitColumn
+	l.AmountColumn = req.AmountColumn
+	l.DrCrColumn = req.DrCrColumn
+	l.DateFormat = req.DateFormat
+	if err := l.layout().Validate(); err != nil {
+		return StatementLayout{}, err
+	}
+	if err := s.db.Save(&l).Error; err != nil {
+		return StatementLayout{}, err
+	}
+	return l, nil
+}
+
+// RejectedLine is a statement line that could not be read, or a UPI credit
+// that could not be imported.
+type RejectedLine struct {
+	Row       int    `json:"row"`
+	Narration string `json:"narration"`
+	Reason    string `json:"reason"`
+}
+
+// StatementImport is the outcome of importing a statement. Lines counts
+// the transaction lines read; each is new, duplicate (its UPI ref was
+// already ingested, by SMS or an earlier import), rejected, or skipped
+// because it is a debit or a credit that didn't come through UPI.
+type StatementImport struct {
+	Layout        string         `json:"layout"`
+	Lines         int            `json:"lines"`
+	New           int            `json:"new"`
+	Duplicate     int            `json:"duplicate"`
+	Rejected      int            `json:"rejected"`
+	Skipped       int            `json:"skipped"`
+	PaymentIDs    []uint         `json:"payment_ids,omitempty"` // payments created
+	RejectedLines []RejectedLine `json:"rejected_lines,omitempty"`
+}
+
+// ImportStatement reads a bank statement file and stores its UPI credits
+// as payments of a store, exactly as CreatePayment would. layoutName picks
+// a layout by name; when empty the file's layout is recognised from its
+// header. Statements rarely carry a time of day, so imported payments are
+// put at noon of their date unless the layout has a time column; those are
+// not matched on import but left to the day's reconcile run. An import
+// that fails part way can be retried: the lines already stored come back
+// as duplicates.
+func (s *Service) ImportStatement(merchantID, storeID uint, data []byte, layoutName string) (StatementImport, error) {
+	var report StatementImport
+
+	saved, err := s.ListStatementLayouts(merchantID)
+	if err != nil {
+		return report, err
+	}
+	var layouts []statement.Layout
+	for _, l := range saved {
+		if layoutName == "" || strings.EqualFold(l.Name, layoutName) {
+			layouts = append(layouts, l.layout())
+		}
+	}
+	if len(layouts) == 0 {
+		return report, ErrLayoutNotFound
+	}
+
+	rows, err := statement.ReadRows(data)
+	if err != nil {
+		return report, fmt.Errorf("%w: %v", ErrUnreadableStatement, err)
+	}
+	st, err := statement.Parse(rows, layouts)
+	if err != nil {
+		return report, err
+	}
+	report.Layout = st.Layout
+	report.Lines = len(st.Lines)
+
+	reject := func(ln statement.Line, reason string) {
+		report.Rejected++
+		report.RejectedLines = append(report.RejectedLines, RejectedLine{Row: ln.Row, Narration: ln.Narration, Reason: reason})
+	}
+	for _, ln := range st.Lines {
+		switch {
+		case ln.Err != nil:
+			reject(ln, ln.Err.Error())
+			continue
+		case ln.Credit <= 0 || !ln.UPI:
+			report.Skipped++
+			continue
+		case ln.UPIRef == "":
+			// Without the ref the line can't be told apart from a payment
+			// already reported by SMS.
+			reject(ln, "no UPI reference in the narration")
+			continue
+		}
+
+		created, err := s.CreatePayment(merchantID, storeID, CreatePaymentRequest{
+			Channel:   ChannelUPI,
+			Amount:    ln.Credit,
+			Time:      ln.Date,
+			UPIRef:    ln.UPIRef,
+			PayerVPA:  ln.PayerVPA,
+			PayerName: ln.PayerName,
+			NoMatch:   !ln.Timed,
+		})
+		if err != nil {
+			return report, err
+		}
+		if created.Duplicate {
+			report.Duplicate++
+			continue
+		}
+		report.New++
+		report.PaymentIDs = append(report.PaymentIDs, created.ID)
+	}
+	return report, nil
+}
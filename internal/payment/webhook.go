@@ -0,0 +1,451 @@
+package payment
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrUnknownProvider   = errors.New("unknown webhook provider")
+	ErrInvalidSignature  = errors.New("webhook signature does not match")
+	ErrStoreNotFound     = errors.New("store not found")
+	ErrWebhookInProgress = errors.New("webhook event is being processed by another delivery")
+)
+
+// MaxWebhookSize is the largest webhook body read.
+const MaxWebhookSize = 1 << 20
+
+// webhookClaimTimeout is how long a PROCESSING event stays claimed. A
+// delivery that died mid-way leaves its claim behind; after this a
+// redelivery takes it over. The payment it may have stored is found again
+// by its UPI ref.
+const webhookClaimTimeout = 2 * time.Minute
+
+// Webhook event statuses.
+const (
+	WebhookStatusProcessing = "PROCESSING" // claimed by a delivery that is storing its payment
+	WebhookStatusProcessed  = "PROCESSED"  // a new payment was stored
+	WebhookStatusDuplicate  = "DUPLICATE"  // the UPI ref was already ingested, e.g. by SMS
+	WebhookStatusIgnored    = "IGNORED"    // not a credit (failed payment, refund, ...)
+	WebhookStatusUnrouted   = "UNROUTED"   // no store for the event's target yet
+)
+
+// WebhookEndpoint is where one provider delivers one merchant's events:
+// POST /webhooks/:provider/:key. The provider signs each delivery with the
+// endpoint's secret. Events are routed to a store by their target (QR code,
+// terminal, soundbox device) through WebhookRoutes, else to StoreID.
+type WebhookEndpoint struct {
+	ID         uint   `gorm:"primaryKey"`
+	MerchantID uint   `gorm:"not null;index"`
+	Provider   string `gorm:"size:32;not null"`
+	Key        string `gorm:"size:64;not null;uniqueIndex"` // public, in the URL
+	Secret     string `gorm:"size:128;not null" json:"-"`
+	StoreID    *uint  // store for events no route matches
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+func (WebhookEndpoint) TableName() string {
+	return "webhook_endpoints"
+}
+
+// WebhookRoute sends an endpoint's events for one provider-side target to
+// a store.
+type WebhookRoute struct {
+	ID         uint   `gorm:"primaryKey"`
+	EndpointID uint   `gorm:"not null;uniqueIndex:idx_webhook_routes_target"`
+	Target     string `gorm:"size:255;not null;uniqueIndex:idx_webhook_routes_target"`
+	StoreID    uint   `gorm:"not null"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+func (WebhookRoute) TableName() string {
+	return "webhook_routes"
+}
+
+// WebhookEvent is a delivery the receiver accepted, kept so that the
+// provider's retries of the same event get the same answer. The row is
+// stored PROCESSING before the event's payment, as a claim on the event.
+type WebhookEvent struct {
+	ID         uint   `gorm:"primaryKey"`
+	MerchantID uint   `gorm:"not null;index"`
+	EndpointID uint   `gorm:"not null;uniqueIndex:idx_webhook_events_event"`
+	EventID    string `gorm:"size:255;not null;uniqueIndex:idx_webhook_events_event"`
+	Target     string `gorm:"size:255"`
+	StoreID    *uint
+	PaymentID  *uint
+	Status     string `gorm:"size:16;not null"`
+	Payload    string `gorm:"type:text;not null"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+func (WebhookEvent) TableName() string {
+	return "webhook_events"
+}
+
+type CreateWebhookEndpointRequest struct {
+	Provider string `json:"provider" binding:"required"`
+	StoreID  *uint  `json:"store_id"`
+}
+
+// CreatedWebhookEndpoint is a new endpoint with its secret, which is only
+// ever shown here.
+type CreatedWebhookEndpoint struct {
+	WebhookEndpoint
+	Secret string `json:"secret"`
+	Path   string `json:"path"`
+}
+
+type WebhookRouteRequest struct {
+	Target  string `json:"target" binding:"required"`
+	StoreID uint   `json:"store_id" binding:"required"`
+}
+
+// WebhookResult is the receiver's answer to a delivery. Replay is set when
+// the event had been received before and nothing new was done.
+type WebhookResult struct {
+	Status  string          `json:"status"`
+	EventID string          `json:"event_id"`
+	StoreID *uint           `json:"store_id,omitempty"`
+	Payment *CreatedPayment `json:"payment,omitempty"`
+	Replay  bool            `json:"replay,omitempty"`
+}
+
+// CreateWebhookEndpoint sets up delivery of a provider's events for a
+// merchant, with a fresh key and secret.
+func (s *Service) CreateWebhookEndpoint(merchantID uint, req CreateWebhookEndpointRequest) (CreatedWebhookEndpoint, error) {
+	provider := strings.ToLower(req.Provider)
+	if _, ok := webhookProviders[provider]; !ok {
+		return CreatedWebhookEndpoint{}, ErrUnknownProvider
+	}
+	if req.StoreID != nil {
+		if err := s.checkStore(merchantID, *req.StoreID); err != nil {
+			return CreatedWebhookEndpoint{}, err
+		}
+	}
+	key, err := randomHex(16)
+	if err != nil {
+		return CreatedWebhookEndpoint{}, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return CreatedWebhookEndpoint{}, err
+	}
+	e := WebhookEndpoint{MerchantID: merchantID, Provider: provider, Key: key, Secret: secret, StoreID: req.StoreID}
+	if err := s.db.Create(&e).Error; err != nil {
+		return CreatedWebhookEndpoint{}, err
+	}
+	return CreatedWebhookEndpoint{WebhookEndpoint: e, Secret: secret, Path: "/webhooks/" + provider + "/" + key}, nil
+}
+
+func (s *Service) ListWebhookEndpoints(merchantID uint) ([]WebhookEndpoint, error) {
+	var endpoints []WebhookEndpoint
+	if err := s.db.Where("merchant_id = ?", merchantID).Order("id ASC").Find(&endpoints).Error; err != nil {
+		return nil, err
+	}
+	return endpoints, nil
+}
+
+// SaveWebhookRoute sends an endpoint's events for target to a store,
+// replacing the target's earlier route.
+func (s *Service) SaveWebhookRoute(merchantID, endpointID uint, req WebhookRouteRequest) (WebhookRoute, error) {
+	var e WebhookEndpoint
+	if err := s.db.Where("id = ? AND merchant_id = ?", endpointID, merchantID).First(&e).Error; err != nil {
+		return WebhookRoute{}, err
+	}
+	if err := s.checkStore(merchantID, req.StoreID); err != nil {
+		return WebhookRoute{}, err
+	}
+
+	var r WebhookRoute
+	err := s.db.Where("endpoint_id = ? AND target = ?", e.ID, req.Target).First(&r).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return WebhookRoute{}, err
+	}
+	r.EndpointID = e.ID
+	r.Target = req.Target
+	r.StoreID = req.StoreID
+	if err := s.db.Save(&r).Error; err != nil {
+		return WebhookRoute{}, err
+	}
+	if err := s.retryUnroutedWebhooks(e, req.Target); err != nil {
+		return WebhookRoute{}, err
+	}
+	return r, nil
+}
+
+// retryUnroutedWebhooks processes an endpoint's UNROUTED events for a
+// target that has just been given a store. They were acknowledged when they
+// arrived, so the provider won't deliver them again.
+func (s *Service) retryUnroutedWebhooks(e WebhookEndpoint, target string) error {
+	p, ok := webhookProviders[e.Provider]
+	if !ok {
+		return ErrUnknownProvider
+	}
+	var events []WebhookEvent
+	if err := s.db.Where("endpoint_id = ? AND target = ? AND status = ?", e.ID, target, WebhookStatusUnrouted).
+		Order("id ASC").Find(&events).Error; err != nil {
+		return err
+	}
+	for i := range events {
+		// Headers aren't kept; the event id is already known and the
+		// payment is read from the body.
+		ev, err := p.parse(http.Header{}, []byte(events[i].Payload))
+		if err != nil {
+			return err
+		}
+		claimed, err := s.takeOverWebhookEvent(&events[i])
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue // a redelivery got to it first
+		}
+		if _, err := s.processWebhookEvent(e, &events[i], ev, WebhookStatusUnrouted); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListWebhookEvents returns a merchant's latest deliveries, optionally
+// filtered by status.
+func (s *Service) ListWebhookEvents(merchantID uint, status string) ([]WebhookEvent, error) {
+	q := s.db.Where("merchant_id = ?", merchantID)
+	if status != "" {
+		q = q.Where("status = ?", status)
+	}
+	var events []WebhookEvent
+	if err := q.Order("id DESC").Limit(500).Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// ReceiveWebhook handles a provider's delivery to an endpoint. The
+// signature is checked against the endpoint's secret before the body is
+// read. A credit is stored as a payment of the store its target routes to,
+// exactly as CreatePayment would. Redeliveries of an event get its first
+// outcome; only an UNROUTED event is tried again, since a route may have
+// been added since. Saving a route also processes the UNROUTED events
+// waiting for it. A delivery that arrives while another is still
+// processing the event gets ErrWebhookInProgress.
+func (s *Service) ReceiveWebhook(provider, key string, h http.Header, body []byte) (WebhookResult, error) {
+	p, ok := webhookProviders[strings.ToLower(provider)]
+	if !ok {
+		return WebhookResult{}, ErrUnknownProvider
+	}
+	var e WebhookEndpoint
+	if err := s.db.Where("key = ? AND provider = ?", key, p.name).First(&e).Error; err != nil {
+		return WebhookResult{}, err
+	}
+	if !p.verify(e.Secret, h, body) {
+		return WebhookResult{}, ErrInvalidSignature
+	}
+
+	ev, err := p.parse(h, body)
+	if err != nil {
+		return WebhookResult{}, err
+	}
+	if ev.EventID == "" {
+		sum := sha256.Sum256(body)
+		ev.EventID = hex.EncodeToString(sum[:])
+	}
+
+	stored := WebhookEvent{
+		MerchantID: e.MerchantID,
+		EndpointID: e.ID,
+		EventID:    ev.EventID,
+		Target:     ev.Target,
+		Payload:    string(body),
+	}
+	prev, claimed, err := s.claimWebhookEvent(&stored)
+	if err != nil {
+		return WebhookResult{}, err
+	}
+	if !claimed {
+		if stored.Status == WebhookStatusProcessing || stored.Status == WebhookStatusUnrouted {
+			return WebhookResult{}, ErrWebhookInProgress
+		}
+		return s.replayWebhook(stored)
+	}
+	return s.processWebhookEvent(e, &stored, ev, prev)
+}
+
+// claimWebhookEvent stores a delivery's event as PROCESSING before anything
+// is done for it, so concurrent first deliveries of an event can't both
+// store its payment. The unique index on (endpoint_id, event_id) decides
+// which one wins. If the event is already stored its row is loaded into ev
+// and taken over when it is UNROUTED or an abandoned claim; prev is the
+// status it had, empty for a new row. claimed is false when another
+// delivery holds the event or has finished it.
+func (s *Service) claimWebhookEvent(ev *WebhookEvent) (prev string, claimed bool, err error) {
+	ev.Status = WebhookStatusProcessing
+	err = s.db.Create(ev).Error
+	if err == nil {
+		return "", true, nil
+	}
+	if !errors.Is(err, gorm.ErrDuplicatedKey) {
+		return "", false, err
+	}
+
+	var existing WebhookEvent
+	if err := s.db.Where("endpoint_id = ? AND event_id = ?", ev.EndpointID, ev.EventID).First(&existing).Error; err != nil {
+		return "", false, err
+	}
+	*ev = existing
+	claimed, err = s.takeOverWebhookEvent(ev)
+	return existing.Status, claimed, err
+}
+
+// takeOverWebhookEvent claims a stored event that is UNROUTED, or
+// PROCESSING for longer than webhookClaimTimeout.
+func (s *Service) takeOverWebhookEvent(ev *WebhookEvent) (bool, error) {
+	now := time.Now()
+	res := s.db.Model(&WebhookEvent{}).
+		Where("id = ? AND (status = ? OR (status = ? AND updated_at < ?))",
+			ev.ID, WebhookStatusUnrouted, WebhookStatusProcessing, now.Add(-webhookClaimTimeout)).
+		Updates(map[string]any{"status": WebhookStatusProcessing, "updated_at": now})
+	if res.Error != nil || res.RowsAffected == 0 {
+		return false, res.Error
+	}
+	ev.Status = WebhookStatusProcessing
+	return true, nil
+}
+
+// processWebhookEvent routes a claimed event to its store, stores its
+// payment and records the outcome on stored. If that fails the claim is
+// given up, back to prev or by removing a new row, so the event can be
+// delivered again.
+func (s *Service) processWebhookEvent(e WebhookEndpoint, stored *WebhookEvent, ev providerEvent, prev string) (WebhookResult, error) {
+	release := func(err error) (WebhookResult, error) {
+		if prev == "" {
+			s.db.Delete(stored)
+		} else {
+			s.db.Model(stored).Update("status", prev)
+		}
+		return WebhookResult{}, err
+	}
+	res := WebhookResult{EventID: stored.EventID}
+
+	switch {
+	case !ev.Credit:
+		stored.Status = WebhookStatusIgnored
+	default:
+		storeID, err := s.routeWebhook(e, ev.Target)
+		if err != nil {
+			return release(err)
+		}
+		if storeID == nil {
+			stored.Status = WebhookStatusUnrouted
+			break
+		}
+		created, err := s.CreatePayment(e.MerchantID, *storeID, ev.Payment)
+		if err != nil {
+			return release(err)
+		}
+		stored.StoreID = storeID
+		stored.PaymentID = &created.ID
+		stored.Status = WebhookStatusProcessed
+		if created.Duplicate {
+			stored.Status = WebhookStatusDuplicate
+		}
+		res.StoreID = storeID
+		res.Payment = &created
+	}
+
+	if err := s.db.Model(stored).Updates(map[string]any{
+		"status":     stored.Status,
+		"store_id":   stored.StoreID,
+		"payment_id": stored.PaymentID,
+	}).Error; err != nil {
+		return WebhookResult{}, err
+	}
+	res.Status = stored.Status
+	return res, nil
+}
+
+// replayWebhook answers a redelivery with the stored outcome.
+func (s *Service) replayWebhook(stored WebhookEvent) (WebhookResult, error) {
+	res := WebhookResult{Status: stored.Status, EventID: stored.EventID, StoreID: stored.StoreID, Replay: true}
+	if stored.PaymentID != nil {
+		var p Payment
+		if err := s.db.First(&p, *stored.PaymentID).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return WebhookResult{}, err
+		} else if err == nil {
+			res.Payment = &CreatedPayment{Payment: p, Duplicate: true}
+		}
+	}
+	return res, nil
+}
+
+// routeWebhook finds the store for an event target: its route, else the
+// endpoint's store. nil means neither is set.
+func (s *Service) routeWebhook(e WebhookEndpoint, target string) (*uint, error) {
+	if target != "" {
+		var r WebhookRoute
+		err := s.db.Where("endpoint_id = ? AND target = ?", e.ID, target).First(&r).Error
+		if err == nil {
+			return &r.StoreID, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+	return e.StoreID, nil
+}
+
+func (s *Service) checkStore(merchantID, storeID uint) error {
+	var n int64
+	if err := s.db.Table("stores").Where("id = ? AND merchant_id = ?", storeID, merchantID).Count(&n).Error; err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrStoreNotFound
+	}
+	return nil
+}
+
+// verify checks a delivery's signature in constant time.
+func (p webhookProvider) verify(secret string, h http.Header, body []byte) bool {
+	sig := strings.TrimSpace(h.Get(p.signatureHeader))
+	if sig == "" {
+		return false
+	}
+	var got []byte
+	var err error
+	if p.base64 {
+		got, err = base64.StdEncoding.DecodeString(sig)
+	} else {
+		got, err = hex.DecodeString(strings.TrimPrefix(sig, "sha256="))
+	}
+	if err != nil {
+		return false
+	}
+	signed := body
+	if p.signed != nil {
+		signed = p.signed(h, body)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(signed)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
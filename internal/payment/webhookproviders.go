@@ -0,0 +1,267 @@
+package payment
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"upisettle/internal/payment/sms"
+)
+
+var ErrInvalidPayload = errors.New("webhook payload could not be read")
+
+// webhookProvider is a payment service provider or soundbox vendor whose
+// webhooks the receiver understands. Each signs the request with HMAC-SHA256
+// under the endpoint secret; they differ in what is signed, where the
+// signature travels and how it is encoded.
+type webhookProvider struct {
+	name            string
+	signatureHeader string
+	base64          bool // signature is base64, not hex
+	// signed returns the bytes the signature covers; nil means the body.
+	signed func(h http.Header, body []byte) []byte
+	parse  func(h http.Header, body []byte) (providerEvent, error)
+}
+
+// providerEvent is what a provider's payload says, in our terms.
+type providerEvent struct {
+	// EventID is the provider's id for the event; redeliveries repeat it.
+	EventID string
+	// Target identifies where the money went on the provider's side (a QR
+	// code, terminal or soundbox device) and picks the store.
+	Target string
+	// Credit is false for events that don't report money received
+	// (failures, refunds); they are acknowledged and ignored.
+	Credit  bool
+	Payment CreatePaymentRequest
+}
+
+var webhookProviders = map[string]webhookProvider{
+	"razorpay": {
+		name:            "razorpay",
+		signatureHeader: "X-Razorpay-Signature",
+		parse:           parseRazorpay,
+	},
+	"cashfree": {
+		name:            "cashfree",
+		signatureHeader: "X-Webhook-Signature",
+		base64:          true,
+		signed: func(h http.Header, body []byte) []byte {
+			return append([]byte(h.Get("X-Webhook-Timestamp")), body...)
+		},
+		parse: parseCashfree,
+	},
+	"soundbox": {
+		name:            "soundbox",
+		signatureHeader: "X-Signature",
+		parse:           parseSoundbox,
+	},
+}
+
+// WebhookProviders returns the names of the supported providers.
+func WebhookProviders() []string {
+	names := make([]string, 0, len(webhookProviders))
+	for name := range webhookProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Razorpay sends payment.captured for UPI payments to the merchant's
+// account and qr_code.credited for payments to a QR code; the QR code id
+// routes the latter.
+func parseRazorpay(h http.Header, body []byte) (providerEvent, error) {
+	var p struct {
+		Event   string `json:"event"`
+		Payload struct {
+			Payment struct {
+				Entity struct {
+					ID           string `json:"id"`
+					Amount       int64  `json:"amount"` // paise
+					Currency     string `json:"currency"`
+					Status       string `json:"status"`
+					Method       string `json:"method"`
+					VPA          string `json:"vpa"`
+					Description  string `json:"description"`
+					CreatedAt    int64  `json:"created_at"`
+					AcquirerData struct {
+						RRN string `json:"rrn"`
+					} `json:"acquirer_data"`
+				} `json:"entity"`
+			} `json:"payment"`
+			QRCode struct {
+				Entity struct {
+					ID string `json:"id"`
+				} `json:"entity"`
+			} `json:"qr_code"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return providerEvent{}, ErrInvalidPayload
+	}
+	pay := p.Payload.Payment.Entity
+	ev := providerEvent{
+		EventID: h.Get("X-Razorpay-Event-Id"),
+		Target:  p.Payload.QRCode.Entity.ID,
+		Credit:  (p.Event == "payment.captured" || p.Event == "qr_code.credited") && pay.Status == "captured",
+	}
+	if ev.EventID == "" && pay.ID != "" {
+		ev.EventID = p.Event + ":" + pay.ID
+	}
+	if !ev.Credit {
+		return ev, nil
+	}
+	if pay.Amount <= 0 || (pay.Currency != "" && pay.Currency != "INR") {
+		return providerEvent{}, ErrInvalidPayload
+	}
+	ev.Payment = CreatePaymentRequest{
+		Channel:  webhookChannel(pay.Method),
+		Amount:   pay.Amount,
+		Time:     time.Unix(pay.CreatedAt, 0),
+		UPIRef:   pay.AcquirerData.RRN,
+		PayerVPA: strings.ToLower(pay.VPA),
+		Note:     pay.Description,
+	}
+	if pay.CreatedAt == 0 {
+		ev.Payment.Time = time.Now()
+	}
+	return ev, nil
+}
+
+// Cashfree sends PAYMENT_SUCCESS_WEBHOOK with the amount in rupees and the
+// UPI RRN as the bank reference. Its payloads carry nothing that tells
+// stores apart, so they go to the endpoint's store.
+func parseCashfree(h http.Header, body []byte) (providerEvent, error) {
+	var p struct {
+		Type string `json:"type"`
+		Data struct {
+			Payment struct {
+				CFPaymentID   json.Number `json:"cf_payment_id"`
+				PaymentStatus string      `json:"payment_status"`
+				PaymentAmount json.Number `json:"payment_amount"`
+				PaymentTime   string      `json:"payment_time"`
+				BankReference string      `json:"bank_reference"`
+				PaymentGroup  string      `json:"payment_group"`
+				PaymentMethod struct {
+					UPI struct {
+						UPIID string `json:"upi_id"`
+					} `json:"upi"`
+				} `json:"payment_method"`
+			} `json:"payment"`
+			CustomerDetails struct {
+				CustomerName string `json:"customer_name"`
+			} `json:"customer_details"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return providerEvent{}, ErrInvalidPayload
+	}
+	pay := p.Data.Payment
+	ev := providerEvent{
+		EventID: p.Type + ":" + pay.CFPaymentID.String(),
+		Credit:  p.Type == "PAYMENT_SUCCESS_WEBHOOK" && pay.PaymentStatus == "SUCCESS",
+	}
+	if !ev.Credit {
+		return ev, nil
+	}
+	amount, err := rupeesToPaise(pay.PaymentAmount.String())
+	if err != nil || amount <= 0 {
+		return providerEvent{}, ErrInvalidPayload
+	}
+	ev.Payment = CreatePaymentRequest{
+		Channel:   webhookChannel(pay.PaymentGroup),
+		Amount:    amount,
+		Time:      webhookTime(pay.PaymentTime),
+		UPIRef:    pay.BankReference,
+		PayerVPA:  strings.ToLower(pay.PaymentMethod.UPI.UPIID),
+		PayerName: p.Data.CustomerDetails.CustomerName,
+	}
+	return ev, nil
+}
+
+// Soundbox vendors are asked to send this flat payload, one per payment
+// announced, with the amount in paise and the device serial number as
+// device_id:
+//
+//	{"event_id": "...", "device_id": "SB123", "status": "SUCCESS", "amount": 25000,
+//	 "upi_ref": "407212345678", "payer_vpa": "rahul@okaxis", "payer_name": "RAHUL KUMAR",
+//	 "txn_time": "2024-03-12T14:22:05+05:30"}
+func parseSoundbox(h http.Header, body []byte) (providerEvent, error) {
+	var p struct {
+		EventID   string `json:"event_id"`
+		DeviceID  string `json:"device_id"`
+		Status    string `json:"status"`
+		Amount    int64  `json:"amount"`
+		UPIRef    string `json:"upi_ref"`
+		PayerVPA  string `json:"payer_vpa"`
+		PayerName string `json:"payer_name"`
+		TxnTime   string `json:"txn_time"`
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return providerEvent{}, ErrInvalidPayload
+	}
+	ev := providerEvent{
+		EventID: p.EventID,
+		Target:  p.DeviceID,
+		Credit:  strings.EqualFold(p.Status, "SUCCESS"),
+	}
+	if ev.EventID == "" && p.UPIRef != "" {
+		ev.EventID = p.DeviceID + ":" + p.UPIRef
+	}
+	if !ev.Credit {
+		return ev, nil
+	}
+	if p.Amount <= 0 {
+		return providerEvent{}, ErrInvalidPayload
+	}
+	ev.Payment = CreatePaymentRequest{
+		Channel:   ChannelUPI,
+		Amount:    p.Amount,
+		Time:      webhookTime(p.TxnTime),
+		UPIRef:    p.UPIRef,
+		PayerVPA:  strings.ToLower(p.PayerVPA),
+		PayerName: p.PayerName,
+	}
+	return ev, nil
+}
+
+func webhookChannel(method string) string {
+	if strings.EqualFold(method, "upi") {
+		return ChannelUPI
+	}
+	return ChannelOther
+}
+
+// webhookTime reads an RFC 3339 time; one without a zone is in IST. An
+// unreadable time falls back to now.
+func webhookTime(s string) time.Time {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, sms.IST); err == nil {
+			return t
+		}
+	}
+	return time.Now()
+}
+
+// rupeesToPaise reads "250.5" as 25050 without going through a float.
+func rupeesToPaise(s string) (int64, error) {
+	whole, frac, _ := strings.Cut(strings.TrimSpace(s), ".")
+	if len(frac) > 2 {
+		return 0, ErrInvalidPayload
+	}
+	frac += strings.Repeat("0", 2-len(frac))
+	rupees, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	paise, err := strconv.ParseInt(frac, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return rupees*100 + paise, nil
+}
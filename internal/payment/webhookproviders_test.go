@@ -0,0 +1,127 @@
+package payment
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"testing"
+)
+
+func TestRupeesToPaise(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"250", 25000, false},
+		{"250.5", 25050, false},
+		{"250.05", 25005, false},
+		{" 1.00 ", 100, false},
+		{"0.99", 99, false},
+		{"250.505", 0, true},
+		{"", 0, true},
+		{"12a", 0, true},
+		{"1.x", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := rupeesToPaise(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("rupeesToPaise(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("rupeesToPaise(%q) = %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookVerify(t *testing.T) {
+	const secret = "9c1e5b7f"
+	body := []byte(`{"event_id":"1","amount":25000}`)
+	sign := func(secret string, parts ...[]byte) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		for _, p := range parts {
+			mac.Write(p)
+		}
+		return mac.Sum(nil)
+	}
+	hexSig := hex.EncodeToString(sign(secret, body))
+	cashfreeSig := base64.StdEncoding.EncodeToString(sign(secret, []byte("1710233525000"), body))
+
+	tests := []struct {
+		name     string
+		provider string
+		header   http.Header
+		body     []byte
+		want     bool
+	}{
+		{
+			name:     "razorpay hex signature",
+			provider: "razorpay",
+			header:   http.Header{"X-Razorpay-Signature": {hexSig}},
+			body:     body,
+			want:     true,
+		},
+		{
+			name:     "soundbox signature with sha256= prefix",
+			provider: "soundbox",
+			header:   http.Header{"X-Signature": {"sha256=" + hexSig}},
+			body:     body,
+			want:     true,
+		},
+		{
+			name:     "cashfree base64 signature over timestamp and body",
+			provider: "cashfree",
+			header:   http.Header{"X-Webhook-Signature": {cashfreeSig}, "X-Webhook-Timestamp": {"1710233525000"}},
+			body:     body,
+			want:     true,
+		},
+		{
+			name:     "cashfree with a different timestamp",
+			provider: "cashfree",
+			header:   http.Header{"X-Webhook-Signature": {cashfreeSig}, "X-Webhook-Timestamp": {"1710233525001"}},
+			body:     body,
+		},
+		{
+			name:     "tampered body",
+			provider: "razorpay",
+			header:   http.Header{"X-Razorpay-Signature": {hexSig}},
+			body:     []byte(`{"event_id":"1","amount":99900}`),
+		},
+		{
+			name:     "wrong secret",
+			provider: "soundbox",
+			header:   http.Header{"X-Signature": {hex.EncodeToString(sign(secret+"x", body))}},
+			body:     body,
+		},
+		{
+			name:     "signature in another provider's header",
+			provider: "soundbox",
+			header:   http.Header{"X-Razorpay-Signature": {hexSig}},
+			body:     body,
+		},
+		{
+			name:     "not hex",
+			provider: "razorpay",
+			header:   http.Header{"X-Razorpay-Signature": {"not-a-signature"}},
+			body:     body,
+		},
+		{
+			name:     "missing",
+			provider: "razorpay",
+			header:   http.Header{},
+			body:     body,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := webhookProviders[tt.provider]
+			if got := p.verify(secret, tt.header, tt.body); got != tt.want {
+				t.Errorf("verify() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,11 +3,11 @@ package reporting
 import (
 	"net/http"
 	"strconv"
-	"time"
 
 	"github.com/gin-gonic/gin"
 
 	"upisettle/internal/auth"
+	"upisettle/internal/merchant"
 )
 
 func RegisterHTTP(rg *gin.RouterGroup, svc *Service) {
@@ -31,18 +31,14 @@ func RegisterHTTP(rg *gin.RouterGroup, svc *Service) {
 		}
 		storeID := uint(storeIDUint64)
 
-		dateStr := c.Query("date")
-		if dateStr == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "date query param is required (YYYY-MM-DD)"})
-			return
-		}
-		day, err := time.Parse("2006-01-02", dateStr)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid date format, expected YYYY-MM-DD"})
+		day, ok := merchant.QueryDay(c, svc.db, merchantID, "date")
+		if !ok {
 			return
 		}
 
-		summary, err := svc.GetDailySummary(merchantID, storeID, day)
+		includeClosed := c.Query("include_closed") == "true"
+
+		summary, err := svc.GetDailySummary(merchantID, storeID, day, includeClosed)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -70,18 +66,12 @@ func RegisterHTTP(rg *gin.RouterGroup, svc *Service) {
 		}
 		storeID := uint(storeIDUint64)
 
-		dateStr := c.Query("date")
-		if dateStr == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "date query param is required (YYYY-MM-DD)"})
-			return
-		}
-		day, err := time.Parse("2006-01-02", dateStr)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid date format, expected YYYY-MM-DD"})
+		day, ok := merchant.QueryDay(c, svc.db, merchantID, "date")
+		if !ok {
 			return
 		}
 
-		exceptions, err := svc.ListExceptions(merchantID, storeID, day)
+		exceptions, err := svc.ListExceptions(merchantID, storeID, day, c.Query("status"))
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -26,11 +26,27 @@ type DailySummary struct {
 	CashTotalAmount   int64  `json:"cash_total_amount"`
 	MatchedOrders     int    `json:"matched_orders"`
 	UnmatchedOrders   int    `json:"unmatched_orders"`
+	PartialOrders     int    `json:"partial_orders"`
+	OutstandingAmount int64  `json:"outstanding_amount"`
 	ExceptionsCount   int    `json:"exceptions_count"`
 	ExceptionsAmount  int64  `json:"exceptions_amount"`
+	// OverpaidAmount and UnderpaidAmount sum the differences on OVERPAYMENT,
+	// UNDERPAYMENT and ROUNDING exceptions, split by direction.
+	OverpaidAmount  int64 `json:"overpaid_amount"`
+	UnderpaidAmount int64 `json:"underpaid_amount"`
+	// ExpectedCash is the opening float plus cash payments minus cash
+	// payouts; CountedCash is what the closing count found, nil until the
+	// drawer is counted.
+	OpeningFloat      int64  `json:"opening_float"`
+	CashPayoutsAmount int64  `json:"cash_payouts_amount"`
+	ExpectedCash      int64  `json:"expected_cash"`
+	CountedCash       *int64 `json:"counted_cash"`
+	CashDifference    int64  `json:"cash_difference"`
 }
 
-func (s *Service) GetDailySummary(merchantID, storeID uint, day time.Time) (DailySummary, error) {
+// GetDailySummary summarises a store's day. Only open exceptions are counted
+// unless includeClosed is set.
+func (s *Service) GetDailySummary(merchantID, storeID uint, day time.Time, includeClosed bool) (DailySummary, error) {
 	summary := DailySummary{
 		Date: day.Format("2006-01-02"),
 	}
@@ -48,11 +64,18 @@ func (s *Service) GetDailySummary(merchantID, storeID uint, day time.Time) (Dail
 	for _, o := range orders {
 		summary.TotalOrders++
 		summary.TotalSalesAmount += o.Amount
-		if o.Status == order.StatusPending {
+		switch o.Status {
+		case order.StatusPending:
 			summary.UnmatchedOrders++
-		} else {
+		case order.StatusPartial:
+			summary.UnmatchedOrders++
+			summary.PartialOrders++
+		default:
 			summary.MatchedOrders++
 		}
+		if o.Status != order.StatusCancelled && o.Outstanding() > 0 {
+			summary.OutstandingAmount += o.Outstanding()
+		}
 	}
 
 	var payments []payment.Payment
@@ -63,6 +86,10 @@ func (s *Service) GetDailySummary(merchantID, storeID uint, day time.Time) (Dail
 	}
 
 	for _, p := range payments {
+		// A payment reported twice only counts once.
+		if p.DuplicateOfID != nil {
+			continue
+		}
 		switch p.Channel {
 		case payment.ChannelUPI:
 			summary.UPITotalAmount += p.Amount
@@ -71,10 +98,34 @@ func (s *Service) GetDailySummary(merchantID, storeID uint, day time.Time) (Dail
 		}
 	}
 
+	var payouts int64
+	if err := s.db.Model(&payment.CashPayout{}).
+		Where("merchant_id = ? AND store_id = ? AND time >= ? AND time < ?", merchantID, storeID, start, end).
+		Select("COALESCE(SUM(amount), 0)").Scan(&payouts).Error; err != nil {
+		return summary, err
+	}
+	summary.CashPayoutsAmount = payouts
+
+	var drawers []matching.CashDrawer
+	if err := s.db.Where("merchant_id = ? AND store_id = ? AND business_date = ?", merchantID, storeID, start).
+		Limit(1).Find(&drawers).Error; err != nil {
+		return summary, err
+	}
+	if len(drawers) > 0 {
+		summary.OpeningFloat = drawers[0].OpeningFloat
+		summary.CountedCash = drawers[0].CountedAmount
+	}
+	summary.ExpectedCash = summary.OpeningFloat + summary.CashTotalAmount - summary.CashPayoutsAmount
+	if summary.CountedCash != nil {
+		summary.CashDifference = *summary.CountedCash - summary.ExpectedCash
+	}
+
 	var exceptions []matching.Exception
-	if err := s.db.
-		Where("merchant_id = ? AND store_id = ? AND created_at >= ? AND created_at < ?", merchantID, storeID, start, end).
-		Find(&exceptions).Error; err != nil {
+	q := s.db.Where("merchant_id = ? AND store_id = ? AND created_at >= ? AND created_at < ?", merchantID, storeID, start, end)
+	if !includeClosed {
+		q = q.Where("status IN ?", matching.OpenExceptionStatuses)
+	}
+	if err := q.Find(&exceptions).Error; err != nil {
 		return summary, err
 	}
 
@@ -82,6 +133,28 @@ func (s *Service) GetDailySummary(merchantID, storeID uint, day time.Time) (Dail
 
 	// Approximate exceptions amount: sum associated order or payment amounts.
 	for _, ex := range exceptions {
+		// A drawer that doesn't balance counts for the cash missing or
+		// left over.
+		if ex.CashDrawerID != nil {
+			if ex.DifferenceAmount < 0 {
+				summary.ExceptionsAmount += -ex.DifferenceAmount
+			} else {
+				summary.ExceptionsAmount += ex.DifferenceAmount
+			}
+			continue
+		}
+		// Amount differences count for the difference only; the order
+		// itself was settled.
+		if ex.DifferenceAmount > 0 {
+			summary.OverpaidAmount += ex.DifferenceAmount
+			summary.ExceptionsAmount += ex.DifferenceAmount
+			continue
+		}
+		if ex.DifferenceAmount < 0 {
+			summary.UnderpaidAmount += -ex.DifferenceAmount
+			summary.ExceptionsAmount += -ex.DifferenceAmount
+			continue
+		}
 		if ex.OrderID != nil {
 			var o order.Order
 			if err := s.db.First(&o, *ex.OrderID).Error; err == nil {
@@ -101,37 +174,50 @@ func (s *Service) GetDailySummary(merchantID, storeID uint, day time.Time) (Dail
 }
 
 type ExceptionDTO struct {
-	ID         uint      `json:"id"`
-	Type       string    `json:"type"`
-	Reason     string    `json:"reason"`
-	OrderID    *uint     `json:"order_id,omitempty"`
-	PaymentID  *uint     `json:"payment_id,omitempty"`
-	Resolved   bool      `json:"resolved"`
-	CreatedAt  time.Time `json:"created_at"`
+	ID               uint      `json:"id"`
+	Type             string    `json:"type"`
+	Reason           string    `json:"reason"`
+	DifferenceAmount int64     `json:"difference_amount,omitempty"`
+	OrderID          *uint     `json:"order_id,omitempty"`
+	PaymentID        *uint     `json:"payment_id,omitempty"`
+	CashDrawerID     *uint     `json:"cash_drawer_id,omitempty"`
+	Status           string    `json:"status"`
+	ResolutionReason string    `json:"resolution_reason,omitempty"`
+	AssigneeID       *uint     `json:"assignee_id,omitempty"`
+	Resolved         bool      `json:"resolved"`
+	CreatedAt        time.Time `json:"created_at"`
 }
 
-func (s *Service) ListExceptions(merchantID, storeID uint, day time.Time) ([]ExceptionDTO, error) {
+// ListExceptions lists a store's exceptions for a day, optionally filtered
+// by workflow status.
+func (s *Service) ListExceptions(merchantID, storeID uint, day time.Time, status string) ([]ExceptionDTO, error) {
 	start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
 	end := start.Add(24 * time.Hour)
 
 	var exceptions []matching.Exception
-	if err := s.db.
-		Where("merchant_id = ? AND store_id = ? AND created_at >= ? AND created_at < ?", merchantID, storeID, start, end).
-		Order("created_at ASC").
-		Find(&exceptions).Error; err != nil {
+	q := s.db.Where("merchant_id = ? AND store_id = ? AND created_at >= ? AND created_at < ?", merchantID, storeID, start, end)
+	if status != "" {
+		q = q.Where("status = ?", status)
+	}
+	if err := q.Order("created_at ASC").Find(&exceptions).Error; err != nil {
 		return nil, err
 	}
 
 	result := make([]ExceptionDTO, 0, len(exceptions))
 	for _, ex := range exceptions {
 		result = append(result, ExceptionDTO{
-			ID:        ex.ID,
-			Type:      ex.Type,
-			Reason:    ex.Reason,
-			OrderID:   ex.OrderID,
-			PaymentID: ex.PaymentID,
-			Resolved:  ex.Resolved,
-			CreatedAt: ex.CreatedAt,
+			ID:               ex.ID,
+			Type:             ex.Type,
+			Reason:           ex.Reason,
+			DifferenceAmount: ex.DifferenceAmount,
+			OrderID:          ex.OrderID,
+			PaymentID:        ex.PaymentID,
+			CashDrawerID:     ex.CashDrawerID,
+			Status:           ex.Status,
+			ResolutionReason: ex.ResolutionReason,
+			AssigneeID:       ex.AssigneeID,
+			Resolved:         ex.Resolved,
+			CreatedAt:        ex.CreatedAt,
 		})
 	}
 	return result, nil
@@ -15,6 +15,8 @@ import (
 func NewDB(cfg config.Config, log upilog.Logger) (*gorm.DB, error) {
 	gormCfg := &gorm.Config{
 		Logger: logger.Default.LogMode(logger.Info),
+		// Report unique violations as gorm.ErrDuplicatedKey.
+		TranslateError: true,
 	}
 
 	db, err := gorm.Open(postgres.Open(cfg.DatabaseURL), gormCfg)
@@ -0,0 +1,7 @@
+ALTER TABLE matches DROP COLUMN IF EXISTS kind;
+ALTER TABLE matches DROP COLUMN IF EXISTS amount;
+
+DROP INDEX IF EXISTS idx_payments_order_id;
+ALTER TABLE payments DROP COLUMN IF EXISTS order_id;
+
+ALTER TABLE orders DROP COLUMN IF EXISTS paid_amount;
@@ -0,0 +1,9 @@
+ALTER TABLE orders ADD COLUMN paid_amount BIGINT NOT NULL DEFAULT 0;
+UPDATE orders SET paid_amount = amount WHERE status IN ('PAID_UPI', 'PAID_CASH');
+
+ALTER TABLE payments ADD COLUMN order_id INT REFERENCES orders(id) ON DELETE SET NULL;
+CREATE INDEX idx_payments_order_id ON payments(order_id);
+
+ALTER TABLE matches ADD COLUMN amount BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE matches ADD COLUMN kind VARCHAR(16) NOT NULL DEFAULT 'SINGLE';
+UPDATE matches SET amount = payments.amount FROM payments WHERE payments.id = matches.payment_id;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_exceptions_open;
+DROP INDEX IF EXISTS idx_exceptions_payment_id;
+DROP INDEX IF EXISTS idx_exceptions_order_id;
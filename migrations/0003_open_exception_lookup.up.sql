@@ -0,0 +1,19 @@
+CREATE INDEX idx_exceptions_order_id ON exceptions(order_id);
+CREATE INDEX idx_exceptions_payment_id ON exceptions(payment_id);
+CREATE INDEX idx_exceptions_open ON exceptions(merchant_id, store_id, type) WHERE resolved = FALSE;
+
+-- Close duplicate open exceptions left by non-idempotent reconcile runs,
+-- keeping the oldest one per type/order/payment.
+UPDATE exceptions e
+SET resolved = TRUE, resolved_at = NOW(), updated_at = NOW()
+WHERE e.resolved = FALSE
+  AND EXISTS (
+      SELECT 1 FROM exceptions o
+      WHERE o.resolved = FALSE
+        AND o.merchant_id = e.merchant_id
+        AND o.store_id = e.store_id
+        AND o.type = e.type
+        AND o.order_id IS NOT DISTINCT FROM e.order_id
+        AND o.payment_id IS NOT DISTINCT FROM e.payment_id
+        AND o.id < e.id
+  );
@@ -0,0 +1,3 @@
+ALTER TABLE exceptions DROP COLUMN IF EXISTS run_id;
+ALTER TABLE matches DROP COLUMN IF EXISTS run_id;
+DROP TABLE IF EXISTS reconciliation_runs;
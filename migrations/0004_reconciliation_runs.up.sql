@@ -0,0 +1,26 @@
+CREATE TABLE reconciliation_runs (
+    id SERIAL PRIMARY KEY,
+    merchant_id INT NOT NULL REFERENCES merchants(id) ON DELETE CASCADE,
+    store_id INT NOT NULL REFERENCES stores(id) ON DELETE CASCADE,
+    business_date DATE NOT NULL,
+    triggered_by INT REFERENCES users(id) ON DELETE SET NULL,
+    strategy VARCHAR(32) NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    error VARCHAR(1024),
+    started_at TIMESTAMPTZ NOT NULL,
+    finished_at TIMESTAMPTZ,
+    matched_orders INT NOT NULL DEFAULT 0,
+    unmatched_orders INT NOT NULL DEFAULT 0,
+    unmatched_payments INT NOT NULL DEFAULT 0,
+    resolved_exceptions INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_reconciliation_runs_store_date ON reconciliation_runs(merchant_id, store_id, business_date);
+
+ALTER TABLE matches ADD COLUMN run_id INT REFERENCES reconciliation_runs(id) ON DELETE SET NULL;
+CREATE INDEX idx_matches_run_id ON matches(run_id);
+
+ALTER TABLE exceptions ADD COLUMN run_id INT REFERENCES reconciliation_runs(id) ON DELETE SET NULL;
+CREATE INDEX idx_exceptions_run_id ON exceptions(run_id);
@@ -0,0 +1 @@
+ALTER TABLE matches ADD COLUMN reason VARCHAR(255);
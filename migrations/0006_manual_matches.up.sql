@@ -0,0 +1 @@
+ALTER TABLE matches ADD COLUMN matched_by INT REFERENCES users(id) ON DELETE SET NULL;
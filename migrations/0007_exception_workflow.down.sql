@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS exception_events;
+
+ALTER TABLE exceptions DROP COLUMN IF EXISTS assignee_id;
+ALTER TABLE exceptions DROP COLUMN IF EXISTS resolution_reason;
+ALTER TABLE exceptions DROP COLUMN IF EXISTS status;
@@ -0,0 +1,19 @@
+ALTER TABLE exceptions ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'OPEN';
+ALTER TABLE exceptions ADD COLUMN resolution_reason VARCHAR(255);
+ALTER TABLE exceptions ADD COLUMN assignee_id INT REFERENCES users(id) ON DELETE SET NULL;
+UPDATE exceptions SET status = 'RESOLVED' WHERE resolved = TRUE;
+
+CREATE INDEX idx_exceptions_assignee_id ON exceptions(assignee_id);
+
+CREATE TABLE exception_events (
+    id SERIAL PRIMARY KEY,
+    exception_id INT NOT NULL REFERENCES exceptions(id) ON DELETE CASCADE,
+    from_status VARCHAR(16) NOT NULL,
+    to_status VARCHAR(16) NOT NULL,
+    assignee_id INT REFERENCES users(id) ON DELETE SET NULL,
+    note VARCHAR(1024),
+    user_id INT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_exception_events_exception_id ON exception_events(exception_id);
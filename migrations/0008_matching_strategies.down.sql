@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS matching_settings;
+
+ALTER TABLE matches DROP COLUMN IF EXISTS strategy;
+ALTER TABLE payments DROP COLUMN IF EXISTS note;
+ALTER TABLE orders DROP COLUMN IF EXISTS customer_vpa;
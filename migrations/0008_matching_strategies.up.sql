@@ -0,0 +1,15 @@
+ALTER TABLE orders ADD COLUMN customer_vpa VARCHAR(255);
+ALTER TABLE payments ADD COLUMN note VARCHAR(255);
+ALTER TABLE matches ADD COLUMN strategy VARCHAR(64);
+
+CREATE TABLE matching_settings (
+    id SERIAL PRIMARY KEY,
+    merchant_id INT NOT NULL REFERENCES merchants(id) ON DELETE CASCADE,
+    store_id INT REFERENCES stores(id) ON DELETE CASCADE,
+    strategies VARCHAR(512) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX idx_matching_settings_store ON matching_settings(merchant_id, store_id) WHERE store_id IS NOT NULL;
+CREATE UNIQUE INDEX idx_matching_settings_merchant ON matching_settings(merchant_id) WHERE store_id IS NULL;
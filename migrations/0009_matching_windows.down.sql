@@ -0,0 +1,4 @@
+ALTER TABLE matching_settings DROP COLUMN IF EXISTS lookahead_minutes;
+ALTER TABLE matching_settings DROP COLUMN IF EXISTS lookback_minutes;
+UPDATE matching_settings SET strategies = '' WHERE strategies IS NULL;
+ALTER TABLE matching_settings ALTER COLUMN strategies SET NOT NULL;
@@ -0,0 +1,3 @@
+ALTER TABLE matching_settings ALTER COLUMN strategies DROP NOT NULL;
+ALTER TABLE matching_settings ADD COLUMN lookback_minutes INT;
+ALTER TABLE matching_settings ADD COLUMN lookahead_minutes INT;
@@ -0,0 +1,4 @@
+ALTER TABLE exceptions DROP COLUMN IF EXISTS difference_amount;
+
+ALTER TABLE matching_settings DROP COLUMN IF EXISTS tolerance_pct;
+ALTER TABLE matching_settings DROP COLUMN IF EXISTS tolerance_paise;
@@ -0,0 +1,4 @@
+ALTER TABLE matching_settings ADD COLUMN tolerance_paise BIGINT;
+ALTER TABLE matching_settings ADD COLUMN tolerance_pct DOUBLE PRECISION;
+
+ALTER TABLE exceptions ADD COLUMN difference_amount BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_matches_single_payment;
+DROP INDEX IF EXISTS idx_matches_order_payment;
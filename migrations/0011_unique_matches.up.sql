@@ -0,0 +1,27 @@
+-- Remove matches that concurrent reconcile runs inserted twice, keeping the
+-- oldest, and take their amounts back off the orders they were credited to.
+WITH dup AS (
+    DELETE FROM matches m
+    USING matches k
+    WHERE m.payment_id = k.payment_id
+      AND m.id > k.id
+      AND (m.order_id = k.order_id OR (m.kind <> 'COMBINED' AND k.kind <> 'COMBINED'))
+    RETURNING m.id, m.order_id, m.amount
+), per_order AS (
+    SELECT order_id, SUM(amount) AS amount
+    FROM (SELECT DISTINCT id, order_id, amount FROM dup) d
+    GROUP BY order_id
+)
+UPDATE orders o
+SET paid_amount = GREATEST(o.paid_amount - p.amount, 0),
+    status = CASE WHEN o.paid_amount - p.amount <= 0 THEN 'PENDING' ELSE 'PARTIAL' END,
+    paid_at = NULL,
+    updated_at = NOW()
+FROM per_order p
+WHERE o.id = p.order_id
+  AND o.paid_amount - p.amount < o.amount;
+
+-- A pair is matched at most once, and a payment belongs to a single order
+-- unless it is a combined bill.
+CREATE UNIQUE INDEX idx_matches_order_payment ON matches(order_id, payment_id);
+CREATE UNIQUE INDEX idx_matches_single_payment ON matches(payment_id) WHERE kind <> 'COMBINED';
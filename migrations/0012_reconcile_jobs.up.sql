@@ -0,0 +1,20 @@
+CREATE TABLE reconcile_jobs (
+    id SERIAL PRIMARY KEY,
+    merchant_id INT NOT NULL REFERENCES merchants(id) ON DELETE CASCADE,
+    store_id INT NOT NULL REFERENCES stores(id) ON DELETE CASCADE,
+    business_date DATE NOT NULL,
+    mode VARCHAR(32) NOT NULL,
+    triggered_by INT REFERENCES users(id) ON DELETE SET NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'QUEUED',
+    progress INT NOT NULL DEFAULT 0,
+    attempts INT NOT NULL DEFAULT 0,
+    run_id INT REFERENCES reconciliation_runs(id) ON DELETE SET NULL,
+    error VARCHAR(1024),
+    started_at TIMESTAMPTZ,
+    finished_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_reconcile_jobs_merchant_store ON reconcile_jobs(merchant_id, store_id);
+CREATE INDEX idx_reconcile_jobs_pending ON reconcile_jobs(id) WHERE status IN ('QUEUED', 'RUNNING');
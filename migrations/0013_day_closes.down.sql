@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS day_closes;
+
+ALTER TABLE reconcile_jobs DROP COLUMN IF EXISTS timezone;
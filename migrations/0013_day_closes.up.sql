@@ -0,0 +1,19 @@
+ALTER TABLE reconcile_jobs ADD COLUMN timezone VARCHAR(100) NOT NULL DEFAULT 'UTC';
+
+CREATE TABLE day_closes (
+    id SERIAL PRIMARY KEY,
+    merchant_id INT NOT NULL REFERENCES merchants(id) ON DELETE CASCADE,
+    store_id INT NOT NULL REFERENCES stores(id) ON DELETE CASCADE,
+    business_date DATE NOT NULL,
+    timezone VARCHAR(100) NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    job_id INT REFERENCES reconcile_jobs(id) ON DELETE SET NULL,
+    run_id INT REFERENCES reconciliation_runs(id) ON DELETE SET NULL,
+    error VARCHAR(1024),
+    closed_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX idx_day_closes_store_date ON day_closes(store_id, business_date);
+CREATE INDEX idx_day_closes_pending ON day_closes(id) WHERE status = 'PENDING';
@@ -0,0 +1,3 @@
+ALTER TABLE exceptions DROP COLUMN IF EXISTS duplicate_of_id;
+DROP INDEX IF EXISTS idx_payments_merchant_upi_ref;
+ALTER TABLE payments DROP COLUMN IF EXISTS duplicate_of_id;
@@ -0,0 +1,27 @@
+ALTER TABLE payments ADD COLUMN duplicate_of_id INT REFERENCES payments(id) ON DELETE SET NULL;
+CREATE INDEX idx_payments_duplicate_of_id ON payments(duplicate_of_id);
+
+-- Mark repeated UPI refs already stored as duplicates of the oldest copy,
+-- so the unique index below can be built.
+UPDATE payments p
+SET duplicate_of_id = (
+        SELECT MIN(o.id) FROM payments o
+        WHERE o.merchant_id = p.merchant_id AND o.upi_ref = p.upi_ref
+    ),
+    updated_at = NOW()
+WHERE COALESCE(p.upi_ref, '') <> ''
+  AND EXISTS (
+      SELECT 1 FROM payments o
+      WHERE o.merchant_id = p.merchant_id
+        AND o.upi_ref = p.upi_ref
+        AND o.id < p.id
+  );
+
+CREATE UNIQUE INDEX idx_payments_merchant_upi_ref ON payments(merchant_id, upi_ref)
+    WHERE upi_ref <> '' AND duplicate_of_id IS NULL;
+
+-- A DUPLICATE_PAYMENT exception records the payment it repeats, so that
+-- reopening an ignored flag can mark the payment as a duplicate again.
+ALTER TABLE exceptions ADD COLUMN duplicate_of_id INT REFERENCES payments(id);
+ALTER TABLE exceptions ADD CONSTRAINT chk_exceptions_duplicate_of
+    CHECK (type <> 'DUPLICATE_PAYMENT' OR duplicate_of_id IS NOT NULL);
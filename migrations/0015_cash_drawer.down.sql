@@ -0,0 +1,4 @@
+ALTER TABLE exceptions DROP COLUMN IF EXISTS cash_drawer_id;
+
+DROP TABLE IF EXISTS cash_drawers;
+DROP TABLE IF EXISTS cash_payouts;
@@ -0,0 +1,33 @@
+CREATE TABLE cash_payouts (
+    id SERIAL PRIMARY KEY,
+    merchant_id INT NOT NULL REFERENCES merchants(id) ON DELETE CASCADE,
+    store_id INT NOT NULL REFERENCES stores(id) ON DELETE CASCADE,
+    amount BIGINT NOT NULL,
+    reason VARCHAR(255),
+    time TIMESTAMPTZ NOT NULL,
+    paid_by INT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_cash_payouts_merchant_store_time ON cash_payouts(merchant_id, store_id, time);
+
+CREATE TABLE cash_drawers (
+    id SERIAL PRIMARY KEY,
+    merchant_id INT NOT NULL REFERENCES merchants(id) ON DELETE CASCADE,
+    store_id INT NOT NULL REFERENCES stores(id) ON DELETE CASCADE,
+    business_date DATE NOT NULL,
+    opening_float BIGINT NOT NULL DEFAULT 0,
+    denominations JSONB,
+    counted_amount BIGINT,
+    expected_amount BIGINT NOT NULL DEFAULT 0,
+    difference BIGINT NOT NULL DEFAULT 0,
+    counted_by INT REFERENCES users(id) ON DELETE SET NULL,
+    counted_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX idx_cash_drawers_store_date ON cash_drawers(store_id, business_date);
+
+ALTER TABLE exceptions ADD COLUMN cash_drawer_id INT REFERENCES cash_drawers(id) ON DELETE SET NULL;
+CREATE INDEX idx_exceptions_cash_drawer_id ON exceptions(cash_drawer_id);
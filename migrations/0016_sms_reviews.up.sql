@@ -0,0 +1,18 @@
+CREATE TABLE sms_reviews (
+    id SERIAL PRIMARY KEY,
+    merchant_id INT NOT NULL REFERENCES merchants(id) ON DELETE CASCADE,
+    store_id INT NOT NULL REFERENCES stores(id) ON DELETE CASCADE,
+    sender VARCHAR(64) NOT NULL,
+    body TEXT NOT NULL,
+    message_id VARCHAR(255),
+    received_at TIMESTAMPTZ NOT NULL,
+    error VARCHAR(255),
+    status VARCHAR(16) NOT NULL DEFAULT 'PENDING',
+    payment_id INT REFERENCES payments(id) ON DELETE SET NULL,
+    reviewed_by INT REFERENCES users(id) ON DELETE SET NULL,
+    reviewed_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_sms_reviews_store_status ON sms_reviews(merchant_id, store_id, status, received_at);
@@ -0,0 +1,6 @@
+ALTER TABLE sms_reviews DROP COLUMN IF EXISTS raw_message_id;
+
+ALTER TABLE payments DROP COLUMN IF EXISTS raw_message_id;
+ALTER TABLE payments ADD COLUMN raw_message_id VARCHAR(255);
+
+DROP TABLE IF EXISTS raw_messages;
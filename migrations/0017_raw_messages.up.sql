@@ -0,0 +1,24 @@
+CREATE TABLE raw_messages (
+    id SERIAL PRIMARY KEY,
+    merchant_id INT NOT NULL REFERENCES merchants(id) ON DELETE CASCADE,
+    store_id INT NOT NULL REFERENCES stores(id) ON DELETE CASCADE,
+    sender VARCHAR(64) NOT NULL,
+    body TEXT NOT NULL,
+    device_id VARCHAR(255),
+    message_id VARCHAR(255),
+    received_at TIMESTAMPTZ NOT NULL,
+    content_hash VARCHAR(64) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_raw_messages_merchant_received_at ON raw_messages(merchant_id, received_at);
+CREATE INDEX idx_raw_messages_content_hash ON raw_messages(merchant_id, store_id, content_hash);
+
+-- raw_message_id only ever held the id a device gave its SMS, which points
+-- at nothing the server kept; it now references the archive.
+ALTER TABLE payments DROP COLUMN raw_message_id;
+ALTER TABLE payments ADD COLUMN raw_message_id INT REFERENCES raw_messages(id) ON DELETE SET NULL;
+CREATE INDEX idx_payments_raw_message_id ON payments(raw_message_id);
+
+ALTER TABLE sms_reviews ADD COLUMN raw_message_id INT REFERENCES raw_messages(id) ON DELETE SET NULL;
+CREATE INDEX idx_sms_reviews_raw_message_id ON sms_reviews(raw_message_id);
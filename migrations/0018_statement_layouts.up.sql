@@ -0,0 +1,18 @@
+CREATE TABLE statement_layouts (
+    id SERIAL PRIMARY KEY,
+    merchant_id INT NOT NULL REFERENCES merchants(id) ON DELETE CASCADE,
+    name VARCHAR(64) NOT NULL,
+    date_column VARCHAR(128) NOT NULL,
+    time_column VARCHAR(128),
+    narration_column VARCHAR(128) NOT NULL,
+    ref_column VARCHAR(128),
+    credit_column VARCHAR(128),
+    debit_column VARCHAR(128),
+    amount_column VARCHAR(128),
+    dr_cr_column VARCHAR(128),
+    date_format VARCHAR(32),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX idx_statement_layouts_name ON statement_layouts(merchant_id, name);
@@ -0,0 +1,17 @@
+CREATE TABLE idempotency_keys (
+    id SERIAL PRIMARY KEY,
+    merchant_id INT NOT NULL REFERENCES merchants(id) ON DELETE CASCADE,
+    key VARCHAR(255) NOT NULL,
+    method VARCHAR(16) NOT NULL,
+    path VARCHAR(512) NOT NULL,
+    request_hash VARCHAR(64) NOT NULL,
+    response_status INT NOT NULL DEFAULT 0,
+    response_body BYTEA,
+    content_type VARCHAR(255),
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX idx_idempotency_keys_key ON idempotency_keys(merchant_id, key);
+CREATE INDEX idx_idempotency_keys_expires_at ON idempotency_keys(merchant_id, expires_at);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_raw_messages_message_id;
+ALTER TABLE raw_messages DROP COLUMN IF EXISTS duplicate_of_id;
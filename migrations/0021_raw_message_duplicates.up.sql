@@ -0,0 +1,4 @@
+-- Every delivery of an SMS is archived; a redelivery points at the first copy.
+ALTER TABLE raw_messages ADD COLUMN duplicate_of_id INT REFERENCES raw_messages(id) ON DELETE SET NULL;
+CREATE INDEX idx_raw_messages_duplicate_of_id ON raw_messages(duplicate_of_id);
+CREATE INDEX idx_raw_messages_message_id ON raw_messages(merchant_id, store_id, device_id, message_id);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS idx_exceptions_duplicate_payment;
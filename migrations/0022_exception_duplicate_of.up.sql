@@ -0,0 +1,38 @@
+-- Databases that ran 0014 before it gave exceptions duplicate_of_id have
+-- DUPLICATE_PAYMENT exceptions without it; recover it for those.
+ALTER TABLE exceptions ADD COLUMN IF NOT EXISTS duplicate_of_id INT REFERENCES payments(id);
+
+-- The payment of an open or resolved flag still points at its original.
+UPDATE exceptions e
+SET duplicate_of_id = p.duplicate_of_id
+FROM payments p
+WHERE e.type = 'DUPLICATE_PAYMENT'
+  AND e.duplicate_of_id IS NULL
+  AND p.id = e.payment_id
+  AND p.duplicate_of_id IS NOT NULL;
+
+-- Ignoring a flag cleared the payment's pointer; the original is then only
+-- named in the reason those exceptions were raised with.
+UPDATE exceptions
+SET duplicate_of_id = substring(reason FROM '^same amount and payer VPA as payment ([0-9]+) within seconds')::INT
+WHERE type = 'DUPLICATE_PAYMENT'
+  AND duplicate_of_id IS NULL;
+
+-- Stop rather than leave flags that can't be reopened correctly.
+DO $$
+DECLARE
+    missing INT;
+BEGIN
+    SELECT COUNT(*) INTO missing FROM exceptions
+    WHERE type = 'DUPLICATE_PAYMENT' AND duplicate_of_id IS NULL;
+    IF missing > 0 THEN
+        RAISE EXCEPTION '% DUPLICATE_PAYMENT exceptions have no recoverable duplicate_of_id; set it by hand and rerun', missing;
+    END IF;
+END $$;
+
+ALTER TABLE exceptions DROP CONSTRAINT IF EXISTS chk_exceptions_duplicate_of;
+ALTER TABLE exceptions ADD CONSTRAINT chk_exceptions_duplicate_of
+    CHECK (type <> 'DUPLICATE_PAYMENT' OR duplicate_of_id IS NOT NULL);
+
+-- One duplicate flag per payment, whether raised on ingestion or by a run.
+CREATE UNIQUE INDEX idx_exceptions_duplicate_payment ON exceptions(payment_id) WHERE type = 'DUPLICATE_PAYMENT';
@@ -0,0 +1,8 @@
+DELETE FROM matches WHERE removed_at IS NOT NULL;
+DROP INDEX IF EXISTS idx_matches_single_payment;
+DROP INDEX IF EXISTS idx_matches_order_payment;
+CREATE UNIQUE INDEX idx_matches_order_payment ON matches(order_id, payment_id);
+CREATE UNIQUE INDEX idx_matches_single_payment ON matches(payment_id) WHERE kind <> 'COMBINED';
+DROP INDEX IF EXISTS idx_matches_removed_at;
+ALTER TABLE matches DROP COLUMN IF EXISTS removed_by;
+ALTER TABLE matches DROP COLUMN IF EXISTS removed_at;
@@ -0,0 +1,12 @@
+-- An unmatch keeps the match, marked as removed, so run and exception
+-- history still point at it.
+ALTER TABLE matches ADD COLUMN removed_at TIMESTAMPTZ;
+ALTER TABLE matches ADD COLUMN removed_by INT REFERENCES users(id) ON DELETE SET NULL;
+CREATE INDEX idx_matches_removed_at ON matches(removed_at);
+
+-- Only live matches count towards the uniqueness rules, so a removed pair
+-- can be matched again.
+DROP INDEX IF EXISTS idx_matches_order_payment;
+DROP INDEX IF EXISTS idx_matches_single_payment;
+CREATE UNIQUE INDEX idx_matches_order_payment ON matches(order_id, payment_id) WHERE removed_at IS NULL;
+CREATE UNIQUE INDEX idx_matches_single_payment ON matches(payment_id) WHERE kind <> 'COMBINED' AND removed_at IS NULL;